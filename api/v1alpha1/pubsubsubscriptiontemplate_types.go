@@ -20,26 +20,64 @@ import (
 	pubsub "github.com/GoogleCloudPlatform/k8s-config-connector/pkg/apis/pubsub/v1beta1"
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"reflect"
 )
 
 // EDIT THIS FILE!  THIS IS SCAFFOLDING FOR YOU TO OWN!
 // NOTE: json tags are required.  Any new fields you add must have json tags for the fields to be serialized.
 
+// TemplateRef references another template.
+type TemplateRef struct {
+	// Name of the referenced template, rendered like any string field.
+	Name string `json:"name"`
+	// Namespace of the referenced template, defaults to the namespace of the referencing template.
+	// +optional
+	Namespace string `json:"namespace,omitempty"`
+}
+
+// PubSubSubscriptionTemplateSpec defines the desired state of PubSubSubscriptionTemplate
+type PubSubSubscriptionTemplateSpec struct {
+	pubsub.PubSubSubscriptionSpec `json:",inline"`
+
+	// TopicTemplateRef references the PubSubTopicTemplate whose rendered PubSubTopic is used as topicRef.
+	// +optional
+	TopicTemplateRef *TemplateRef `json:"topicTemplateRef,omitempty"`
+}
+
 // PubSubSubscriptionTemplateStatus defines the observed state of PubSubSubscriptionTemplate
 type PubSubSubscriptionTemplateStatus struct {
-	Ref v1.ObjectReference `json:"ref,omitempty"`
+	Ref        v1.ObjectReference `json:"ref,omitempty"`
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+	// Violations lists the TemplatePolicy rules the rendered resource does not satisfy.
+	Violations []PolicyViolation `json:"violations,omitempty"`
 }
 
 //+kubebuilder:object:root=true
 //+kubebuilder:subresource:status
+//+kubebuilder:storageversion
 
 // PubSubSubscriptionTemplate is the Schema for the pubsubsubscriptiontemplates API
 type PubSubSubscriptionTemplate struct {
 	metav1.TypeMeta   `json:",inline"`
 	metav1.ObjectMeta `json:"metadata,omitempty"`
 
-	Spec   pubsub.PubSubSubscriptionSpec    `json:"spec,omitempty"`
+	Spec   PubSubSubscriptionTemplateSpec   `json:"spec,omitempty"`
 	Status PubSubSubscriptionTemplateStatus `json:"status,omitempty"`
+
+	// Templated holds the spec fields set to a template expression although their KCC type is not a string.
+	Templated TemplatedFields `json:"-"`
+}
+
+func (t *PubSubSubscriptionTemplate) UnmarshalJSON(data []byte) error {
+	type plain PubSubSubscriptionTemplate
+	fields, err := UnmarshalTemplated(data, (*plain)(t), []string{"spec"}, reflect.TypeOf(t.Spec))
+	t.Templated = fields
+	return err
+}
+
+func (t PubSubSubscriptionTemplate) MarshalJSON() ([]byte, error) {
+	type plain PubSubSubscriptionTemplate
+	return MarshalTemplated(plain(t), []string{"spec"}, t.Templated)
 }
 
 //+kubebuilder:object:root=true
@@ -20,6 +20,7 @@ import (
 	pubsub "github.com/GoogleCloudPlatform/k8s-config-connector/pkg/apis/pubsub/v1beta1"
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"reflect"
 )
 
 // EDIT THIS FILE!  THIS IS SCAFFOLDING FOR YOU TO OWN!
@@ -27,11 +28,15 @@ import (
 
 // PubSubTopicTemplateStatus defines the observed state of PubSubTopicTemplate
 type PubSubTopicTemplateStatus struct {
-	Ref v1.ObjectReference `json:"ref,omitempty"`
+	Ref        v1.ObjectReference `json:"ref,omitempty"`
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+	// Violations lists the TemplatePolicy rules the rendered resource does not satisfy.
+	Violations []PolicyViolation `json:"violations,omitempty"`
 }
 
 //+kubebuilder:object:root=true
 //+kubebuilder:subresource:status
+//+kubebuilder:storageversion
 
 // PubSubTopicTemplate is the Schema for the pubsubtopictemplates API
 type PubSubTopicTemplate struct {
@@ -40,6 +45,21 @@ type PubSubTopicTemplate struct {
 
 	Spec   pubsub.PubSubTopicSpec    `json:"spec,omitempty"`
 	Status PubSubTopicTemplateStatus `json:"status,omitempty"`
+
+	// Templated holds the spec fields set to a template expression although their KCC type is not a string.
+	Templated TemplatedFields `json:"-"`
+}
+
+func (t *PubSubTopicTemplate) UnmarshalJSON(data []byte) error {
+	type plain PubSubTopicTemplate
+	fields, err := UnmarshalTemplated(data, (*plain)(t), []string{"spec"}, reflect.TypeOf(t.Spec))
+	t.Templated = fields
+	return err
+}
+
+func (t PubSubTopicTemplate) MarshalJSON() ([]byte, error) {
+	type plain PubSubTopicTemplate
+	return MarshalTemplated(plain(t), []string{"spec"}, t.Templated)
 }
 
 //+kubebuilder:object:root=true
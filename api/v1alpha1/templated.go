@@ -0,0 +1,229 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// TemplatedFields holds the spec fields set to a template expression although their KCC type is not a string,
+// keyed by the JSON pointer of the field within the spec, e.g. /ackDeadlineSeconds. They can not be decoded
+// into the KCC types, so templates keep them aside and the controller renders them on their own.
+type TemplatedFields map[string]string
+
+// Inject sets the fields in tree, a spec decoded into maps and slices, creating missing objects on the way.
+func (f TemplatedFields) Inject(tree map[string]interface{}) {
+	for pointer, expr := range f {
+		setPointer(tree, splitPointer(pointer), expr)
+	}
+}
+
+// Pointers returns the parsed JSON pointers of the fields.
+func (f TemplatedFields) Pointers() [][]string {
+	var out [][]string
+	for pointer := range f {
+		out = append(out, splitPointer(pointer))
+	}
+	return out
+}
+
+// UnmarshalTemplated decodes data into obj, a pointer to a type without an UnmarshalJSON method. Before that, string
+// values of non-string fields of specType below specPath are removed from data and returned.
+func UnmarshalTemplated(data []byte, obj interface{}, specPath []string, specType reflect.Type) (TemplatedFields, error) {
+	var tree map[string]interface{}
+	if err := json.Unmarshal(data, &tree); err != nil {
+		return nil, err
+	}
+	spec, ok := lookup(tree, specPath).(map[string]interface{})
+	if !ok {
+		return nil, json.Unmarshal(data, obj)
+	}
+	fields := TemplatedFields{}
+	extract(spec, specType, "", fields)
+	if len(fields) == 0 {
+		return nil, json.Unmarshal(data, obj)
+	}
+	data, err := json.Marshal(tree)
+	if err != nil {
+		return nil, err
+	}
+	return fields, json.Unmarshal(data, obj)
+}
+
+// MarshalTemplated encodes obj, a value of a type without a MarshalJSON method, with fields set below specPath.
+func MarshalTemplated(obj interface{}, specPath []string, fields TemplatedFields) ([]byte, error) {
+	data, err := json.Marshal(obj)
+	if err != nil || len(fields) == 0 {
+		return data, err
+	}
+	var tree map[string]interface{}
+	if err := json.Unmarshal(data, &tree); err != nil {
+		return nil, err
+	}
+	spec, ok := lookup(tree, specPath).(map[string]interface{})
+	if !ok {
+		spec = map[string]interface{}{}
+		setPointer(tree, specPath, spec)
+	}
+	fields.Inject(spec)
+	return json.Marshal(tree)
+}
+
+// extract moves the string values of non-string leaves of typ from node to fields.
+func extract(node interface{}, typ reflect.Type, pointer string, fields TemplatedFields) interface{} {
+	for typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	switch typ.Kind() {
+	case reflect.Struct:
+		obj, ok := node.(map[string]interface{})
+		if !ok {
+			return node
+		}
+		for name, field := range jsonFields(typ) {
+			v, ok := obj[name]
+			if !ok {
+				continue
+			}
+			if rest := extract(v, field, pointer+"/"+escapePointer(name), fields); rest != nil {
+				obj[name] = rest
+			} else {
+				delete(obj, name)
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		if list, ok := node.([]interface{}); ok {
+			for i, item := range list {
+				// an element can not be removed without shifting the others, it is left empty instead
+				list[i] = extract(item, typ.Elem(), pointer+"/"+strconv.Itoa(i), fields)
+			}
+		}
+	case reflect.Map:
+		if obj, ok := node.(map[string]interface{}); ok {
+			for k, v := range obj {
+				if rest := extract(v, typ.Elem(), pointer+"/"+escapePointer(k), fields); rest != nil {
+					obj[k] = rest
+				} else {
+					delete(obj, k)
+				}
+			}
+		}
+	case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Float32, reflect.Float64:
+		if s, ok := node.(string); ok {
+			fields[pointer] = s
+			return nil
+		}
+	}
+	return node
+}
+
+// jsonFields returns the fields of a struct type by their JSON name, fields of inlined structs included.
+func jsonFields(typ reflect.Type) map[string]reflect.Type {
+	out := make(map[string]reflect.Type)
+	for i := 0; i < typ.NumField(); i++ {
+		f := typ.Field(i)
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" && f.Anonymous {
+			embedded := f.Type
+			for embedded.Kind() == reflect.Ptr {
+				embedded = embedded.Elem()
+			}
+			if embedded.Kind() == reflect.Struct {
+				for k, v := range jsonFields(embedded) {
+					out[k] = v
+				}
+				continue
+			}
+		}
+		if name == "" {
+			name = f.Name
+		}
+		out[name] = f.Type
+	}
+	return out
+}
+
+func lookup(tree map[string]interface{}, path []string) interface{} {
+	var node interface{} = tree
+	for _, key := range path {
+		obj, ok := node.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		node = obj[key]
+	}
+	return node
+}
+
+func setPointer(tree map[string]interface{}, path []string, value interface{}) {
+	var node interface{} = tree
+	for i, key := range path {
+		last := i == len(path)-1
+		switch n := node.(type) {
+		case map[string]interface{}:
+			if last {
+				n[key] = value
+				return
+			}
+			if _, ok := n[key]; !ok || n[key] == nil {
+				if _, err := strconv.Atoi(path[i+1]); err == nil {
+					// missing lists can not be sized, the field is dropped
+					return
+				}
+				n[key] = map[string]interface{}{}
+			}
+			node = n[key]
+		case []interface{}:
+			idx, err := strconv.Atoi(key)
+			if err != nil || idx >= len(n) {
+				return
+			}
+			if last {
+				n[idx] = value
+				return
+			}
+			if n[idx] == nil {
+				n[idx] = map[string]interface{}{}
+			}
+			node = n[idx]
+		default:
+			return
+		}
+	}
+}
+
+var pointerEscaper = strings.NewReplacer("~", "~0", "/", "~1")
+var pointerUnescaper = strings.NewReplacer("~1", "/", "~0", "~")
+
+func escapePointer(s string) string {
+	return pointerEscaper.Replace(s)
+}
+
+func splitPointer(pointer string) []string {
+	parts := strings.Split(strings.TrimPrefix(pointer, "/"), "/")
+	for i, p := range parts {
+		parts[i] = pointerUnescaper.Replace(p)
+	}
+	return parts
+}
@@ -0,0 +1,56 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestTemplatedFields(t *testing.T) {
+	data := []byte(`{"metadata":{"name":"orders"},"spec":{"ackDeadlineSeconds":"{{ .values.ack }}",` +
+		`"retainAckedMessages":true,"deadLetterPolicy":{"maxDeliveryAttempts":"{{ .values.attempts }}"},"topicRef":{"name":"orders"}}}`)
+
+	src := &PubSubSubscriptionTemplate{}
+	assert.NoError(t, json.Unmarshal(data, src))
+	assert.Equal(t, TemplatedFields{
+		"/ackDeadlineSeconds":                   "{{ .values.ack }}",
+		"/deadLetterPolicy/maxDeliveryAttempts": "{{ .values.attempts }}",
+	}, src.Templated)
+	assert.Nil(t, src.Spec.AckDeadlineSeconds)
+	assert.True(t, *src.Spec.RetainAckedMessages)
+	assert.Equal(t, "orders", src.Spec.TopicRef.Name)
+
+	out, err := json.Marshal(src)
+	assert.NoError(t, err)
+	var tree map[string]interface{}
+	assert.NoError(t, json.Unmarshal(out, &tree))
+	spec := tree["spec"].(map[string]interface{})
+	assert.Equal(t, "{{ .values.ack }}", spec["ackDeadlineSeconds"])
+	assert.Equal(t, "{{ .values.attempts }}", spec["deadLetterPolicy"].(map[string]interface{})["maxDeliveryAttempts"])
+
+	dst := &PubSubSubscriptionTemplate{}
+	assert.NoError(t, json.Unmarshal(out, dst))
+	assert.Equal(t, src, dst)
+	assert.Equal(t, src, src.DeepCopy())
+
+	plain := &PubSubSubscriptionTemplate{}
+	assert.NoError(t, json.Unmarshal([]byte(`{"spec":{"ackDeadlineSeconds":10}}`), plain))
+	assert.Nil(t, plain.Templated)
+	assert.Equal(t, 10, *plain.Spec.AckDeadlineSeconds)
+}
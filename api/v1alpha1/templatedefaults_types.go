@@ -0,0 +1,60 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// KindDefaults holds the default spec fields of one kind of rendered resources.
+type KindDefaults struct {
+	// Kind of the rendered resources, e.g. PubSubTopic.
+	Kind string `json:"kind"`
+	// Spec holds the default fields, merged under the spec of every template rendering into Kind.
+	// Values are rendered like the template spec.
+	// +kubebuilder:pruning:PreserveUnknownFields
+	Spec runtime.RawExtension `json:"spec"`
+}
+
+// TemplateDefaultsSpec defines the desired state of TemplateDefaults
+type TemplateDefaultsSpec struct {
+	Defaults []KindDefaults `json:"defaults"`
+}
+
+//+kubebuilder:object:root=true
+
+// TemplateDefaults is the Schema for the templatedefaults API
+type TemplateDefaults struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec TemplateDefaultsSpec `json:"spec,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// TemplateDefaultsList contains a list of TemplateDefaults
+type TemplateDefaultsList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []TemplateDefaults `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&TemplateDefaults{}, &TemplateDefaultsList{})
+}
@@ -0,0 +1,72 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// PolicyRule is a CEL expression the rendered resource must satisfy.
+type PolicyRule struct {
+	// Name identifies the rule in violations.
+	Name string `json:"name"`
+	// Expression is evaluated with the rendered resource as object and must return true,
+	// e.g. object.spec.resourceID.startsWith(object.metadata.namespace + '.').
+	Expression string `json:"expression"`
+	// Message is reported when the rule is violated, defaults to the expression.
+	// +optional
+	Message string `json:"message,omitempty"`
+}
+
+// TemplatePolicySpec defines the desired state of TemplatePolicy
+type TemplatePolicySpec struct {
+	// Kinds of the rendered resources the rules apply to, e.g. PubSubTopic. Defaults to all kinds.
+	// +optional
+	Kinds []string     `json:"kinds,omitempty"`
+	Rules []PolicyRule `json:"rules"`
+}
+
+// PolicyViolation is a rule the rendered resource of a template does not satisfy.
+type PolicyViolation struct {
+	Policy  string `json:"policy"`
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:resource:scope=Cluster
+
+// TemplatePolicy is the Schema for the templatepolicies API
+type TemplatePolicy struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec TemplatePolicySpec `json:"spec,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// TemplatePolicyList contains a list of TemplatePolicy
+type TemplatePolicyList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []TemplatePolicy `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&TemplatePolicy{}, &TemplatePolicyList{})
+}
@@ -0,0 +1,74 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// TemplateQuotaSpec defines the desired state of TemplateQuota
+type TemplateQuotaSpec struct {
+	// Hard limits the number of rendered resources per kind in the namespace, e.g. PubSubTopic: 50.
+	Hard map[string]int `json:"hard"`
+}
+
+// TemplateQuotaStatus defines the observed state of TemplateQuota
+type TemplateQuotaStatus struct {
+	// Used counts the rendered resources per kind in the namespace.
+	Used map[string]int `json:"used,omitempty"`
+	// Reserved charges the quota for rendered resources that are being created.
+	Reserved []TemplateQuotaReservation `json:"reserved,omitempty"`
+}
+
+// TemplateQuotaReservation charges a quota for a rendered resource before it is created. It is dropped once the
+// resource exists, or when it expires because its create failed without releasing it.
+type TemplateQuotaReservation struct {
+	// Kind of the rendered resource, e.g. PubSubTopic.
+	Kind string `json:"kind"`
+	// Template rendering the resource.
+	Template string `json:"template"`
+	// UID of the template, the reservation is settled by a resource it controls.
+	UID types.UID `json:"uid"`
+	// Time the reservation was made.
+	Time metav1.Time `json:"time"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+
+// TemplateQuota is the Schema for the templatequotas API
+type TemplateQuota struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   TemplateQuotaSpec   `json:"spec,omitempty"`
+	Status TemplateQuotaStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// TemplateQuotaList contains a list of TemplateQuota
+type TemplateQuotaList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []TemplateQuota `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&TemplateQuota{}, &TemplateQuotaList{})
+}
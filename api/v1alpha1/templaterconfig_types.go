@@ -0,0 +1,77 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	cfg "sigs.k8s.io/controller-runtime/pkg/config/v1alpha1"
+)
+
+// RateLimiterConfig configures how fast failed templates are retried.
+type RateLimiterConfig struct {
+	// BaseDelay is the delay before the first retry, doubled on every failure. Defaults to 5ms.
+	BaseDelay *metav1.Duration `json:"baseDelay,omitempty"`
+	// MaxDelay caps the delay between retries. Defaults to 1000s.
+	MaxDelay *metav1.Duration `json:"maxDelay,omitempty"`
+	// QPS is the overall number of retries per second. Defaults to 10.
+	QPS int `json:"qps,omitempty"`
+	// Burst is the number of retries allowed above QPS. Defaults to 100.
+	Burst int `json:"burst,omitempty"`
+}
+
+// ShardingConfig splits templates between several templater replicas.
+type ShardingConfig struct {
+	// Shards is the number of shards, 0 or 1 disables sharding.
+	Shards int `json:"shards,omitempty"`
+	// ShardID is the shard handled by this replica. Defaults to the ordinal of the StatefulSet pod.
+	ShardID *int `json:"shardID,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// TemplaterConfig is the Schema for the manager config file
+type TemplaterConfig struct {
+	metav1.TypeMeta `json:",inline"`
+
+	// ControllerManagerConfigurationSpec returns the configurations for controllers
+	cfg.ControllerManagerConfigurationSpec `json:",inline"`
+
+	// MaxConcurrentReconciles is the number of templates of a kind reconciled in parallel, keyed by the template kind.
+	// The "*" key applies to kinds without their own entry.
+	MaxConcurrentReconciles map[string]int `json:"maxConcurrentReconciles,omitempty"`
+	// RateLimiter configures how fast failed templates are retried.
+	RateLimiter RateLimiterConfig `json:"rateLimiter,omitempty"`
+	// WatchNamespaces restricts the templater to the listed namespaces, all namespaces are watched when empty.
+	WatchNamespaces []string `json:"watchNamespaces,omitempty"`
+	// Sharding splits templates between several templater replicas.
+	Sharding ShardingConfig `json:"sharding,omitempty"`
+	// Class is the templater class handled by this installation. Empty means templates without a class.
+	Class string `json:"class,omitempty"`
+	// PropagationExclude lists the substrings of annotation and label keys not copied to rendered resources.
+	// Defaults to fluxcd.io and last-applied-configuration.
+	PropagationExclude []string `json:"propagationExclude,omitempty"`
+	// RevisionHistoryLimit is the number of rendered specs kept per template, 0 disables the history. Defaults to 10.
+	RevisionHistoryLimit *int `json:"revisionHistoryLimit,omitempty"`
+	// AllowedFunctions lists the functions go templates may call.
+	AllowedFunctions []string `json:"allowedFunctions,omitempty"`
+	// Paused suspends creating and updating rendered resources in the whole cluster, status and drift are still reported.
+	Paused bool `json:"paused,omitempty"`
+}
+
+func init() {
+	SchemeBuilder.Register(&TemplaterConfig{})
+}
@@ -0,0 +1,141 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha2
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/slamdev/config-connector-templater/api/v1alpha1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"strings"
+)
+
+// v1alpha1 keeps the target, values and options of a template in annotations, the keys are those of pkg/options.go.
+const (
+	annotationPrefix             = "templater.slamdev.net/"
+	targetNameAnnotation         = annotationPrefix + "target-name"
+	targetNamespaceAnnotation    = annotationPrefix + "target-namespace"
+	valuesAnnotation             = annotationPrefix + "values"
+	engineAnnotation             = annotationPrefix + "engine"
+	adoptionPolicyAnnotation     = annotationPrefix + "adoption-policy"
+	pausedAnnotation             = annotationPrefix + "paused"
+	classAnnotation              = annotationPrefix + "class"
+	dependsOnAnnotation          = annotationPrefix + "depends-on"
+	targetClusterAnnotation      = annotationPrefix + "target-cluster"
+	autoRollbackWindowAnnotation = annotationPrefix + "auto-rollback-window"
+	rollbackToAnnotation         = annotationPrefix + "rollback-to"
+)
+
+// stringFields maps the annotations holding plain strings to their field.
+func stringFields(target *TemplateTarget, opts *TemplateOptions) map[string]*string {
+	return map[string]*string{
+		targetNameAnnotation:         &target.Name,
+		targetNamespaceAnnotation:    &target.Namespace,
+		engineAnnotation:             &opts.Engine,
+		adoptionPolicyAnnotation:     &opts.AdoptionPolicy,
+		classAnnotation:              &opts.Class,
+		targetClusterAnnotation:      &opts.TargetCluster,
+		autoRollbackWindowAnnotation: &opts.AutoRollbackWindow,
+		rollbackToAnnotation:         &opts.RollbackTo,
+	}
+}
+
+// toAnnotations returns annotations with the target, values and options of a template added, fields win over
+// annotations set by hand. The target kind is implied by the template kind, so it must be empty or kind.
+func toAnnotations(annotations map[string]string, kind string, target TemplateTarget, values *runtime.RawExtension,
+	opts TemplateOptions) (map[string]string, error) {
+	if target.Kind != "" && target.Kind != kind {
+		return nil, fmt.Errorf("spec.target.kind must be %s, not %s", kind, target.Kind)
+	}
+	out := make(map[string]string, len(annotations))
+	for k, v := range annotations {
+		out[k] = v
+	}
+	for k, v := range stringFields(&target, &opts) {
+		if *v != "" {
+			out[k] = *v
+		}
+	}
+	if opts.Paused {
+		out[pausedAnnotation] = "true"
+	}
+	if len(opts.DependsOn) > 0 {
+		out[dependsOnAnnotation] = strings.Join(opts.DependsOn, ",")
+	}
+	if values != nil && len(values.Raw) > 0 {
+		out[valuesAnnotation] = string(values.Raw)
+	}
+	if len(out) == 0 {
+		return nil, nil
+	}
+	return out, nil
+}
+
+// fromAnnotations moves the target, values and options of a template out of annotations. Annotations
+// a field can not hold as is, e.g. values that are not a JSON object, are left in place.
+func fromAnnotations(annotations map[string]string, kind string) (map[string]string, TemplateTarget, *runtime.RawExtension, TemplateOptions) {
+	target := TemplateTarget{Kind: kind}
+	opts := TemplateOptions{}
+	var values *runtime.RawExtension
+	out := make(map[string]string, len(annotations))
+	for k, v := range annotations {
+		out[k] = v
+	}
+	for k, field := range stringFields(&target, &opts) {
+		if v := out[k]; v != "" {
+			*field = v
+			delete(out, k)
+		}
+	}
+	if out[pausedAnnotation] == "true" {
+		opts.Paused = true
+		delete(out, pausedAnnotation)
+	}
+	if v := out[dependsOnAnnotation]; v != "" {
+		for _, dep := range strings.Split(v, ",") {
+			if dep = strings.TrimSpace(dep); dep != "" {
+				opts.DependsOn = append(opts.DependsOn, dep)
+			}
+		}
+		delete(out, dependsOnAnnotation)
+	}
+	var obj map[string]interface{}
+	if v, ok := out[valuesAnnotation]; ok && json.Unmarshal([]byte(v), &obj) == nil && obj != nil {
+		values = &runtime.RawExtension{Raw: []byte(v)}
+		delete(out, valuesAnnotation)
+	}
+	if len(out) == 0 {
+		out = nil
+	}
+	return out, target, values, opts
+}
+
+func violationsToV1alpha1(in []PolicyViolation) []v1alpha1.PolicyViolation {
+	var out []v1alpha1.PolicyViolation
+	for _, v := range in {
+		out = append(out, v1alpha1.PolicyViolation{Policy: v.Policy, Rule: v.Rule, Message: v.Message})
+	}
+	return out
+}
+
+func violationsFromV1alpha1(in []v1alpha1.PolicyViolation) []PolicyViolation {
+	var out []PolicyViolation
+	for _, v := range in {
+		out = append(out, PolicyViolation{Policy: v.Policy, Rule: v.Rule, Message: v.Message})
+	}
+	return out
+}
@@ -0,0 +1,83 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha2
+
+import (
+	pubsub "github.com/GoogleCloudPlatform/k8s-config-connector/pkg/apis/pubsub/v1beta1"
+	"github.com/slamdev/config-connector-templater/api/v1alpha1"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"testing"
+)
+
+func TestConvertTopicTemplate(t *testing.T) {
+	resourceID := "{{ .values.service }}"
+	src := &PubSubTopicTemplate{
+		ObjectMeta: metav1.ObjectMeta{Name: "orders", Namespace: "team1", Annotations: map[string]string{"team": "a"}},
+		Spec: PubSubTopicTemplateSpec{
+			Target:   TemplateTarget{Kind: "PubSubTopic", Name: "orders-{{ .metadata.namespace }}"},
+			Values:   &runtime.RawExtension{Raw: []byte(`{"service":"orders"}`)},
+			Template: pubsub.PubSubTopicSpec{ResourceID: &resourceID},
+			Options:  TemplateOptions{Engine: "gotemplate", Paused: true, DependsOn: []string{"PubSubTopicTemplate/a", "PubSubTopicTemplate/b"}},
+		},
+		Status: TemplateStatus{Violations: []PolicyViolation{{Policy: "p", Rule: "r", Message: "m"}}},
+	}
+
+	hub := &v1alpha1.PubSubTopicTemplate{}
+	assert.NoError(t, src.ConvertTo(hub))
+	assert.Equal(t, map[string]string{
+		"team":                              "a",
+		"templater.slamdev.net/target-name": "orders-{{ .metadata.namespace }}",
+		"templater.slamdev.net/values":      `{"service":"orders"}`,
+		"templater.slamdev.net/engine":      "gotemplate",
+		"templater.slamdev.net/paused":      "true",
+		"templater.slamdev.net/depends-on":  "PubSubTopicTemplate/a,PubSubTopicTemplate/b",
+	}, hub.Annotations)
+	assert.Equal(t, src.Spec.Template, hub.Spec)
+	assert.Equal(t, "p", hub.Status.Violations[0].Policy)
+	assert.Equal(t, map[string]string{"team": "a"}, src.Annotations)
+
+	dst := &PubSubTopicTemplate{}
+	assert.NoError(t, dst.ConvertFrom(hub))
+	assert.Equal(t, src, dst)
+
+	src.Spec.Target.Kind = "PubSubSubscription"
+	assert.Error(t, src.ConvertTo(&v1alpha1.PubSubTopicTemplate{}))
+}
+
+func TestConvertSubscriptionTemplateFromHub(t *testing.T) {
+	hub := &v1alpha1.PubSubSubscriptionTemplate{
+		ObjectMeta: metav1.ObjectMeta{Name: "orders", Annotations: map[string]string{
+			"templater.slamdev.net/paused": "yes",
+			"templater.slamdev.net/values": "[1]",
+		}},
+		Spec: v1alpha1.PubSubSubscriptionTemplateSpec{TopicTemplateRef: &v1alpha1.TemplateRef{Name: "orders"}},
+	}
+
+	dst := &PubSubSubscriptionTemplate{}
+	assert.NoError(t, dst.ConvertFrom(hub))
+	// values that are not an object and unknown paused values stay annotations
+	assert.Equal(t, hub.Annotations, dst.Annotations)
+	assert.Equal(t, TemplateTarget{Kind: "PubSubSubscription"}, dst.Spec.Target)
+	assert.Nil(t, dst.Spec.Values)
+	assert.Equal(t, "orders", dst.Spec.TopicTemplateRef.Name)
+
+	back := &v1alpha1.PubSubSubscriptionTemplate{}
+	assert.NoError(t, dst.ConvertTo(back))
+	assert.Equal(t, hub, back)
+}
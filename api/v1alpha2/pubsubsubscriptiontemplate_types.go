@@ -0,0 +1,83 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha2
+
+import (
+	pubsub "github.com/GoogleCloudPlatform/k8s-config-connector/pkg/apis/pubsub/v1beta1"
+	"github.com/slamdev/config-connector-templater/api/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"reflect"
+)
+
+// PubSubSubscriptionTemplateSpec defines the desired state of PubSubSubscriptionTemplate
+type PubSubSubscriptionTemplateSpec struct {
+	// +optional
+	Target TemplateTarget `json:"target,omitempty"`
+	// Values are exposed to the template as values.
+	// +kubebuilder:pruning:PreserveUnknownFields
+	// +optional
+	Values *runtime.RawExtension `json:"values,omitempty"`
+	// Template is the spec of the rendered PubSubSubscription, its string fields may hold template expressions.
+	// +optional
+	Template pubsub.PubSubSubscriptionSpec `json:"template,omitempty"`
+	// TopicTemplateRef references the PubSubTopicTemplate whose rendered PubSubTopic is used as topicRef.
+	// +optional
+	TopicTemplateRef *TemplateRef `json:"topicTemplateRef,omitempty"`
+	// +optional
+	Options TemplateOptions `json:"options,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+
+// PubSubSubscriptionTemplate is the Schema for the pubsubsubscriptiontemplates API
+type PubSubSubscriptionTemplate struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   PubSubSubscriptionTemplateSpec `json:"spec,omitempty"`
+	Status TemplateStatus                 `json:"status,omitempty"`
+
+	// Templated holds the fields of spec.template set to a template expression although their KCC type is not a string.
+	Templated v1alpha1.TemplatedFields `json:"-"`
+}
+
+func (t *PubSubSubscriptionTemplate) UnmarshalJSON(data []byte) error {
+	type plain PubSubSubscriptionTemplate
+	fields, err := v1alpha1.UnmarshalTemplated(data, (*plain)(t), []string{"spec", "template"}, reflect.TypeOf(t.Spec.Template))
+	t.Templated = fields
+	return err
+}
+
+func (t PubSubSubscriptionTemplate) MarshalJSON() ([]byte, error) {
+	type plain PubSubSubscriptionTemplate
+	return v1alpha1.MarshalTemplated(plain(t), []string{"spec", "template"}, t.Templated)
+}
+
+//+kubebuilder:object:root=true
+
+// PubSubSubscriptionTemplateList contains a list of PubSubSubscriptionTemplate
+type PubSubSubscriptionTemplateList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []PubSubSubscriptionTemplate `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&PubSubSubscriptionTemplate{}, &PubSubSubscriptionTemplateList{})
+}
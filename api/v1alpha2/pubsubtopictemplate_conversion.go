@@ -0,0 +1,56 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha2
+
+import (
+	"github.com/slamdev/config-connector-templater/api/v1alpha1"
+	"sigs.k8s.io/controller-runtime/pkg/conversion"
+)
+
+// ConvertTo converts this PubSubTopicTemplate to the v1alpha1 hub version.
+func (src *PubSubTopicTemplate) ConvertTo(dstRaw conversion.Hub) error {
+	dst := dstRaw.(*v1alpha1.PubSubTopicTemplate)
+	annotations, err := toAnnotations(src.Annotations, "PubSubTopic", src.Spec.Target, src.Spec.Values, src.Spec.Options)
+	if err != nil {
+		return err
+	}
+	dst.ObjectMeta = src.ObjectMeta
+	dst.Annotations = annotations
+	dst.Spec = src.Spec.Template
+	dst.Templated = src.Templated
+	dst.Status = v1alpha1.PubSubTopicTemplateStatus{
+		Ref:        src.Status.Ref,
+		Conditions: src.Status.Conditions,
+		Violations: violationsToV1alpha1(src.Status.Violations),
+	}
+	return nil
+}
+
+// ConvertFrom converts the v1alpha1 hub version to this PubSubTopicTemplate.
+func (dst *PubSubTopicTemplate) ConvertFrom(srcRaw conversion.Hub) error {
+	src := srcRaw.(*v1alpha1.PubSubTopicTemplate)
+	dst.ObjectMeta = src.ObjectMeta
+	dst.Annotations, dst.Spec.Target, dst.Spec.Values, dst.Spec.Options = fromAnnotations(src.Annotations, "PubSubTopic")
+	dst.Spec.Template = src.Spec
+	dst.Templated = src.Templated
+	dst.Status = TemplateStatus{
+		Ref:        src.Status.Ref,
+		Conditions: src.Status.Conditions,
+		Violations: violationsFromV1alpha1(src.Status.Violations),
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha2
+
+import (
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// TemplateTarget identifies the resource a template renders.
+type TemplateTarget struct {
+	// Kind of the rendered resource, defaults to the kind the template renders and can not be changed.
+	// +optional
+	Kind string `json:"kind,omitempty"`
+	// Name of the rendered resource, rendered like any string field. Defaults to the name of the template.
+	// +optional
+	Name string `json:"name,omitempty"`
+	// Namespace of the rendered resource, owner references can not cross namespaces,
+	// so it has to be the namespace of the template.
+	// +optional
+	Namespace string `json:"namespace,omitempty"`
+}
+
+// TemplateOptions configure how a template is rendered and applied.
+type TemplateOptions struct {
+	// Engine is the expression language of the template, gotemplate by default.
+	// +kubebuilder:validation:Enum=gotemplate;cel;jsonnet;cue
+	// +optional
+	Engine string `json:"engine,omitempty"`
+	// AdoptionPolicy decides what happens when the rendered resource already exists without an owner, Never by default.
+	// +kubebuilder:validation:Enum=Never;IfUnowned;Force
+	// +optional
+	AdoptionPolicy string `json:"adoptionPolicy,omitempty"`
+	// Paused suspends creating and updating the rendered resource.
+	// +optional
+	Paused bool `json:"paused,omitempty"`
+	// Class assigns the template to the templater installation started with the same --class.
+	// +optional
+	Class string `json:"class,omitempty"`
+	// DependsOn lists the templates in the same namespace, as Kind/name, that must be Ready
+	// before the rendered resource is created.
+	// +optional
+	DependsOn []string `json:"dependsOn,omitempty"`
+	// TargetCluster names a Secret in the namespace of the template holding the kubeconfig
+	// of the remote cluster the resource is rendered into.
+	// +optional
+	TargetCluster string `json:"targetCluster,omitempty"`
+	// AutoRollbackWindow enables rolling the rendered resource back to the newest known-good revision
+	// when it fails to apply within the given duration after a change, e.g. 10m.
+	// +optional
+	AutoRollbackWindow string `json:"autoRollbackWindow,omitempty"`
+	// RollbackTo pins the rendered resource to the spec of a previous revision.
+	// +optional
+	RollbackTo string `json:"rollbackTo,omitempty"`
+}
+
+// TemplateRef references another template.
+type TemplateRef struct {
+	// Name of the referenced template, rendered like any string field.
+	Name string `json:"name"`
+	// Namespace of the referenced template, defaults to the namespace of the referencing template.
+	// +optional
+	Namespace string `json:"namespace,omitempty"`
+}
+
+// PolicyViolation is a rule the rendered resource of a template does not satisfy.
+type PolicyViolation struct {
+	Policy  string `json:"policy"`
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// TemplateStatus defines the observed state of a template
+type TemplateStatus struct {
+	Ref        v1.ObjectReference `json:"ref,omitempty"`
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+	// Violations lists the TemplatePolicy rules the rendered resource does not satisfy.
+	Violations []PolicyViolation `json:"violations,omitempty"`
+}
@@ -20,8 +20,11 @@ import (
 	"fmt"
 	pubsub "github.com/GoogleCloudPlatform/k8s-config-connector/pkg/apis/pubsub/v1beta1"
 	api "github.com/slamdev/config-connector-templater/api/v1alpha1"
+	"github.com/slamdev/config-connector-templater/pkg"
+	"reflect"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
 )
 
 //+kubebuilder:rbac:groups=config-connector-templater.slamdev.net,resources=pubsubtopictemplates,verbs=get;list;watch;create;update;patch;delete
@@ -34,6 +37,16 @@ import (
 //+kubebuilder:rbac:groups=config-connector-templater.slamdev.net,resources=pubsubsubscriptiontemplates/finalizers,verbs=update
 //+kubebuilder:rbac:groups=pubsub.cnrm.cloud.google.com,resources=pubsubsubscriptions,verbs=get;list;watch;create;update;patch;delete
 
+//+kubebuilder:rbac:groups=config-connector-templater.slamdev.net,resources=templatedefaults,verbs=get;list;watch
+//+kubebuilder:rbac:groups=config-connector-templater.slamdev.net,resources=clustertemplatedefaults,verbs=get;list;watch
+//+kubebuilder:rbac:groups=config-connector-templater.slamdev.net,resources=templatepolicies,verbs=get;list;watch
+//+kubebuilder:rbac:groups=config-connector-templater.slamdev.net,resources=templatequotas,verbs=get;list;watch
+//+kubebuilder:rbac:groups=config-connector-templater.slamdev.net,resources=templatequotas/status,verbs=get;update;patch
+
+//+kubebuilder:rbac:groups="",resources=namespaces,verbs=get;list;watch
+//+kubebuilder:rbac:groups="",resources=secrets,verbs=get
+//+kubebuilder:rbac:groups=apps,resources=controllerrevisions,verbs=get;list;watch;create;update;patch;delete
+
 var controlledTypes = []controlledType{
 	{
 		id:           "pubsubtopictemplate",
@@ -44,6 +57,7 @@ var controlledTypes = []controlledType{
 		id:           "pubsubsubscriptiontemplate",
 		templateType: &api.PubSubSubscriptionTemplate{},
 		renderType:   &pubsub.PubSubSubscription{},
+		references:   []client.Object{&api.PubSubTopicTemplate{}},
 	},
 }
 
@@ -51,20 +65,54 @@ type controlledType struct {
 	id           string
 	templateType client.Object
 	renderType   client.Object
+	// references lists the template types the spec of templateType may reference
+	references []client.Object
+}
+
+// Options tunes the workqueues of the template controllers.
+type Options struct {
+	// MaxConcurrentReconciles is keyed by the template kind, see pkg.Concurrency.
+	MaxConcurrentReconciles map[string]int
+	// RateLimiter is used by every controller, the controller-runtime default is used when empty.
+	RateLimiter pkg.RateLimiterOptions
+	// Sharding restricts the controllers to the templates of one shard.
+	Sharding pkg.Sharding
+}
+
+// BackupKinds lists the template kinds and the kinds they render, see pkg.Export.
+func BackupKinds() []pkg.BackupKind {
+	kinds := make([]pkg.BackupKind, 0, len(controlledTypes))
+	for _, t := range controlledTypes {
+		kinds = append(kinds, pkg.BackupKind{Template: t.templateType, Render: t.renderType})
+	}
+	return kinds
 }
 
-func CreateControllers(mgr ctrl.Manager) error {
+func CreateControllers(mgr ctrl.Manager, cfg pkg.Config, opts Options) error {
 	for _, t := range controlledTypes {
+		kind := reflect.TypeOf(t.templateType).Elem().Name()
 		c := &TemplateReconciler{
 			Client:       mgr.GetClient(),
 			Scheme:       mgr.GetScheme(),
 			LoggerName:   t.id,
 			TemplateType: t.templateType,
 			RenderType:   t.renderType,
+			References:   t.references,
+			Config:       cfg,
+			Sharding:     opts.Sharding,
+			Options: controller.Options{
+				MaxConcurrentReconciles: pkg.Concurrency(opts.MaxConcurrentReconciles, kind),
+			},
+		}
+		if opts.RateLimiter != (pkg.RateLimiterOptions{}) {
+			c.Options.RateLimiter = pkg.NewRateLimiter(opts.RateLimiter)
 		}
 		if err := c.SetupWithManager(mgr); err != nil {
 			return fmt.Errorf("unable to create %s controller; %w", c.LoggerName, err)
 		}
 	}
+	if err := createQuotaController(mgr, cfg); err != nil {
+		return fmt.Errorf("unable to create templatequota controller; %w", err)
+	}
 	return nil
 }
@@ -0,0 +1,39 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/conversion"
+)
+
+// CreateConversionWebhook serves /convert, converting templates between v1alpha1 and v1alpha2.
+// v1alpha1 is stored and reconciled, the other versions are converted through it.
+func CreateConversionWebhook(mgr ctrl.Manager) error {
+	for _, t := range controlledTypes {
+		ok, err := conversion.IsConvertible(mgr.GetScheme(), t.templateType)
+		if err != nil {
+			return fmt.Errorf("unable to create %s conversion webhook; %w", t.id, err)
+		}
+		if !ok {
+			return fmt.Errorf("unable to create %s conversion webhook; no convertible versions registered", t.id)
+		}
+	}
+	mgr.GetWebhookServer().Register("/convert", &conversion.Webhook{})
+	return nil
+}
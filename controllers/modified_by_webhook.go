@@ -0,0 +1,101 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/slamdev/config-connector-templater/pkg"
+	admissionv1 "k8s.io/api/admission/v1"
+	"net/http"
+	"reflect"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+	"strings"
+)
+
+//+kubebuilder:webhook:path=/mutate-config-connector-templater-slamdev-net-v1alpha1-pubsubtopictemplate,mutating=true,failurePolicy=fail,sideEffects=None,groups=config-connector-templater.slamdev.net,resources=pubsubtopictemplates,verbs=create;update,versions=v1alpha1,name=mpubsubtopictemplate.kb.io,admissionReviewVersions={v1,v1beta1}
+//+kubebuilder:webhook:path=/mutate-config-connector-templater-slamdev-net-v1alpha1-pubsubsubscriptiontemplate,mutating=true,failurePolicy=fail,sideEffects=None,groups=config-connector-templater.slamdev.net,resources=pubsubsubscriptiontemplates,verbs=create;update,versions=v1alpha1,name=mpubsubsubscriptiontemplate.kb.io,admissionReviewVersions={v1,v1beta1}
+
+// ModifiedByRecorder records the user changing a template in its last-modified-by annotation for the audit log.
+type ModifiedByRecorder struct {
+	TemplateType client.Object
+	decoder      *admission.Decoder
+}
+
+func (m *ModifiedByRecorder) Handle(_ context.Context, req admission.Request) admission.Response {
+	obj := m.newTemplate()
+	if err := m.decoder.DecodeRaw(req.Object, obj); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+	var old client.Object
+	if req.Operation == admissionv1.Update {
+		old = m.newTemplate()
+		if err := m.decoder.DecodeRaw(req.OldObject, old); err != nil {
+			return admission.Errored(http.StatusBadRequest, err)
+		}
+	}
+	if err := pkg.RecordModifiedBy(old, obj, req.UserInfo.Username); err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	// only the annotations are patched, the typed object would add its empty fields
+	var raw map[string]interface{}
+	if err := json.Unmarshal(req.Object.Raw, &raw); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+	metadata, _ := raw["metadata"].(map[string]interface{})
+	if metadata == nil {
+		metadata = make(map[string]interface{})
+		raw["metadata"] = metadata
+	}
+	if annotations := obj.GetAnnotations(); len(annotations) > 0 {
+		metadata["annotations"] = annotations
+	} else {
+		delete(metadata, "annotations")
+	}
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	return admission.PatchResponseFromRaw(req.Object.Raw, data)
+}
+
+func (m *ModifiedByRecorder) newTemplate() client.Object {
+	return reflect.New(reflect.ValueOf(m.TemplateType).Elem().Type()).Interface().(client.Object)
+}
+
+func (m *ModifiedByRecorder) InjectDecoder(d *admission.Decoder) error {
+	m.decoder = d
+	return nil
+}
+
+// CreateModifiedByWebhook registers a ModifiedByRecorder for every template kind with the webhook server of mgr.
+func CreateModifiedByWebhook(mgr ctrl.Manager) error {
+	for _, t := range controlledTypes {
+		gvk, err := apiutil.GVKForObject(t.templateType, mgr.GetScheme())
+		if err != nil {
+			return fmt.Errorf("unable to create %s modified-by webhook; %w", t.id, err)
+		}
+		path := "/mutate-" + strings.ReplaceAll(gvk.Group, ".", "-") + "-" + gvk.Version + "-" + strings.ToLower(gvk.Kind)
+		mgr.GetWebhookServer().Register(path, &webhook.Admission{Handler: &ModifiedByRecorder{TemplateType: t.templateType}})
+	}
+	return nil
+}
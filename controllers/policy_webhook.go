@@ -0,0 +1,97 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"github.com/slamdev/config-connector-templater/pkg"
+	"k8s.io/apimachinery/pkg/runtime"
+	"net/http"
+	"reflect"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+	"strings"
+)
+
+//+kubebuilder:webhook:path=/validate-config-connector-templater-slamdev-net-v1alpha1-pubsubtopictemplate,mutating=false,failurePolicy=fail,sideEffects=None,groups=config-connector-templater.slamdev.net,resources=pubsubtopictemplates,verbs=create;update,versions=v1alpha1,name=vpubsubtopictemplate.kb.io,admissionReviewVersions={v1,v1beta1}
+//+kubebuilder:webhook:path=/validate-config-connector-templater-slamdev-net-v1alpha1-pubsubsubscriptiontemplate,mutating=false,failurePolicy=fail,sideEffects=None,groups=config-connector-templater.slamdev.net,resources=pubsubsubscriptiontemplates,verbs=create;update,versions=v1alpha1,name=vpubsubsubscriptiontemplate.kb.io,admissionReviewVersions={v1,v1beta1}
+
+// PolicyValidator rejects templates whose rendered resource violates a TemplatePolicy.
+// Templates that can not be rendered are admitted with a warning, the render error is reported on their status.
+type PolicyValidator struct {
+	client.Client
+	Scheme       *runtime.Scheme
+	Config       pkg.Config
+	TemplateType client.Object
+	RenderType   client.Object
+	decoder      *admission.Decoder
+}
+
+func (v *PolicyValidator) Handle(ctx context.Context, req admission.Request) admission.Response {
+	src := reflect.New(reflect.ValueOf(v.TemplateType).Elem().Type()).Interface().(client.Object)
+	if err := v.decoder.Decode(req, src); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+	if !pkg.HasClass(src, v.Config.Class) {
+		return admission.Allowed("")
+	}
+	target := reflect.New(reflect.ValueOf(v.RenderType).Elem().Type()).Interface().(client.Object)
+	violations, err := pkg.CheckPolicies(ctx, v, v.Config, src, target)
+	if err != nil {
+		return admission.Allowed("").WithWarnings(fmt.Sprintf("policies not checked: %s", err))
+	}
+	if len(violations) == 0 {
+		return admission.Allowed("")
+	}
+	var msgs []string
+	for _, violation := range violations {
+		msgs = append(msgs, fmt.Sprintf("%s/%s: %s", violation.Policy, violation.Rule, violation.Message))
+	}
+	return admission.Denied("rendered resource violates policies: " + strings.Join(msgs, "; "))
+}
+
+func (v *PolicyValidator) GetScheme() *runtime.Scheme {
+	return v.Scheme
+}
+
+func (v *PolicyValidator) InjectDecoder(d *admission.Decoder) error {
+	v.decoder = d
+	return nil
+}
+
+// CreateWebhooks registers a PolicyValidator for every template kind with the webhook server of mgr.
+func CreateWebhooks(mgr ctrl.Manager, cfg pkg.Config) error {
+	for _, t := range controlledTypes {
+		gvk, err := apiutil.GVKForObject(t.templateType, mgr.GetScheme())
+		if err != nil {
+			return fmt.Errorf("unable to create %s webhook; %w", t.id, err)
+		}
+		path := "/validate-" + strings.ReplaceAll(gvk.Group, ".", "-") + "-" + gvk.Version + "-" + strings.ToLower(gvk.Kind)
+		mgr.GetWebhookServer().Register(path, &webhook.Admission{Handler: &PolicyValidator{
+			Client:       mgr.GetClient(),
+			Scheme:       mgr.GetScheme(),
+			Config:       cfg,
+			TemplateType: t.templateType,
+			RenderType:   t.renderType,
+		}})
+	}
+	return nil
+}
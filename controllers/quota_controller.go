@@ -0,0 +1,136 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	api "github.com/slamdev/config-connector-templater/api/v1alpha1"
+	"github.com/slamdev/config-connector-templater/pkg"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"reflect"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+// QuotaReconciler publishes the usage of a TemplateQuota object
+type QuotaReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+	// RenderTypes are keyed by kind
+	RenderTypes map[string]client.Object
+}
+
+func (r *QuotaReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	logger := log.FromContext(ctx).WithValues("templatequota", req.NamespacedName)
+
+	quota := &api.TemplateQuota{}
+	if err := r.Get(ctx, req.NamespacedName, quota); err != nil {
+		if errors.IsNotFound(err) {
+			return ctrl.Result{}, nil
+		}
+		logger.Error(err, "Failed to get resource")
+		return ctrl.Result{}, err
+	}
+
+	used := make(map[string]int, len(quota.Spec.Hard))
+	for kind := range quota.Spec.Hard {
+		renderType, ok := r.RenderTypes[kind]
+		if !ok {
+			// not rendered by the templater, nothing can be counted
+			continue
+		}
+		count, err := pkg.QuotaUsage(ctx, r, quota.Namespace, renderType)
+		if err != nil {
+			logger.Error(err, "Failed to count quota usage", "kind", kind)
+			return ctrl.Result{}, err
+		}
+		used[kind] = count
+	}
+	reserved := len(quota.Status.Reserved)
+	pending, err := pkg.SettleReservations(ctx, r, quota, r.RenderTypes)
+	if err != nil {
+		logger.Error(err, "Failed to settle quota reservations")
+		return ctrl.Result{}, err
+	}
+	result := ctrl.Result{}
+	if pending {
+		// reservations of creates that failed without releasing them expire
+		result.RequeueAfter = quotaRetryPeriod
+	}
+	if len(quota.Status.Reserved) == reserved && (reflect.DeepEqual(used, quota.Status.Used) || (len(used) == 0 && len(quota.Status.Used) == 0)) {
+		return result, nil
+	}
+	quota.Status.Used = used
+	// the update is guarded by the resourceVersion, it fails rather than dropping reservations made meanwhile
+	if err := r.Status().Update(ctx, quota); err != nil {
+		logger.Error(err, "Failed to update quota usage")
+		return ctrl.Result{}, err
+	}
+	return result, nil
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *QuotaReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	b := ctrl.NewControllerManagedBy(mgr).
+		For(&api.TemplateQuota{})
+	for _, renderType := range r.RenderTypes {
+		b = b.Watches(&source.Kind{Type: renderType}, handler.EnqueueRequestsFromMapFunc(r.quotas))
+	}
+	return b.Complete(r)
+}
+
+// quotas maps a rendered resource to the quotas in its namespace.
+func (r *QuotaReconciler) quotas(obj client.Object) []reconcile.Request {
+	list := &api.TemplateQuotaList{}
+	if err := r.List(context.Background(), list, client.InNamespace(obj.GetNamespace())); err != nil {
+		ctrl.Log.WithName("templatequota").Error(err, "Failed to list quotas")
+		return nil
+	}
+	var requests []reconcile.Request
+	for _, q := range list.Items {
+		requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Namespace: q.Namespace, Name: q.Name}})
+	}
+	return requests
+}
+
+func (r *QuotaReconciler) GetScheme() *runtime.Scheme {
+	return r.Scheme
+}
+
+func createQuotaController(mgr ctrl.Manager, cfg pkg.Config) error {
+	if cfg.GitOps != nil {
+		// rendered resources are kept in the repository, quotas are still checked before creating targets
+		return nil
+	}
+	renderTypes := make(map[string]client.Object, len(controlledTypes))
+	for _, t := range controlledTypes {
+		gvk, err := apiutil.GVKForObject(t.renderType, mgr.GetScheme())
+		if err != nil {
+			return err
+		}
+		renderTypes[gvk.Kind] = t.renderType
+	}
+	r := &QuotaReconciler{Client: mgr.GetClient(), Scheme: mgr.GetScheme(), RenderTypes: renderTypes}
+	return r.SetupWithManager(mgr)
+}
@@ -18,14 +18,35 @@ package controllers
 
 import (
 	"context"
+	goerrors "errors"
+	"github.com/go-logr/logr"
+	api "github.com/slamdev/config-connector-templater/api/v1alpha1"
 	"github.com/slamdev/config-connector-templater/pkg"
 	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
 	"reflect"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+	"time"
+)
+
+const (
+	conflictRetryPeriod = time.Minute
+	// namespaces are not watched, so a paused template checks for resume periodically
+	pausedRetryPeriod = time.Minute
+	// dependencies are not watched, so a waiting template checks them periodically
+	dependencyRetryPeriod = 15 * time.Second
+	// deletions of other rendered resources are not watched, so a template over quota checks it periodically
+	quotaRetryPeriod   = time.Minute
+	remoteResyncPeriod = time.Minute
 )
 
 // TemplateReconciler reconciles a PubSubTopicTemplate object
@@ -35,6 +56,10 @@ type TemplateReconciler struct {
 	LoggerName   string
 	TemplateType client.Object
 	RenderType   client.Object
+	References   []client.Object
+	Config       pkg.Config
+	Options      controller.Options
+	Sharding     pkg.Sharding
 }
 
 func (r *TemplateReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
@@ -50,29 +75,119 @@ func (r *TemplateReconciler) Reconcile(ctx context.Context, req ctrl.Request) (c
 		logger.Error(err, "Failed to get resource")
 		return ctrl.Result{}, err
 	}
+	if !pkg.HasClass(res, r.Config.Class) {
+		// events of rendered resources are not filtered by class
+		return ctrl.Result{}, nil
+	}
+
+	if !res.GetDeletionTimestamp().IsZero() {
+		return ctrl.Result{}, r.finalize(ctx, logger, res)
+	}
+	if pkg.SetTargetFinalizer(r.Config, res) {
+		// remote targets are not garbage collected and audited deletes are recorded by the templater,
+		// those targets are deleted with the template
+		if err := r.Update(ctx, res); err != nil {
+			logger.Error(err, "Failed to update finalizers")
+			return ctrl.Result{}, err
+		}
+	}
+
+	cli, err := pkg.TargetClient(ctx, r, r.Config, res)
+	if err != nil {
+		return r.failed(logger, err, "Failed to connect to target cluster")
+	}
+
+	name, err := pkg.TargetName(ctx, cli, r.Config, res)
+	if err != nil {
+		return r.failed(logger, err, "Failed to render target name")
+	}
 
 	found := r.initRenderType()
-	err = r.Get(ctx, types.NamespacedName{Name: res.GetName(), Namespace: res.GetNamespace()}, found)
+	err = cli.Get(ctx, types.NamespacedName{Name: name, Namespace: res.GetNamespace()}, found)
+	if err != nil && !errors.IsNotFound(err) {
+		logger.Error(err, "Failed to get resource")
+		return ctrl.Result{}, err
+	}
+
+	reason, pauseErr := pkg.PauseReason(ctx, cli, r.Config, res)
+	if pauseErr != nil {
+		logger.Error(pauseErr, "Failed to check pause")
+		return ctrl.Result{}, pauseErr
+	}
+	if reason != "" {
+		var target client.Object
+		if err == nil {
+			target = found
+		}
+		if err := pkg.ReportPaused(ctx, cli, r.Config, res, target, reason, name); err != nil {
+			return r.failed(logger, err, "Failed to report pause")
+		}
+		logger.Info("Reconciliation is paused", "reason", reason)
+		return ctrl.Result{RequeueAfter: pausedRetryPeriod}, nil
+	}
 
 	if err != nil && errors.IsNotFound(err) {
-		if err := pkg.CreateTargetResource(ctx, r, res, r.initRenderType()); err != nil {
-			logger.Error(err, "Failed to create resource")
+		waiting, err := pkg.WaitForDependencies(ctx, cli, res)
+		if err != nil {
+			logger.Error(err, "Failed to check dependencies")
 			return ctrl.Result{}, err
 		}
+		if waiting {
+			logger.Info("Waiting for dependencies")
+			return ctrl.Result{RequeueAfter: dependencyRetryPeriod}, nil
+		}
+		exceeded, err := pkg.CreateWithinQuota(ctx, cli, r.Config, res, r.initRenderType())
+		if err != nil {
+			if errors.IsAlreadyExists(err) {
+				// another template created it first, resolve the conflict on the next attempt
+				return ctrl.Result{Requeue: true}, nil
+			}
+			return r.failed(logger, err, "Failed to create resource")
+		}
+		if exceeded {
+			logger.Info("Quota exceeded")
+			return ctrl.Result{RequeueAfter: quotaRetryPeriod}, nil
+		}
 		return ctrl.Result{Requeue: true}, nil
-	} else if err != nil {
-		logger.Error(err, "Failed to get resource")
-		return ctrl.Result{}, err
 	}
 
-	if err := pkg.UpdateTargetResource(ctx, r, res, found, r.initRenderType()); err != nil {
-		logger.Error(err, "Failed to update resource")
+	owned, err := pkg.ResolveConflict(ctx, cli, r.Config, res, found)
+	if err != nil {
+		logger.Error(err, "Failed to resolve conflict")
 		return ctrl.Result{}, err
 	}
+	if !owned {
+		// the owner may go away or the spec may be fixed by hand, check again later
+		logger.Info("Resource is owned by another controller or can not be adopted", "name", name)
+		return ctrl.Result{RequeueAfter: conflictRetryPeriod}, nil
+	}
+
+	if err := pkg.UpdateTargetResource(ctx, cli, r.Config, res, found, r.initRenderType()); err != nil {
+		return r.failed(logger, err, "Failed to update resource")
+	}
 
+	if pkg.IsExternal(r.Config, res) {
+		// remote targets are not watched, their status is mirrored periodically
+		return ctrl.Result{RequeueAfter: remoteResyncPeriod}, nil
+	}
 	return ctrl.Result{}, nil
 }
 
+func (r *TemplateReconciler) failed(logger logr.Logger, err error, msg string) (ctrl.Result, error) {
+	if goerrors.Is(err, pkg.ErrRenderLimitExceeded) {
+		// retrying will not help, wait for the template to change
+		logger.Info("Render limit exceeded", "error", err.Error())
+		return ctrl.Result{}, nil
+	}
+	if goerrors.Is(err, pkg.ErrPolicyViolated) {
+		// retrying will not help, wait for the template or the policy to change
+		logger.Info("Rendered resource violates policies", "error", err.Error())
+		return ctrl.Result{}, nil
+	}
+	logger.Error(err, msg)
+	return ctrl.Result{}, err
+}
+
 func (r *TemplateReconciler) initTemplateType() client.Object {
 	return reflect.New(reflect.ValueOf(r.TemplateType).Elem().Type()).Interface().(client.Object)
 }
@@ -83,12 +198,71 @@ func (r *TemplateReconciler) initRenderType() client.Object {
 
 // SetupWithManager sets up the controller with the Manager.
 func (r *TemplateReconciler) SetupWithManager(mgr ctrl.Manager) error {
-	return ctrl.NewControllerManagedBy(mgr).
-		For(r.initTemplateType()).
-		Owns(r.initRenderType()).
+	// only templates and rendered resources are filtered by shard, events of other objects reach every
+	// replica and are mapped to the templates of its shard, see templates
+	shard := predicate.NewPredicateFuncs(r.Sharding.Owns)
+	b := ctrl.NewControllerManagedBy(mgr).
+		For(r.initTemplateType(), builder.WithPredicates(shard, predicate.NewPredicateFuncs(func(obj client.Object) bool {
+			return pkg.HasClass(obj, r.Config.Class)
+		})))
+	if r.Config.GitOps == nil {
+		// with GitOps the rendered resources may not even be installed in this cluster
+		b = b.Owns(r.initRenderType(), builder.WithPredicates(shard))
+	}
+	for _, ref := range r.References {
+		b = b.Watches(&source.Kind{Type: ref}, handler.EnqueueRequestsFromMapFunc(r.referencing))
+	}
+	for _, obj := range []client.Object{&api.TemplateDefaults{}, &api.ClusterTemplateDefaults{}, &api.TemplatePolicy{}, &api.TemplateQuota{}} {
+		// status updates, e.g. of quota usage, do not change the render
+		b = b.Watches(&source.Kind{Type: obj}, handler.EnqueueRequestsFromMapFunc(r.inNamespace),
+			builder.WithPredicates(predicate.GenerationChangedPredicate{}))
+	}
+	return b.
+		WithOptions(r.Options).
 		Complete(r)
 }
 
+// referencing maps a referenced template to the templates whose spec references it.
+func (r *TemplateReconciler) referencing(ref client.Object) []reconcile.Request {
+	return r.requests(r.Sharding.TemplatesReferencing(context.Background(), r, r.TemplateType, ref))
+}
+
+// inNamespace maps an object to the templates in its namespace, cluster scoped objects such as
+// ClusterTemplateDefaults and TemplatePolicy to all templates.
+func (r *TemplateReconciler) inNamespace(obj client.Object) []reconcile.Request {
+	return r.requests(r.Sharding.TemplatesIn(context.Background(), r, r.TemplateType, obj))
+}
+
+// requests turns the templates listed in the shard of this replica into requests.
+func (r *TemplateReconciler) requests(names []types.NamespacedName, err error) []reconcile.Request {
+	if err != nil {
+		ctrl.Log.WithName(r.LoggerName).Error(err, "Failed to list templates")
+		return nil
+	}
+	var requests []reconcile.Request
+	for _, name := range names {
+		requests = append(requests, reconcile.Request{NamespacedName: name})
+	}
+	return requests
+}
+
+// finalize deletes the target of a deleted template unless it is left to the garbage collector.
+func (r *TemplateReconciler) finalize(ctx context.Context, logger logr.Logger, res client.Object) error {
+	if !pkg.HasTargetFinalizer(res) {
+		return nil
+	}
+	if err := pkg.DeleteTarget(ctx, r, r.Config, res, r.initRenderType()); err != nil {
+		if !errors.IsNotFound(err) {
+			logger.Error(err, "Failed to delete target")
+			return err
+		}
+		// the kubeconfig secret is gone, the remote target can not be reached anymore
+		logger.Info("Remote target left behind", "error", err.Error())
+	}
+	pkg.RemoveTargetFinalizers(res)
+	return r.Update(ctx, res)
+}
+
 func (r *TemplateReconciler) GetScheme() *runtime.Scheme {
 	return r.Scheme
 }
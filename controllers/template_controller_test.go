@@ -21,6 +21,7 @@ import (
 	gke "github.com/GoogleCloudPlatform/k8s-config-connector/pkg/apis/k8s/v1alpha1"
 	pubsub "github.com/GoogleCloudPlatform/k8s-config-connector/pkg/apis/pubsub/v1beta1"
 	api "github.com/slamdev/config-connector-templater/api/v1alpha1"
+	"github.com/slamdev/config-connector-templater/pkg"
 	"github.com/stretchr/testify/assert"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
@@ -164,7 +165,7 @@ func TestMain(m *testing.M) {
 		panic(err)
 	}
 
-	if err := CreateControllers(k8sManager); err != nil {
+	if err := CreateControllers(k8sManager, pkg.Config{}, Options{}); err != nil {
 		panic(err)
 	}
 
@@ -0,0 +1,192 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// relaxcrd relaxes the generated schemas of template CRDs, so that fields of KCC types that are not strings,
+// or strings with a pattern, accept template expressions. The schemas are kept as generated in the schemas
+// directory, the controller checks the rendered resources against them instead.
+//
+//	go run ./hack/relaxcrd -templated=v1alpha1:spec,v1alpha2:spec.template -schemas=pkg/schemas config/crd/bases/*_pubsubtopictemplates.yaml
+//
+// Required fields a template may leave out, e.g. topicRef when topicTemplateRef is set, are made optional:
+//
+//	go run ./hack/relaxcrd -optional=v1alpha1:spec.topicRef,v1alpha2:spec.template.topicRef config/crd/bases/*_pubsubsubscriptiontemplates.yaml
+package main
+
+import (
+	"flag"
+	"fmt"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	"os"
+	"path/filepath"
+	"sigs.k8s.io/yaml"
+	"strings"
+)
+
+func main() {
+	templated := flag.String("templated", "v1alpha1:spec",
+		"Comma separated list of version:path pairs, the path is the dot separated field holding the templated spec.")
+	optional := flag.String("optional", "",
+		"Comma separated list of version:path pairs of required fields templates may leave out, e.g. fields set from a template reference.")
+	schemas := flag.String("schemas", "",
+		"Directory the schema of the templated spec of the storage version is written to before it is relaxed.")
+	flag.Parse()
+
+	paths, err := parsePaths(*templated)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	optionalPaths, err := parsePaths(*optional)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	for _, file := range flag.Args() {
+		if err := relaxFile(file, paths, optionalPaths, *schemas); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to relax %s; %s\n", file, err)
+			os.Exit(1)
+		}
+	}
+}
+
+// parsePaths parses a comma separated list of version:path pairs into the dot separated paths per version.
+func parsePaths(list string) (map[string][][]string, error) {
+	paths := make(map[string][][]string)
+	if list == "" {
+		return paths, nil
+	}
+	for _, pair := range strings.Split(list, ",") {
+		i := strings.Index(pair, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid version:path pair %q", pair)
+		}
+		paths[pair[:i]] = append(paths[pair[:i]], strings.Split(pair[i+1:], "."))
+	}
+	return paths, nil
+}
+
+func relaxFile(file string, paths map[string][][]string, optional map[string][][]string, schemas string) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	crd := &apiextensionsv1.CustomResourceDefinition{}
+	if err := yaml.Unmarshal(data, crd); err != nil {
+		return err
+	}
+	for _, version := range crd.Spec.Versions {
+		if version.Schema == nil || version.Schema.OpenAPIV3Schema == nil {
+			continue
+		}
+		storage := version.Storage
+		for _, path := range paths[version.Name] {
+			err := walk(version.Schema.OpenAPIV3Schema, path, func(templated *apiextensionsv1.JSONSchemaProps) error {
+				if storage && schemas != "" {
+					if err := writeSchema(filepath.Join(schemas, strings.ToLower(crd.Spec.Names.Kind)+".yaml"), templated); err != nil {
+						return err
+					}
+				}
+				relax(templated)
+				return nil
+			})
+			if err != nil {
+				return fmt.Errorf("version %s; %w", version.Name, err)
+			}
+		}
+		for _, path := range optional[version.Name] {
+			// the kept schema still requires the field, it is set once rendered
+			err := walk(version.Schema.OpenAPIV3Schema, path[:len(path)-1], func(parent *apiextensionsv1.JSONSchemaProps) error {
+				parent.Required = remove(parent.Required, path[len(path)-1])
+				return nil
+			})
+			if err != nil {
+				return fmt.Errorf("version %s; %w", version.Name, err)
+			}
+		}
+	}
+	out, err := yaml.Marshal(crd)
+	if err != nil {
+		return err
+	}
+	// the document separator written by controller-gen
+	return os.WriteFile(file, append([]byte("\n---\n"), out...), 0644)
+}
+
+func writeSchema(file string, schema *apiextensionsv1.JSONSchemaProps) error {
+	out, err := yaml.Marshal(schema)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(file, out, 0644)
+}
+
+// walk calls fn with the schema of the field at path below schema. Properties are kept by value,
+// so the edited copies are stored back on the way up.
+func walk(schema *apiextensionsv1.JSONSchemaProps, path []string, fn func(*apiextensionsv1.JSONSchemaProps) error) error {
+	if len(path) == 0 {
+		return fn(schema)
+	}
+	prop, ok := schema.Properties[path[0]]
+	if !ok {
+		return fmt.Errorf("no field %s", path[0])
+	}
+	if err := walk(&prop, path[1:], fn); err != nil {
+		return err
+	}
+	schema.Properties[path[0]] = prop
+	return nil
+}
+
+func remove(list []string, item string) []string {
+	var out []string
+	for _, v := range list {
+		if v != item {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// relax drops the constraints template expressions can not meet from schema and every schema below it,
+// integers accept strings too and numbers and booleans any value.
+func relax(schema *apiextensionsv1.JSONSchemaProps) {
+	schema.Format, schema.Pattern, schema.Enum = "", "", nil
+	schema.MinLength, schema.MaxLength, schema.MultipleOf = nil, nil, nil
+	schema.Minimum, schema.Maximum = nil, nil
+	schema.ExclusiveMinimum, schema.ExclusiveMaximum = false, false
+	switch schema.Type {
+	case "integer":
+		schema.Type, schema.XIntOrString = "", true
+	case "number", "boolean":
+		preserve := true
+		schema.Type, schema.XPreserveUnknownFields = "", &preserve
+	}
+	for key, prop := range schema.Properties {
+		relax(&prop)
+		schema.Properties[key] = prop
+	}
+	if schema.AdditionalProperties != nil && schema.AdditionalProperties.Schema != nil {
+		relax(schema.AdditionalProperties.Schema)
+	}
+	if schema.Items != nil {
+		if schema.Items.Schema != nil {
+			relax(schema.Items.Schema)
+		}
+		for i := range schema.Items.JSONSchemas {
+			relax(&schema.Items.JSONSchemas[i])
+		}
+	}
+}
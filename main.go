@@ -17,9 +17,15 @@ limitations under the License.
 package main
 
 import (
+	"context"
 	"flag"
 	pubsub "github.com/GoogleCloudPlatform/k8s-config-connector/pkg/apis/pubsub/v1beta1"
+	corev1 "k8s.io/api/core/v1"
 	"os"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"strings"
+	"time"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
 	// to ensure that exec-entrypoint and run can make use of them.
@@ -33,7 +39,9 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 
 	configconnectortemplaterv1alpha1 "github.com/slamdev/config-connector-templater/api/v1alpha1"
+	configconnectortemplaterv1alpha2 "github.com/slamdev/config-connector-templater/api/v1alpha2"
 	"github.com/slamdev/config-connector-templater/controllers"
+	"github.com/slamdev/config-connector-templater/pkg"
 	//+kubebuilder:scaffold:imports
 )
 
@@ -48,18 +56,113 @@ func init() {
 	utilruntime.Must(pubsub.AddToScheme(scheme))
 
 	utilruntime.Must(configconnectortemplaterv1alpha1.AddToScheme(scheme))
+	utilruntime.Must(configconnectortemplaterv1alpha2.AddToScheme(scheme))
 	//+kubebuilder:scaffold:scheme
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "eval" {
+		// jsonnet and cue expressions are evaluated in a child process that is killed when the render times out
+		os.Exit(pkg.ServeEval(os.Stdin, os.Stdout))
+	}
+	if len(os.Args) > 1 && (os.Args[1] == "export" || os.Args[1] == "import") {
+		backup(os.Args[1], os.Args[2:])
+		return
+	}
+
+	var configFile string
 	var metricsAddr string
 	var enableLeaderElection bool
 	var probeAddr string
+	var allowedFunctions string
+	var limits pkg.Limits
+	var cacheSize int
+	var paused bool
+	var concurrency string
+	var syncPeriod time.Duration
+	var rateLimiter pkg.RateLimiterOptions
+	var watchNamespaces string
+	var sharding pkg.Sharding
+	var class string
+	var propagationExclude string
+	var auditLog string
+	var auditRedact string
+	var revisionHistoryLimit int
+	var enablePolicyWebhook bool
+	var enableModifiedByWebhook bool
+	var enableConversionWebhook bool
+	var gitOps pkg.GitOptions
+	flag.StringVar(&configFile, "config", "",
+		"The controller will load its initial configuration from this file. "+
+			"Omit this flag to use the default configuration values. "+
+			"Command-line flags override configuration from this file.")
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
+	flag.StringVar(&allowedFunctions, "allowed-template-functions", "",
+		"Comma separated list of functions go templates may call. "+
+			"Defaults to all sprig functions except env, expandenv and getHostByName.")
+	flag.DurationVar(&limits.Timeout, "render-timeout", 5*time.Second,
+		"The wall-clock time a single template render may take.")
+	flag.IntVar(&limits.MaxOutputBytes, "render-max-output-bytes", 1024*1024,
+		"The maximum size of everything a single template render produces.")
+	flag.IntVar(&limits.MaxDepth, "render-max-depth", 50,
+		"The maximum nesting of template actions and defined template calls.")
+	flag.IntVar(&cacheSize, "render-cache-size", 10000,
+		"The number of parsed templates and rendered targets kept in memory.")
+	flag.BoolVar(&paused, "paused", false,
+		"Suspend creating and updating rendered resources in the whole cluster, status and drift are still reported.")
+	flag.StringVar(&concurrency, "max-concurrent-reconciles", "",
+		"Comma separated list of Kind=count pairs limiting the templates of a kind reconciled in parallel. "+
+			"A bare count applies to all kinds. Defaults to 1.")
+	flag.DurationVar(&syncPeriod, "sync-period", 0,
+		"The minimum frequency at which all templates are reconciled. Defaults to 10 hours.")
+	flag.DurationVar(&rateLimiter.BaseDelay, "rate-limiter-base-delay", 0,
+		"The delay before retrying a failed template, doubled on every failure. Defaults to 5ms.")
+	flag.DurationVar(&rateLimiter.MaxDelay, "rate-limiter-max-delay", 0,
+		"The maximum delay before retrying a failed template. Defaults to 1000s.")
+	flag.IntVar(&rateLimiter.QPS, "rate-limiter-qps", 0,
+		"The overall number of template retries per second. Defaults to 10.")
+	flag.IntVar(&rateLimiter.Burst, "rate-limiter-burst", 0,
+		"The number of template retries allowed above the QPS. Defaults to 100.")
+	flag.StringVar(&watchNamespaces, "watch-namespaces", "",
+		"Comma separated list of namespaces to watch. Defaults to all namespaces.")
+	flag.IntVar(&sharding.Shards, "shards", 0,
+		"The number of shards templates are split into, each replica reconciles a single shard. "+
+			"Templates are assigned by the "+pkg.ShardLabel+" label or a hash of their namespace.")
+	flag.IntVar(&sharding.ID, "shard-id", -1,
+		"The shard reconciled by this replica. Defaults to the ordinal of the StatefulSet pod.")
+	flag.StringVar(&class, "class", "",
+		"The templater class handled by this installation, matched against the "+pkg.ClassAnnotation+" annotation. "+
+			"Defaults to the templates without a class.")
+	flag.StringVar(&propagationExclude, "propagation-exclude", "",
+		"Comma separated list of substrings of annotation and label keys not copied to rendered resources. "+
+			"Defaults to fluxcd.io,last-applied-configuration.")
+	flag.StringVar(&auditLog, "audit-log", "",
+		"Write a JSON line for every change to rendered resources to this file, - for stdout. Disabled by default.")
+	flag.StringVar(&auditRedact, "audit-redact", strings.Join(pkg.DefaultRedactedPaths(), ","),
+		"Comma separated list of spec paths whose values are hidden in the audit log.")
+	flag.IntVar(&revisionHistoryLimit, "revision-history-limit", 10,
+		"The number of rendered specs kept as ControllerRevisions per template, 0 disables the history.")
+	flag.BoolVar(&enablePolicyWebhook, "enable-policy-webhook", false,
+		"Serve the admission webhook rejecting templates whose rendered resource violates a TemplatePolicy. "+
+			"Requires a serving certificate, see config/webhook.")
+	flag.BoolVar(&enableModifiedByWebhook, "enable-modified-by-webhook", false,
+		"Serve the admission webhook recording the user of the last change to a template, reported as modifiedBy "+
+			"in the audit log. Requires a serving certificate, see config/webhook.")
+	flag.BoolVar(&enableConversionWebhook, "enable-conversion-webhook", false,
+		"Serve the webhook converting templates between API versions, required to serve v1alpha2. "+
+			"Requires a serving certificate, see config/webhook.")
+	flag.StringVar(&gitOps.Repo, "gitops-repo", "",
+		"Commit rendered resources as YAML files to this Git repository instead of applying them: "+
+			"a local worktree or the URL of a repository to clone and push to. Disabled by default.")
+	flag.StringVar(&gitOps.Branch, "gitops-branch", "main", "The branch rendered resources are committed to.")
+	flag.StringVar(&gitOps.Dir, "gitops-dir", "/tmp/templater-gitops", "The worktree a remote --gitops-repo is cloned into.")
+	flag.StringVar(&gitOps.Path, "gitops-path", "", "The directory of the repository holding the rendered resources.")
+	flag.StringVar(&gitOps.Author, "gitops-author", "config-connector-templater <config-connector-templater@slamdev.net>",
+		"The author of the commits as name <email>.")
 	opts := zap.Options{
 		Development: true,
 	}
@@ -68,23 +171,171 @@ func main() {
 
 	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
 
-	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
-		Scheme:                 scheme,
-		MetricsBindAddress:     metricsAddr,
-		Port:                   9443,
-		HealthProbeBindAddress: probeAddr,
-		LeaderElection:         enableLeaderElection,
-		LeaderElectionID:       "e9aa28d2.slamdev.net",
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
 	})
+
+	var err error
+	options := ctrl.Options{Scheme: scheme}
+	templaterConfig := configconnectortemplaterv1alpha1.TemplaterConfig{}
+	if configFile != "" {
+		options, err = options.AndFrom(ctrl.ConfigFile().AtPath(configFile).OfKind(&templaterConfig))
+		if err != nil {
+			setupLog.Error(err, "unable to load the config file")
+			os.Exit(1)
+		}
+	}
+	if explicit["metrics-bind-address"] || options.MetricsBindAddress == "" {
+		options.MetricsBindAddress = metricsAddr
+	}
+	if explicit["health-probe-bind-address"] || options.HealthProbeBindAddress == "" {
+		options.HealthProbeBindAddress = probeAddr
+	}
+	if explicit["leader-elect"] {
+		options.LeaderElection = enableLeaderElection
+	}
+	if options.LeaderElectionID == "" {
+		options.LeaderElectionID = "e9aa28d2.slamdev.net"
+	}
+
+	if !explicit["class"] {
+		class = templaterConfig.Class
+	}
+	if !explicit["paused"] {
+		paused = templaterConfig.Paused
+	}
+	options.LeaderElectionID = pkg.ClassLeaderElectionID(class, options.LeaderElectionID)
+
+	if !explicit["shards"] {
+		sharding.Shards = templaterConfig.Sharding.Shards
+	}
+	if !explicit["shard-id"] && templaterConfig.Sharding.ShardID != nil {
+		sharding.ID = *templaterConfig.Sharding.ShardID
+	}
+	if sharding.Enabled() && sharding.ID < 0 {
+		hostname, _ := os.Hostname()
+		if sharding.ID, err = pkg.ShardFromHostname(hostname); err != nil {
+			// pods of a Deployment have no ordinal, config/sharding runs the manager as a StatefulSet
+			setupLog.Error(err, "unable to detect shard id, set --shard-id or deploy config/sharding")
+			os.Exit(1)
+		}
+	}
+	if err := sharding.Validate(); err != nil {
+		setupLog.Error(err, "invalid sharding")
+		os.Exit(1)
+	}
+	options.LeaderElectionID = sharding.LeaderElectionID(options.LeaderElectionID)
+	if options.Port == 0 {
+		options.Port = 9443
+	}
+	if explicit["sync-period"] {
+		options.SyncPeriod = &syncPeriod
+	}
+
+	controllerOptions := controllers.Options{MaxConcurrentReconciles: templaterConfig.MaxConcurrentReconciles, Sharding: sharding}
+	if concurrency != "" {
+		counts, err := pkg.ParseConcurrency(concurrency)
+		if err != nil {
+			setupLog.Error(err, "invalid --max-concurrent-reconciles")
+			os.Exit(1)
+		}
+		controllerOptions.MaxConcurrentReconciles = counts
+	}
+	controllerOptions.RateLimiter = rateLimiterOptions(templaterConfig.RateLimiter)
+	if explicit["rate-limiter-base-delay"] {
+		controllerOptions.RateLimiter.BaseDelay = rateLimiter.BaseDelay
+	}
+	if explicit["rate-limiter-max-delay"] {
+		controllerOptions.RateLimiter.MaxDelay = rateLimiter.MaxDelay
+	}
+	if explicit["rate-limiter-qps"] {
+		controllerOptions.RateLimiter.QPS = rateLimiter.QPS
+	}
+	if explicit["rate-limiter-burst"] {
+		controllerOptions.RateLimiter.Burst = rateLimiter.Burst
+	}
+
+	namespaces := templaterConfig.WatchNamespaces
+	if watchNamespaces != "" {
+		namespaces = pkg.ParseList(watchNamespaces)
+	}
+	if len(namespaces) == 1 {
+		options.Namespace = namespaces[0]
+	} else if len(namespaces) > 1 {
+		options.Namespace = ""
+		options.NewCache = cache.MultiNamespacedCacheBuilder(namespaces)
+	}
+	// kubeconfig secrets of remote clusters are read rarely, caching all secrets is not worth it
+	options.ClientDisableCacheFor = []client.Object{&corev1.Secret{}}
+	if options.Namespace != "" || options.NewCache != nil {
+		// namespaces are cluster scoped and can not be served by a namespaced cache
+		options.ClientDisableCacheFor = append(options.ClientDisableCacheFor, &corev1.Namespace{})
+	}
+
+	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), options)
 	if err != nil {
 		setupLog.Error(err, "unable to start manager")
 		os.Exit(1)
 	}
 
-	if err := controllers.CreateControllers(mgr); err != nil {
+	cfg := pkg.Config{Limits: limits, Paused: paused, Class: class, Cache: pkg.NewCache(cacheSize), Remotes: pkg.NewRemotes(),
+		Quotas: pkg.NewQuotas(mgr.GetAPIReader())}
+	cfg.AllowedFunctions = templaterConfig.AllowedFunctions
+	if allowedFunctions != "" {
+		cfg.AllowedFunctions = pkg.ParseList(allowedFunctions)
+	}
+	if !explicit["revision-history-limit"] && templaterConfig.RevisionHistoryLimit != nil {
+		cfg.RevisionHistoryLimit = *templaterConfig.RevisionHistoryLimit
+	} else {
+		cfg.RevisionHistoryLimit = revisionHistoryLimit
+	}
+	cfg.ExcludedKeys = templaterConfig.PropagationExclude
+	if explicit["propagation-exclude"] {
+		cfg.ExcludedKeys = pkg.ParseList(propagationExclude)
+	}
+
+	if gitOps.Repo != "" {
+		if cfg.GitOps, err = pkg.NewGitStore(context.Background(), gitOps, mgr.GetScheme()); err != nil {
+			setupLog.Error(err, "unable to prepare gitops repository")
+			os.Exit(1)
+		}
+	}
+
+	if auditLog == "-" {
+		cfg.Audit = pkg.NewAuditLog(os.Stdout, pkg.ParseList(auditRedact))
+	} else if auditLog != "" {
+		f, err := os.OpenFile(auditLog, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			setupLog.Error(err, "unable to open audit log")
+			os.Exit(1)
+		}
+		defer f.Close()
+		cfg.Audit = pkg.NewAuditLog(f, pkg.ParseList(auditRedact))
+	}
+
+	if err := controllers.CreateControllers(mgr, cfg, controllerOptions); err != nil {
 		setupLog.Error(err, "unable to create controllers")
 		os.Exit(1)
 	}
+	if enablePolicyWebhook {
+		if err := controllers.CreateWebhooks(mgr, cfg); err != nil {
+			setupLog.Error(err, "unable to create webhooks")
+			os.Exit(1)
+		}
+	}
+	if enableModifiedByWebhook {
+		if err := controllers.CreateModifiedByWebhook(mgr); err != nil {
+			setupLog.Error(err, "unable to create modified-by webhook")
+			os.Exit(1)
+		}
+	}
+	if enableConversionWebhook {
+		if err := controllers.CreateConversionWebhook(mgr); err != nil {
+			setupLog.Error(err, "unable to create conversion webhook")
+			os.Exit(1)
+		}
+	}
 	//+kubebuilder:scaffold:builder
 
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
@@ -102,3 +353,52 @@ func main() {
 		os.Exit(1)
 	}
 }
+
+// backup runs the export and import commands, which copy templates and rendered resources between clusters.
+func backup(command string, args []string) {
+	var dir string
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	flags.StringVar(&dir, "dir", "backup", "The directory templates and rendered resources are exported to and imported from.")
+	opts := zap.Options{
+		Development: true,
+	}
+	opts.BindFlags(flags)
+	_ = flags.Parse(args)
+
+	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
+
+	c, err := client.New(ctrl.GetConfigOrDie(), client.Options{Scheme: scheme})
+	if err != nil {
+		setupLog.Error(err, "unable to create client")
+		os.Exit(1)
+	}
+	run := pkg.Export
+	if command == "import" {
+		run = pkg.Import
+	}
+	count, err := run(context.Background(), backupClient{c}, controllers.BackupKinds(), dir)
+	if err != nil {
+		setupLog.Error(err, command+" failed", "objects", count)
+		os.Exit(1)
+	}
+	setupLog.Info(command+" finished", "objects", count, "dir", dir)
+}
+
+type backupClient struct {
+	client.Client
+}
+
+func (c backupClient) GetScheme() *runtime.Scheme {
+	return c.Scheme()
+}
+
+func rateLimiterOptions(c configconnectortemplaterv1alpha1.RateLimiterConfig) pkg.RateLimiterOptions {
+	opts := pkg.RateLimiterOptions{QPS: c.QPS, Burst: c.Burst}
+	if c.BaseDelay != nil {
+		opts.BaseDelay = c.BaseDelay.Duration
+	}
+	if c.MaxDelay != nil {
+		opts.MaxDelay = c.MaxDelay.Duration
+	}
+	return opts
+}
@@ -0,0 +1,205 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	corev1 "k8s.io/api/core/v1"
+	"reflect"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	AuditCreate = "create"
+	AuditUpdate = "update"
+	AuditDelete = "delete"
+
+	CauseTargetMissing   = "TargetMissing"
+	CauseTemplateChanged = "TemplateChanged"
+	CauseOwnerChanged    = "OwnerChanged"
+	CauseDrift           = "Drift"
+	CauseTemplateDeleted = "TemplateDeleted"
+	CauseRollback        = "Rollback"
+	CauseAutoRollback    = "AutoRollback"
+
+	// AuditDeleteFinalizer is set on templates rendering into the local cluster while auditing,
+	// their target is deleted and the delete recorded before the template goes away.
+	AuditDeleteFinalizer = AnnotationPrefix + "audit-delete"
+
+	// LastModifiedByAnnotation holds the user of the last change to a template, it is set by the modified-by webhook.
+	LastModifiedByAnnotation = AnnotationPrefix + "last-modified-by"
+
+	redacted = "<redacted>"
+)
+
+// AuditRecord is a single change applied to a rendered resource.
+type AuditRecord struct {
+	Time     time.Time              `json:"time"`
+	Action   string                 `json:"action"`
+	Template corev1.ObjectReference `json:"template"`
+	Target   corev1.ObjectReference `json:"target"`
+	Diff     []FieldDiff            `json:"diff,omitempty"`
+	Cause    string                 `json:"cause"`
+	// ModifiedBy is the user of the last change to the template, see LastModifiedByAnnotation.
+	ModifiedBy string `json:"modifiedBy,omitempty"`
+}
+
+// AuditLog writes audit records as JSON lines. A nil AuditLog discards them.
+type AuditLog struct {
+	mu     sync.Mutex
+	out    io.Writer
+	redact []string
+}
+
+// NewAuditLog writes records to out and hides the values of the fields under the redact paths,
+// e.g. $.pushConfig.oidcToken.
+func NewAuditLog(out io.Writer, redact []string) *AuditLog {
+	return &AuditLog{out: out, redact: redact}
+}
+
+// DefaultRedactedPaths hides the push endpoint and its credentials, which may carry tokens.
+func DefaultRedactedPaths() []string {
+	return []string{"$.pushConfig.pushEndpoint", "$.pushConfig.attributes", "$.pushConfig.oidcToken"}
+}
+
+func (a *AuditLog) Record(rec AuditRecord) error {
+	if a == nil {
+		return nil
+	}
+	if rec.Time.IsZero() {
+		rec.Time = time.Now().UTC()
+	}
+	diff := make([]FieldDiff, len(rec.Diff))
+	for i, d := range rec.Diff {
+		if a.isRedacted(d.Path) {
+			d.Old, d.New = redactValue(d.Old), redactValue(d.New)
+		}
+		diff[i] = d
+	}
+	rec.Diff = diff
+
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("failed to marshal audit record; %w", err)
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.out.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write audit record; %w", err)
+	}
+	return nil
+}
+
+func (a *AuditLog) isRedacted(path string) bool {
+	for _, p := range a.redact {
+		if path == p || strings.HasPrefix(path, p+".") || strings.HasPrefix(path, p+"[") {
+			return true
+		}
+	}
+	return false
+}
+
+func redactValue(v interface{}) interface{} {
+	if v == nil {
+		return nil
+	}
+	return redacted
+}
+
+func recordChange(cli CliCli, cfg Config, action string, cause string, src client.Object, target client.Object, diff []FieldDiff) error {
+	return cfg.Audit.Record(AuditRecord{
+		Action:     action,
+		Template:   objectRef(cli, src),
+		Target:     objectRef(cli, target),
+		Diff:       diff,
+		Cause:      cause,
+		ModifiedBy: lastModifiedBy(src),
+	})
+}
+
+func objectRef(cli CliCli, obj client.Object) corev1.ObjectReference {
+	return corev1.ObjectReference{
+		Kind:      kindOf(cli, obj),
+		Namespace: obj.GetNamespace(),
+		Name:      obj.GetName(),
+		UID:       obj.GetUID(),
+	}
+}
+
+// lastModifiedBy is the user of the last change to src, empty without the modified-by webhook.
+func lastModifiedBy(src client.Object) string {
+	user, _ := getAnnotation(src, LastModifiedByAnnotation)
+	return user
+}
+
+// RecordModifiedBy sets the last-modified-by annotation of obj to user if it changes anything but its status
+// and the metadata kept by the API server and controllers, e.g. finalizers. old is nil for new objects.
+// Otherwise the annotation of old is kept, so it can not be set by hand.
+func RecordModifiedBy(old client.Object, obj client.Object, user string) error {
+	changed := old == nil
+	if !changed {
+		before, err := userFields(old)
+		if err != nil {
+			return err
+		}
+		after, err := userFields(obj)
+		if err != nil {
+			return err
+		}
+		changed = !reflect.DeepEqual(before, after)
+	}
+	if changed {
+		setAnnotation(obj, LastModifiedByAnnotation, user)
+		return nil
+	}
+	if v, ok := old.GetAnnotations()[LastModifiedByAnnotation]; ok {
+		setAnnotation(obj, LastModifiedByAnnotation, v)
+		return nil
+	}
+	annotations := obj.GetAnnotations()
+	delete(annotations, LastModifiedByAnnotation)
+	obj.SetAnnotations(annotations)
+	return nil
+}
+
+// userFields returns the fields of obj users change: everything but the status and the metadata
+// besides labels and annotations.
+func userFields(obj client.Object) (map[string]interface{}, error) {
+	fields, err := structToMap(obj)
+	if err != nil {
+		return nil, err
+	}
+	delete(fields, "status")
+	delete(fields, "metadata")
+	annotations := make(map[string]string)
+	for k, v := range obj.GetAnnotations() {
+		if k != LastModifiedByAnnotation {
+			annotations[k] = v
+		}
+	}
+	labels := make(map[string]string)
+	for k, v := range obj.GetLabels() {
+		labels[k] = v
+	}
+	fields["annotations"], fields["labels"] = annotations, labels
+	return fields, nil
+}
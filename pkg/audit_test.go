@@ -0,0 +1,132 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	pubsub "github.com/GoogleCloudPlatform/k8s-config-connector/pkg/apis/pubsub/v1beta1"
+	api "github.com/slamdev/config-connector-templater/api/v1alpha1"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"testing"
+)
+
+func TestAuditLogRedacts(t *testing.T) {
+	out := &bytes.Buffer{}
+	audit := NewAuditLog(out, DefaultRedactedPaths())
+	err := audit.Record(AuditRecord{
+		Action: AuditUpdate,
+		Cause:  CauseTemplateChanged,
+		Diff: []FieldDiff{
+			{Path: "$.pushConfig.pushEndpoint", Old: "https://a?token=1", New: "https://b?token=2"},
+			{Path: "$.pushConfig.attributes.x-goog-version", New: "v1"},
+			{Path: "$.ackDeadlineSeconds", Old: 10, New: 20},
+		},
+	})
+	assert.NoError(t, err)
+
+	rec := AuditRecord{}
+	assert.NoError(t, json.Unmarshal(out.Bytes(), &rec))
+	assert.Equal(t, FieldDiff{Path: "$.pushConfig.pushEndpoint", Old: redacted, New: redacted}, rec.Diff[0])
+	assert.Equal(t, FieldDiff{Path: "$.pushConfig.attributes.x-goog-version", New: redacted}, rec.Diff[1])
+	assert.Equal(t, FieldDiff{Path: "$.ackDeadlineSeconds", Old: float64(10), New: float64(20)}, rec.Diff[2])
+
+	var disabled *AuditLog
+	assert.NoError(t, disabled.Record(rec))
+}
+
+func TestDiffSpecsCreate(t *testing.T) {
+	diffs, err := diffSpecs(nil, map[string]interface{}{"a": map[string]interface{}{"b": "c"}, "d": "e"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"$.a.b", "$.d"}, diffPaths(diffs))
+}
+
+func TestRecordModifiedBy(t *testing.T) {
+	template := &api.PubSubTopicTemplate{ObjectMeta: metav1.ObjectMeta{Name: "orders", Namespace: "team1"}}
+	assert.NoError(t, RecordModifiedBy(nil, template, "alice"))
+	assert.Equal(t, "alice", lastModifiedBy(template))
+
+	// finalizers and status are kept by the controller
+	old := template.DeepCopy()
+	template.Finalizers = []string{RemoteTargetFinalizer}
+	template.Status.Conditions = []metav1.Condition{{Type: RenderedCondition, Status: metav1.ConditionTrue}}
+	assert.NoError(t, RecordModifiedBy(old, template, "system:serviceaccount:templater:manager"))
+	assert.Equal(t, "alice", lastModifiedBy(template))
+
+	old = template.DeepCopy()
+	resourceID := "orders"
+	template.Spec.ResourceID = &resourceID
+	assert.NoError(t, RecordModifiedBy(old, template, "bob"))
+	assert.Equal(t, "bob", lastModifiedBy(template))
+
+	old = template.DeepCopy()
+	template.Labels = map[string]string{"team": "payments"}
+	assert.NoError(t, RecordModifiedBy(old, template, "carol"))
+	assert.Equal(t, "carol", lastModifiedBy(template))
+
+	// the annotation can not be set by hand
+	old = template.DeepCopy()
+	template.Annotations[LastModifiedByAnnotation] = "mallory"
+	assert.NoError(t, RecordModifiedBy(old, template, "mallory"))
+	assert.Equal(t, "carol", lastModifiedBy(template))
+
+	old = &api.PubSubTopicTemplate{ObjectMeta: metav1.ObjectMeta{Name: "orders", Namespace: "team1"}}
+	template = old.DeepCopy()
+	template.Annotations = map[string]string{LastModifiedByAnnotation: "mallory"}
+	assert.NoError(t, RecordModifiedBy(old, template, "mallory"))
+	assert.Equal(t, "", lastModifiedBy(template))
+}
+
+func TestDeleteTargetAudited(t *testing.T) {
+	ctx := context.Background()
+	template := &api.PubSubTopicTemplate{ObjectMeta: metav1.ObjectMeta{Name: "orders", Namespace: "team1", UID: "uid"}}
+	controller := true
+	owner := metav1.OwnerReference{APIVersion: api.GroupVersion.String(), Kind: "PubSubTopicTemplate", Name: "orders", UID: "uid", Controller: &controller}
+	target := &pubsub.PubSubTopic{ObjectMeta: metav1.ObjectMeta{Name: "orders", Namespace: "team1", OwnerReferences: []metav1.OwnerReference{owner}}}
+	cli := newFakeCli(template, target, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team1"}})
+	out := &bytes.Buffer{}
+	cfg := Config{Audit: NewAuditLog(out, nil)}
+
+	// local targets are deleted by the templater while auditing, otherwise they are garbage collected
+	assert.True(t, SetTargetFinalizer(cfg, template))
+	assert.Equal(t, []string{AuditDeleteFinalizer}, template.Finalizers)
+	assert.False(t, SetTargetFinalizer(cfg, template))
+	assert.True(t, SetTargetFinalizer(Config{}, template))
+	assert.Empty(t, template.Finalizers)
+
+	assert.NoError(t, DeleteTarget(ctx, cli, cfg, template, &pubsub.PubSubTopic{}))
+	assert.True(t, errors.IsNotFound(cli.Get(ctx, client.ObjectKeyFromObject(target), &pubsub.PubSubTopic{})))
+	rec := AuditRecord{}
+	assert.NoError(t, json.Unmarshal(out.Bytes(), &rec))
+	assert.Equal(t, AuditDelete, rec.Action)
+	assert.Equal(t, CauseTemplateDeleted, rec.Cause)
+	assert.Equal(t, "orders", rec.Target.Name)
+	assert.Equal(t, "PubSubTopic", rec.Target.Kind)
+
+	// a target that is already gone or not owned by the template is not recorded
+	out.Reset()
+	assert.NoError(t, DeleteTarget(ctx, cli, cfg, template, &pubsub.PubSubTopic{}))
+	assert.NoError(t, cli.Create(ctx, &pubsub.PubSubTopic{ObjectMeta: metav1.ObjectMeta{Name: "orders", Namespace: "team1"}}))
+	assert.NoError(t, DeleteTarget(ctx, cli, cfg, template, &pubsub.PubSubTopic{}))
+	assert.NoError(t, cli.Get(ctx, client.ObjectKeyFromObject(target), &pubsub.PubSubTopic{}))
+	assert.Empty(t, out.String())
+}
@@ -0,0 +1,285 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"context"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+	"sigs.k8s.io/yaml"
+	"strings"
+)
+
+// BackupKind pairs a template kind with the kind it renders.
+type BackupKind struct {
+	Template client.Object
+	Render   client.Object
+}
+
+// Export writes every template of kinds and the resource it rendered to dir as <namespace>/<kind>/<name>.yaml,
+// without status and the metadata set by the API server. Rendered resources keep the owner reference to their
+// template without its UID, Import restores it. It returns the number of written files.
+func Export(ctx context.Context, cli CliCli, kinds []BackupKind, dir string) (int, error) {
+	written := 0
+	for _, kind := range kinds {
+		list, err := newList(cli, kind.Template)
+		if err != nil {
+			return written, err
+		}
+		if err := cli.List(ctx, list); err != nil {
+			return written, fmt.Errorf("failed to list templates; %w", err)
+		}
+		items, err := meta.ExtractList(list)
+		if err != nil {
+			return written, err
+		}
+		for _, item := range items {
+			src := item.(client.Object)
+			if err := exportObject(cli, src, dir); err != nil {
+				return written, err
+			}
+			written++
+			ref := getStatusRef(src)
+			if ref.Name == "" {
+				continue
+			}
+			target := reflect.New(reflect.TypeOf(kind.Render).Elem()).Interface().(client.Object)
+			if err := cli.Get(ctx, client.ObjectKey{Namespace: src.GetNamespace(), Name: ref.Name}, target); err != nil {
+				if errors.IsNotFound(err) {
+					// the target lives in a remote cluster or was deleted meanwhile
+					continue
+				}
+				return written, fmt.Errorf("failed to get rendered resource of %s; %w", src.GetName(), err)
+			}
+			if !metav1.IsControlledBy(target, src) {
+				continue
+			}
+			if err := exportObject(cli, target, dir); err != nil {
+				return written, err
+			}
+			written++
+		}
+	}
+	return written, nil
+}
+
+// Import creates the templates and rendered resources written by Export. Templates are imported first,
+// rendered resources are then created owned by them, or adopted when they already exist without an owner.
+// Missing namespaces are created, existing templates are left alone. It returns the number of imported objects.
+func Import(ctx context.Context, cli CliCli, kinds []BackupKind, dir string) (int, error) {
+	var templates, targets []client.Object
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || filepath.Ext(path) != ".yaml" {
+			return err
+		}
+		obj, err := readBackup(cli, path)
+		if err != nil {
+			return err
+		}
+		if isBackupKind(cli, kinds, obj, true) {
+			templates = append(templates, obj)
+		} else if isBackupKind(cli, kinds, obj, false) {
+			targets = append(targets, obj)
+		} else {
+			return fmt.Errorf("%s holds neither a template nor a rendered resource", path)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to read backup; %w", err)
+	}
+
+	imported := 0
+	for _, src := range templates {
+		if err := ensureNamespace(ctx, cli, src.GetNamespace()); err != nil {
+			return imported, err
+		}
+		if err := cli.Create(ctx, src); err != nil {
+			if errors.IsAlreadyExists(err) {
+				continue
+			}
+			return imported, fmt.Errorf("failed to create %s/%s; %w", src.GetNamespace(), src.GetName(), err)
+		}
+		imported++
+	}
+	for _, target := range targets {
+		ok, err := importTarget(ctx, cli, kinds, target)
+		if err != nil {
+			return imported, err
+		}
+		if ok {
+			imported++
+		}
+	}
+	return imported, nil
+}
+
+// importTarget creates target owned by the template named in its owner reference or adopts the existing one.
+func importTarget(ctx context.Context, cli CliCli, kinds []BackupKind, target client.Object) (bool, error) {
+	owner := metav1.GetControllerOf(target)
+	if owner == nil {
+		return false, fmt.Errorf("%s/%s has no owner template", target.GetNamespace(), target.GetName())
+	}
+	var src client.Object
+	for _, k := range kinds {
+		gvk, err := apiutil.GVKForObject(k.Template, cli.GetScheme())
+		if err == nil && gvk.Kind == owner.Kind && gvk.GroupVersion().String() == owner.APIVersion {
+			src = reflect.New(reflect.TypeOf(k.Template).Elem()).Interface().(client.Object)
+		}
+	}
+	if src == nil {
+		return false, fmt.Errorf("%s/%s is owned by unknown kind %s", target.GetNamespace(), target.GetName(), owner.Kind)
+	}
+	if err := cli.Get(ctx, client.ObjectKey{Namespace: target.GetNamespace(), Name: owner.Name}, src); err != nil {
+		return false, fmt.Errorf("failed to get owner of %s/%s; %w", target.GetNamespace(), target.GetName(), err)
+	}
+	ref := *owner
+	ref.UID = src.GetUID()
+
+	existing := reflect.New(reflect.TypeOf(target).Elem()).Interface().(client.Object)
+	if err := cli.Get(ctx, client.ObjectKeyFromObject(target), existing); err != nil {
+		if !errors.IsNotFound(err) {
+			return false, fmt.Errorf("failed to get %s/%s; %w", target.GetNamespace(), target.GetName(), err)
+		}
+		target.SetOwnerReferences(replaceOwner(target.GetOwnerReferences(), ref))
+		if err := cli.Create(ctx, target); err != nil {
+			return false, fmt.Errorf("failed to create %s/%s; %w", target.GetNamespace(), target.GetName(), err)
+		}
+		return true, nil
+	}
+	if metav1.IsControlledBy(existing, src) {
+		return false, nil
+	}
+	if other := metav1.GetControllerOf(existing); other != nil {
+		return false, fmt.Errorf("%s/%s is already controlled by %s %s", target.GetNamespace(), target.GetName(), other.Kind, other.Name)
+	}
+	// the live spec is kept, the controller reconciles it with the template
+	existing.SetOwnerReferences(replaceOwner(existing.GetOwnerReferences(), ref))
+	if err := cli.Update(ctx, existing); err != nil {
+		return false, fmt.Errorf("failed to adopt %s/%s; %w", target.GetNamespace(), target.GetName(), err)
+	}
+	return true, nil
+}
+
+func exportObject(cli CliCli, obj client.Object, dir string) error {
+	gvk, err := apiutil.GVKForObject(obj, cli.GetScheme())
+	if err != nil {
+		return err
+	}
+	u, err := cleanObject(obj, gvk)
+	if err != nil {
+		return err
+	}
+	metadata, _ := u["metadata"].(map[string]interface{})
+	// finalizers and owner UIDs belong to the source cluster
+	delete(metadata, "finalizers")
+	if refs, ok := metadata["ownerReferences"].([]interface{}); ok {
+		for _, ref := range refs {
+			delete(ref.(map[string]interface{}), "uid")
+		}
+	}
+	data, err := yaml.Marshal(u)
+	if err != nil {
+		return fmt.Errorf("failed to marshal %s; %w", obj.GetName(), err)
+	}
+	file := filepath.Join(dir, obj.GetNamespace(), strings.ToLower(gvk.Kind), obj.GetName()+".yaml")
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(file, data, 0644)
+}
+
+func readBackup(cli CliCli, path string) (client.Object, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	u := &unstructured.Unstructured{}
+	if err := yaml.Unmarshal(data, &u.Object); err != nil {
+		return nil, fmt.Errorf("failed to parse %s; %w", path, err)
+	}
+	obj, err := cli.GetScheme().New(u.GroupVersionKind())
+	if err != nil {
+		return nil, fmt.Errorf("unsupported kind in %s; %w", path, err)
+	}
+	if err := yaml.Unmarshal(data, obj); err != nil {
+		return nil, fmt.Errorf("failed to decode %s; %w", path, err)
+	}
+	return obj.(client.Object), nil
+}
+
+// isBackupKind reports whether obj is one of the template kinds, or the rendered kinds when template is false.
+func isBackupKind(cli CliCli, kinds []BackupKind, obj client.Object, template bool) bool {
+	gvk, err := apiutil.GVKForObject(obj, cli.GetScheme())
+	if err != nil {
+		return false
+	}
+	for _, k := range kinds {
+		typ := k.Render
+		if template {
+			typ = k.Template
+		}
+		if kgvk, err := apiutil.GVKForObject(typ, cli.GetScheme()); err == nil && kgvk == gvk {
+			return true
+		}
+	}
+	return false
+}
+
+func ensureNamespace(ctx context.Context, cli CliCli, name string) error {
+	ns := &corev1.Namespace{}
+	if err := cli.Get(ctx, client.ObjectKey{Name: name}, ns); err == nil || !errors.IsNotFound(err) {
+		return err
+	}
+	ns.SetName(name)
+	if err := cli.Create(ctx, ns); err != nil && !errors.IsAlreadyExists(err) {
+		return fmt.Errorf("failed to create namespace %s; %w", name, err)
+	}
+	return nil
+}
+
+func replaceOwner(refs []metav1.OwnerReference, owner metav1.OwnerReference) []metav1.OwnerReference {
+	out := []metav1.OwnerReference{owner}
+	for _, ref := range refs {
+		if ref.Kind != owner.Kind || ref.Name != owner.Name {
+			out = append(out, ref)
+		}
+	}
+	return out
+}
+
+func newList(cli CliCli, obj client.Object) (client.ObjectList, error) {
+	gvk, err := apiutil.GVKForObject(obj, cli.GetScheme())
+	if err != nil {
+		return nil, err
+	}
+	list, err := cli.GetScheme().New(schema.GroupVersionKind{Group: gvk.Group, Version: gvk.Version, Kind: gvk.Kind + "List"})
+	if err != nil {
+		return nil, err
+	}
+	return list.(client.ObjectList), nil
+}
@@ -0,0 +1,89 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"context"
+	pubsub "github.com/GoogleCloudPlatform/k8s-config-connector/pkg/apis/pubsub/v1beta1"
+	api "github.com/slamdev/config-connector-templater/api/v1alpha1"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"os"
+	"path/filepath"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"testing"
+)
+
+func TestExportImport(t *testing.T) {
+	ctx := context.Background()
+	kinds := []BackupKind{
+		{Template: &api.PubSubTopicTemplate{}, Render: &pubsub.PubSubTopic{}},
+		{Template: &api.PubSubSubscriptionTemplate{}, Render: &pubsub.PubSubSubscription{}},
+	}
+	resourceID := "orders-{{ .metadata.namespace }}"
+	template := &api.PubSubTopicTemplate{ObjectMeta: metav1.ObjectMeta{Name: "orders", Namespace: "team1", UID: "uid",
+		Finalizers: []string{RemoteTargetFinalizer}}}
+	template.Spec.ResourceID = &resourceID
+	template.Status.Ref.Name = "orders"
+	topicID := "orders-team1"
+	topic := &pubsub.PubSubTopic{ObjectMeta: metav1.ObjectMeta{Name: "orders", Namespace: "team1", UID: "topic-uid"}}
+	topic.Spec.ResourceID = &topicID
+	src := newFakeCli(template, topic)
+	assert.NoError(t, ctrl.SetControllerReference(template, topic, src.Scheme()))
+	assert.NoError(t, src.Update(ctx, topic))
+	pending := &api.PubSubTopicTemplate{ObjectMeta: metav1.ObjectMeta{Name: "pending", Namespace: "team2"}}
+	assert.NoError(t, src.Create(ctx, pending))
+
+	dir := t.TempDir()
+	written, err := Export(ctx, src, kinds, dir)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, written)
+	data, err := os.ReadFile(filepath.Join(dir, "team1", "pubsubtopictemplate", "orders.yaml"))
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), "kind: PubSubTopicTemplate")
+	assert.NotContains(t, string(data), "uid")
+	assert.NotContains(t, string(data), "resourceVersion")
+	assert.FileExists(t, filepath.Join(dir, "team1", "pubsubtopic", "orders.yaml"))
+	assert.FileExists(t, filepath.Join(dir, "team2", "pubsubtopictemplate", "pending.yaml"))
+
+	// the topic of the pending template already exists in the destination and is adopted
+	pendingID := "pending"
+	existing := &pubsub.PubSubTopic{ObjectMeta: metav1.ObjectMeta{Name: "orders", Namespace: "team1"}}
+	existing.Spec.ResourceID = &pendingID
+	dst := newFakeCli(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team1"}}, existing)
+	imported, err := Import(ctx, dst, kinds, dir)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, imported)
+
+	restored := &api.PubSubTopicTemplate{}
+	assert.NoError(t, dst.Get(ctx, client.ObjectKey{Namespace: "team1", Name: "orders"}, restored))
+	assert.Equal(t, template.Spec, restored.Spec)
+	assert.Empty(t, restored.Finalizers)
+	assert.NoError(t, dst.Get(ctx, client.ObjectKey{Name: "team2"}, &corev1.Namespace{}))
+
+	adopted := &pubsub.PubSubTopic{}
+	assert.NoError(t, dst.Get(ctx, client.ObjectKey{Namespace: "team1", Name: "orders"}, adopted))
+	assert.True(t, metav1.IsControlledBy(adopted, restored))
+	assert.Equal(t, "pending", *adopted.Spec.ResourceID)
+
+	// importing again changes nothing
+	imported, err = Import(ctx, dst, kinds, dir)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, imported)
+}
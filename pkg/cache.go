@@ -0,0 +1,187 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"k8s.io/apimachinery/pkg/types"
+	"sync"
+	"text/template"
+)
+
+// maxParsedPerTemplate bounds the parsed sources kept for one template generation;
+// annotations (and so whole-document templates) can change without a new generation.
+const maxParsedPerTemplate = 256
+
+// Cache keeps parsed templates per template UID and generation, and the inputs hash of
+// the last render applied to each target, so reconciles that change nothing can skip rendering.
+// It is safe for concurrent use and shared by all controllers.
+type Cache struct {
+	parsed  *lru
+	applied *lru
+}
+
+// NewCache creates a cache holding at most size templates and size targets.
+func NewCache(size int) *Cache {
+	return &Cache{parsed: newLRU(size), applied: newLRU(size)}
+}
+
+type parsedTemplates struct {
+	mu        sync.Mutex
+	templates map[string]*template.Template
+}
+
+func (p *parsedTemplates) get(src string) (*template.Template, bool) {
+	if p == nil {
+		return nil, false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	t, ok := p.templates[src]
+	return t, ok
+}
+
+func (p *parsedTemplates) put(src string, t *template.Template) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.templates) >= maxParsedPerTemplate {
+		p.templates = make(map[string]*template.Template)
+	}
+	p.templates[src] = t
+}
+
+// parsedTemplates returns the parsed sources of a template generation rendered with the given options.
+func (c *Cache) parsedTemplates(uid types.UID, generation int64, optsKey string) *parsedTemplates {
+	if c == nil {
+		return nil
+	}
+	key := fmt.Sprintf("%s/%d/%s", uid, generation, optsKey)
+	return c.parsed.getOrAdd(key, func() interface{} {
+		return &parsedTemplates{templates: make(map[string]*template.Template)}
+	}).(*parsedTemplates)
+}
+
+type appliedRender struct {
+	generation int64
+	hash       string
+}
+
+// markApplied records that the target at its current generation is the render of the given inputs.
+func (c *Cache) markApplied(uid types.UID, generation int64, hash string) {
+	if c == nil {
+		return
+	}
+	c.applied.put(string(uid), appliedRender{generation: generation, hash: hash})
+}
+
+// isApplied reports whether the target was not changed since it was rendered from the given inputs.
+func (c *Cache) isApplied(uid types.UID, generation int64, hash string) bool {
+	if c == nil {
+		return false
+	}
+	v, ok := c.applied.get(string(uid))
+	return ok && v.(appliedRender) == appliedRender{generation: generation, hash: hash}
+}
+
+// inputsHash identifies everything a render depends on.
+func inputsHash(params map[string]interface{}, opts RenderOptions) (string, error) {
+	jsonStr, err := json.Marshal(struct {
+		Params    map[string]interface{}
+		Engine    string
+		Functions []string
+		Limits    Limits
+	}{params, opts.Engine, opts.Functions, opts.Limits})
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal render inputs; %w", err)
+	}
+	sum := sha256.Sum256(jsonStr)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+type lru struct {
+	mu    sync.Mutex
+	size  int
+	order *list.List
+	items map[string]*list.Element
+}
+
+type lruItem struct {
+	key   string
+	value interface{}
+}
+
+func newLRU(size int) *lru {
+	return &lru{size: size, order: list.New(), items: make(map[string]*list.Element)}
+}
+
+func (l *lru) get(key string) (interface{}, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if e, ok := l.items[key]; ok {
+		l.order.MoveToFront(e)
+		return e.Value.(*lruItem).value, true
+	}
+	return nil, false
+}
+
+func (l *lru) getOrAdd(key string, create func() interface{}) interface{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if e, ok := l.items[key]; ok {
+		l.order.MoveToFront(e)
+		return e.Value.(*lruItem).value
+	}
+	value := create()
+	l.add(key, value)
+	return value
+}
+
+func (l *lru) put(key string, value interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if e, ok := l.items[key]; ok {
+		l.order.MoveToFront(e)
+		e.Value.(*lruItem).value = value
+		return
+	}
+	l.add(key, value)
+}
+
+func (l *lru) remove(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if e, ok := l.items[key]; ok {
+		l.order.Remove(e)
+		delete(l.items, key)
+	}
+}
+
+func (l *lru) add(key string, value interface{}) {
+	l.items[key] = l.order.PushFront(&lruItem{key: key, value: value})
+	for l.size > 0 && l.order.Len() > l.size {
+		oldest := l.order.Back()
+		l.order.Remove(oldest)
+		delete(l.items, oldest.Value.(*lruItem).key)
+	}
+}
@@ -0,0 +1,71 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	api "github.com/slamdev/config-connector-templater/api/v1alpha1"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"testing"
+)
+
+func TestInputsHash(t *testing.T) {
+	template := api.PubSubTopicTemplate{
+		ObjectMeta: metav1.ObjectMeta{Name: "topic", Namespace: "ns", ResourceVersion: "1"},
+	}
+	hash := func() string {
+		params, err := templateParams(template)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h, err := inputsHash(params, RenderOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+
+	initial := hash()
+
+	template.ResourceVersion = "2"
+	template.Status.Ref.Name = "topic"
+	assert.Equal(t, initial, hash())
+
+	template.Labels = map[string]string{"team": "a"}
+	assert.NotEqual(t, initial, hash())
+}
+
+func TestCache(t *testing.T) {
+	cache := NewCache(2)
+
+	cache.markApplied("a", 1, "h1")
+	assert.True(t, cache.isApplied("a", 1, "h1"))
+	assert.False(t, cache.isApplied("a", 2, "h1"))
+	assert.False(t, cache.isApplied("a", 1, "h2"))
+
+	cache.markApplied("b", 1, "h1")
+	cache.markApplied("c", 1, "h1")
+	assert.False(t, cache.isApplied("a", 1, "h1"))
+
+	parsed := cache.parsedTemplates("uid", 1, "opts")
+	assert.Same(t, parsed, cache.parsedTemplates("uid", 1, "opts"))
+	assert.NotSame(t, parsed, cache.parsedTemplates("uid", 2, "opts"))
+
+	var nilCache *Cache
+	assert.False(t, nilCache.isApplied("a", 1, "h1"))
+	assert.Nil(t, nilCache.parsedTemplates("uid", 1, "opts"))
+}
@@ -0,0 +1,36 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// HasClass reports whether src belongs to the templater installation of the given class.
+func HasClass(src client.Object, class string) bool {
+	v, _ := getAnnotation(src, ClassAnnotation)
+	return v == class
+}
+
+// ClassLeaderElectionID derives a separate leader election per class, so installations of
+// different classes do not block each other.
+func ClassLeaderElectionID(class string, id string) string {
+	if class == "" {
+		return id
+	}
+	return class + "-" + id
+}
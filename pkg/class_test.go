@@ -0,0 +1,44 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	api "github.com/slamdev/config-connector-templater/api/v1alpha1"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestHasClass(t *testing.T) {
+	template := &api.PubSubTopicTemplate{}
+	assert.True(t, HasClass(template, ""))
+	assert.False(t, HasClass(template, "platform"))
+
+	template.Annotations = map[string]string{ClassAnnotation: "platform"}
+	assert.True(t, HasClass(template, "platform"))
+	assert.False(t, HasClass(template, ""))
+
+	assert.Equal(t, "platform-e9aa28d2.slamdev.net", ClassLeaderElectionID("platform", "e9aa28d2.slamdev.net"))
+}
+
+func TestConfigIsExcluded(t *testing.T) {
+	assert.True(t, Config{}.isExcluded("kustomize.toolkit.fluxcd.io/checksum"))
+	assert.False(t, Config{}.isExcluded("team"))
+
+	cfg := Config{ExcludedKeys: []string{"team"}}
+	assert.True(t, cfg.isExcluded("team"))
+	assert.False(t, cfg.isExcluded("kustomize.toolkit.fluxcd.io/checksum"))
+}
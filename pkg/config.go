@@ -0,0 +1,66 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import "strings"
+
+// Config holds the administrator settings shared by all template controllers.
+type Config struct {
+	// AllowedFunctions lists the functions go templates may call.
+	// Nil means every sprig function except the ones exposing the controller host.
+	AllowedFunctions []string
+	// Limits caps the resources a single render may use.
+	Limits Limits
+	// Paused suspends creating and updating rendered resources in the whole cluster.
+	Paused bool
+	// Class is the templater class handled by this installation, templates of other classes are ignored.
+	// Empty means templates without a class.
+	Class string
+	// ExcludedKeys lists the substrings of annotation and label keys that are not copied from templates
+	// to rendered resources. Nil means DefaultExcludedKeys.
+	ExcludedKeys []string
+	// Audit receives a record of every change to rendered resources, nil disables auditing.
+	Audit *AuditLog
+	// RevisionHistoryLimit is the number of rendered specs kept per template, 0 disables the history.
+	RevisionHistoryLimit int
+	// Cache is shared by all controllers, nil disables caching.
+	Cache *Cache
+	// Remotes caches the clients of remote clusters, nil connects on every reconcile.
+	Remotes *Remotes
+	// GitOps receives the rendered resources instead of the cluster, nil applies them to the cluster.
+	GitOps *GitStore
+	// Quotas reads the quotas and the rendered resources they count, nil reads from the cache.
+	Quotas *Quotas
+}
+
+// DefaultExcludedKeys keeps the bookkeeping of flux and kubectl apply on the templates.
+func DefaultExcludedKeys() []string {
+	return []string{"fluxcd.io", "last-applied-configuration"}
+}
+
+func (c Config) isExcluded(key string) bool {
+	excluded := c.ExcludedKeys
+	if excluded == nil {
+		excluded = DefaultExcludedKeys()
+	}
+	for _, e := range excluded {
+		if strings.Contains(key, e) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,231 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"context"
+	"fmt"
+	api "github.com/slamdev/config-connector-templater/api/v1alpha1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"reflect"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"strings"
+)
+
+const (
+	// AdoptedCondition reports whether an existing resource without an owner was adopted by the template.
+	AdoptedCondition = "Adopted"
+
+	AdoptionDisabledReason      = "AdoptionDisabled"
+	SpecMismatchReason          = "SpecMismatch"
+	AdoptedReason               = "Adopted"
+	ForceAdoptedReason          = "ForceAdopted"
+	InvalidAdoptionPolicyReason = "InvalidAdoptionPolicy"
+
+	// ConflictCondition is True while another template owns the resource this template renders into.
+	ConflictCondition = "Conflict"
+
+	TargetOwnedByOtherReason = "TargetOwnedByOtherTemplate"
+	TargetOwnedReason        = "TargetOwned"
+)
+
+// TargetName renders the name of the resource src renders into.
+func TargetName(ctx context.Context, cli CliCli, cfg Config, src client.Object) (string, error) {
+	tpl, ok := getAnnotation(src, TargetNameAnnotation)
+	if !ok || tpl == "" {
+		return src.GetName(), nil
+	}
+	opts, err := renderOptions(ctx, cli, cfg, src)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve render options; %w", err)
+	}
+	name, err := renderTargetName(src, opts)
+	if err != nil {
+		return "", failRender(ctx, cli, src, err)
+	}
+	return name, nil
+}
+
+func renderTargetName(src client.Object, opts RenderOptions) (string, error) {
+	tpl, ok := getAnnotation(src, TargetNameAnnotation)
+	if !ok || tpl == "" {
+		return src.GetName(), nil
+	}
+	name, err := RenderString(tpl, src, opts)
+	if err != nil {
+		return "", fmt.Errorf("failed to render target name; %w", err)
+	}
+	// the name is not checked by an API server in GitOps mode, where it also becomes a file path
+	if errs := validation.IsDNS1123Subdomain(name); len(errs) > 0 {
+		return "", fmt.Errorf("invalid target name %q; %s", name, strings.Join(errs, ", "))
+	}
+	return name, nil
+}
+
+// ResolveConflict decides whether src may manage the existing target. Resources without an
+// owner are adopted according to the adoption policy of src. When several templates render
+// into the same resource the oldest one wins (by creation time, then name and uid), so the
+// winner does not depend on the order of reconciles and survives controller restarts.
+// A losing template gets a Conflict condition naming the current owner. Resources controlled
+// by anything but a template are never taken over.
+func ResolveConflict(ctx context.Context, cli CliCli, cfg Config, src client.Object, target client.Object) (bool, error) {
+	owner := metav1.GetControllerOf(target)
+	if owner == nil {
+		return adopt(ctx, cli, cfg, src, target)
+	}
+	if owner.UID == src.GetUID() {
+		return true, nil
+	}
+
+	if isTemplaterOwner(*owner) {
+		current := &unstructured.Unstructured{}
+		current.SetAPIVersion(owner.APIVersion)
+		current.SetKind(owner.Kind)
+		err := cli.Get(ctx, client.ObjectKey{Namespace: target.GetNamespace(), Name: owner.Name}, current)
+		if err != nil && !errors.IsNotFound(err) {
+			return false, fmt.Errorf("failed to get owner of dest resource; %w", err)
+		}
+		if errors.IsNotFound(err) || current.GetUID() != owner.UID || isOlder(src, current) {
+			// the owner is gone or younger, src takes the target over
+			return true, nil
+		}
+	}
+
+	msg := fmt.Sprintf("%s %s/%s is owned by %s %s", kindOf(cli, target), target.GetNamespace(), target.GetName(), owner.Kind, owner.Name)
+	if err := updateCondition(ctx, cli, src, metav1.Condition{
+		Type:    ConflictCondition,
+		Status:  metav1.ConditionTrue,
+		Reason:  TargetOwnedByOtherReason,
+		Message: msg,
+	}); err != nil {
+		return false, fmt.Errorf("failed to report conflict; %w", err)
+	}
+	return false, nil
+}
+
+// adopt decides whether src may take over an existing resource that has no owner.
+func adopt(ctx context.Context, cli CliCli, cfg Config, src client.Object, target client.Object) (bool, error) {
+	policy, _ := getAnnotation(src, AdoptionPolicyAnnotation)
+	if policy == "" {
+		policy = AdoptNever
+	}
+	kind := kindOf(cli, target)
+
+	var diffs []FieldDiff
+	if policy == AdoptIfUnowned || policy == AdoptForce {
+		opts, hash, err := renderInputs(ctx, cli, cfg, src)
+		if err != nil {
+			return false, err
+		}
+		rendered := reflect.New(reflect.TypeOf(target).Elem()).Interface().(client.Object)
+		if err := createTemplatedResource(ctx, cli, cfg, src, rendered, opts, hash); err != nil {
+			return false, err
+		}
+		if diffs, err = diffSpecs(getSpec(target), getSpec(rendered)); err != nil {
+			return false, fmt.Errorf("failed to compare specs; %w", err)
+		}
+	}
+
+	cond := metav1.Condition{Type: AdoptedCondition, Status: metav1.ConditionFalse}
+	switch policy {
+	case AdoptNever:
+		cond.Reason = AdoptionDisabledReason
+		cond.Message = fmt.Sprintf("%s %s/%s already exists and is not owned by a template; set the %s annotation to %s or %s to adopt it",
+			kind, target.GetNamespace(), target.GetName(), AdoptionPolicyAnnotation, AdoptIfUnowned, AdoptForce)
+	case AdoptIfUnowned:
+		// fields the render leaves out are defaulted by Config Connector, e.g. spec.resourceID, they can not differ
+		diffs = renderedDiffs(diffs)
+		if len(diffs) > 0 {
+			cond.Reason = SpecMismatchReason
+			cond.Message = fmt.Sprintf("%s %s/%s differs from the rendered spec at %s",
+				kind, target.GetNamespace(), target.GetName(), strings.Join(diffPaths(diffs), ", "))
+		} else {
+			cond.Status = metav1.ConditionTrue
+			cond.Reason = AdoptedReason
+		}
+	case AdoptForce:
+		cond.Status = metav1.ConditionTrue
+		cond.Reason = ForceAdoptedReason
+		if len(diffs) > 0 {
+			cond.Message = fmt.Sprintf("overwritten fields: %s", strings.Join(diffPaths(diffs), ", "))
+		}
+	default:
+		cond.Reason = InvalidAdoptionPolicyReason
+		cond.Message = fmt.Sprintf("unknown adoption policy %q, expected %s, %s or %s", policy, AdoptNever, AdoptIfUnowned, AdoptForce)
+	}
+
+	if err := updateCondition(ctx, cli, src, cond); err != nil {
+		return false, fmt.Errorf("failed to report adoption; %w", err)
+	}
+	return cond.Status == metav1.ConditionTrue, nil
+}
+
+// clearConflict resolves a previously reported conflict in memory and reports whether anything changed.
+func clearConflict(src client.Object) bool {
+	if meta.FindStatusCondition(*getConditions(src), ConflictCondition) == nil {
+		return false
+	}
+	return setCondition(src, metav1.Condition{
+		Type:   ConflictCondition,
+		Status: metav1.ConditionFalse,
+		Reason: TargetOwnedReason,
+	})
+}
+
+// setController makes src the only controller of target.
+func setController(cli CliCli, src client.Object, target client.Object) error {
+	refs := target.GetOwnerReferences()
+	kept := refs[:0]
+	for _, ref := range refs {
+		if ref.Controller == nil || !*ref.Controller || ref.UID == src.GetUID() {
+			kept = append(kept, ref)
+		}
+	}
+	target.SetOwnerReferences(kept)
+	return ctrl.SetControllerReference(src, target, cli.GetScheme())
+}
+
+func isOlder(a client.Object, b client.Object) bool {
+	at, bt := a.GetCreationTimestamp(), b.GetCreationTimestamp()
+	if !at.Equal(&bt) {
+		return at.Before(&bt)
+	}
+	if a.GetName() != b.GetName() {
+		return a.GetName() < b.GetName()
+	}
+	return a.GetUID() < b.GetUID()
+}
+
+// isTemplaterOwner reports whether owner is a template.
+func isTemplaterOwner(owner metav1.OwnerReference) bool {
+	gv, err := schema.ParseGroupVersion(owner.APIVersion)
+	return err == nil && gv.Group == api.GroupVersion.Group
+}
+
+func kindOf(cli CliCli, obj client.Object) string {
+	gvks, _, err := cli.GetScheme().ObjectKinds(obj)
+	if err != nil || len(gvks) == 0 {
+		return obj.GetObjectKind().GroupVersionKind().Kind
+	}
+	return gvks[0].Kind
+}
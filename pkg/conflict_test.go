@@ -0,0 +1,91 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"context"
+	k8s "github.com/GoogleCloudPlatform/k8s-config-connector/pkg/apis/k8s/v1alpha1"
+	pubsub "github.com/GoogleCloudPlatform/k8s-config-connector/pkg/apis/pubsub/v1beta1"
+	api "github.com/slamdev/config-connector-templater/api/v1alpha1"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"testing"
+	"time"
+)
+
+func TestIsOlder(t *testing.T) {
+	now := metav1.NewTime(time.Now())
+	later := metav1.NewTime(now.Add(time.Second))
+
+	a := &api.PubSubTopicTemplate{ObjectMeta: metav1.ObjectMeta{Name: "b", CreationTimestamp: now}}
+	b := &api.PubSubTopicTemplate{ObjectMeta: metav1.ObjectMeta{Name: "a", CreationTimestamp: later}}
+	assert.True(t, isOlder(a, b))
+	assert.False(t, isOlder(b, a))
+
+	b.CreationTimestamp = now
+	assert.True(t, isOlder(b, a))
+	assert.False(t, isOlder(a, b))
+}
+
+func TestRenderTargetName(t *testing.T) {
+	template := &api.PubSubTopicTemplate{ObjectMeta: metav1.ObjectMeta{Name: "topic", Namespace: "team1"}}
+
+	name, err := renderTargetName(template, RenderOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, "topic", name)
+
+	template.Annotations = map[string]string{TargetNameAnnotation: "{{ .metadata.namespace }}-{{ .metadata.name }}"}
+	name, err = renderTargetName(template, RenderOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, "team1-topic", name)
+
+	template.Annotations[TargetNameAnnotation] = "../../other/pubsubtopic/{{ .metadata.name }}"
+	_, err = renderTargetName(template, RenderOptions{})
+	assert.Error(t, err)
+}
+
+func TestAdoptIfUnowned(t *testing.T) {
+	ctx := context.Background()
+	template := &api.PubSubTopicTemplate{ObjectMeta: metav1.ObjectMeta{Name: "orders", Namespace: "team1", UID: "orders",
+		Annotations: map[string]string{AdoptionPolicyAnnotation: AdoptIfUnowned}}}
+	template.Spec.KmsKeyRef = &k8s.ResourceRef{Name: "key"}
+	// a hand-written manifest, Config Connector defaulted the resourceID the template leaves out
+	resourceID := "orders"
+	existing := &pubsub.PubSubTopic{ObjectMeta: metav1.ObjectMeta{Name: "orders", Namespace: "team1"}}
+	existing.Spec.KmsKeyRef = &k8s.ResourceRef{Name: "key"}
+	existing.Spec.ResourceID = &resourceID
+	cli := newFakeCli(template, existing, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team1"}})
+
+	owned, err := ResolveConflict(ctx, cli, Config{}, template, existing)
+	assert.NoError(t, err)
+	assert.True(t, owned)
+	assert.NoError(t, cli.Get(ctx, client.ObjectKeyFromObject(template), template))
+	cond := meta.FindStatusCondition(template.Status.Conditions, AdoptedCondition)
+	assert.Equal(t, AdoptedReason, cond.Reason)
+
+	existing.Spec.KmsKeyRef = &k8s.ResourceRef{Name: "other"}
+	owned, err = ResolveConflict(ctx, cli, Config{}, template, existing)
+	assert.NoError(t, err)
+	assert.False(t, owned)
+	assert.NoError(t, cli.Get(ctx, client.ObjectKeyFromObject(template), template))
+	cond = meta.FindStatusCondition(template.Status.Conditions, AdoptedCondition)
+	assert.Equal(t, SpecMismatchReason, cond.Reason)
+	assert.Equal(t, "PubSubTopic team1/orders differs from the rendered spec at $.kmsKeyRef.name", cond.Message)
+}
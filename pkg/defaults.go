@@ -0,0 +1,120 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	api "github.com/slamdev/config-connector-templater/api/v1alpha1"
+	"reflect"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sort"
+	"strings"
+)
+
+// templateDefaults merges the ClusterTemplateDefaults and the TemplateDefaults in the namespace of src
+// that apply to the target kind of src. Each layer is sorted by name, later layers and names win.
+func templateDefaults(ctx context.Context, cli CliCli, src client.Object) (map[string]interface{}, error) {
+	kind := targetKind(cli, src)
+	clusterList := &api.ClusterTemplateDefaultsList{}
+	if err := cli.List(ctx, clusterList); err != nil {
+		return nil, fmt.Errorf("failed to list cluster template defaults; %w", err)
+	}
+	sort.Slice(clusterList.Items, func(i, j int) bool { return clusterList.Items[i].Name < clusterList.Items[j].Name })
+	nsList := &api.TemplateDefaultsList{}
+	if err := cli.List(ctx, nsList, client.InNamespace(src.GetNamespace())); err != nil {
+		return nil, fmt.Errorf("failed to list template defaults; %w", err)
+	}
+	sort.Slice(nsList.Items, func(i, j int) bool { return nsList.Items[i].Name < nsList.Items[j].Name })
+
+	var layers []api.TemplateDefaultsSpec
+	for _, d := range clusterList.Items {
+		layers = append(layers, d.Spec)
+	}
+	for _, d := range nsList.Items {
+		layers = append(layers, d.Spec)
+	}
+	var out map[string]interface{}
+	for _, layer := range layers {
+		for _, d := range layer.Defaults {
+			if d.Kind != kind || len(d.Spec.Raw) == 0 {
+				continue
+			}
+			var spec map[string]interface{}
+			if err := json.Unmarshal(d.Spec.Raw, &spec); err != nil {
+				return nil, fmt.Errorf("failed to parse defaults of %s; %w", kind, err)
+			}
+			out = mergeDefaults(spec, out)
+		}
+	}
+	return out, nil
+}
+
+// applyDefaults renders the defaults like the template spec and merges them under the spec rendered from a
+// template document. A document is only YAML once rendered, so unlike structured specs it can not be merged first.
+func applyDefaults(spec interface{}, defaults map[string]interface{}, src client.Object, opts RenderOptions) (interface{}, error) {
+	if len(defaults) == 0 {
+		return spec, nil
+	}
+	opts.defaults = nil
+	rendered, err := Render(defaults, src, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to render defaults; %w", err)
+	}
+	tree, err := structToTree(spec)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse rendered spec; %w", err)
+	}
+	specMap, _ := tree.(map[string]interface{})
+	jsonStr, err := json.Marshal(mergeDefaults(specMap, rendered.(map[string]interface{})))
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal defaulted spec; %w", err)
+	}
+	structType := reflect.TypeOf(spec)
+	outPtr := reflect.New(structType).Interface()
+	decoder := json.NewDecoder(bytes.NewReader(jsonStr))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(outPtr); err != nil {
+		return nil, fmt.Errorf("defaults do not match %s schema; %w", structType.Name(), err)
+	}
+	return reflect.ValueOf(outPtr).Elem().Interface(), nil
+}
+
+// mergeDefaults deep merges defaults under spec: maps are merged, any other value set in spec wins.
+func mergeDefaults(spec map[string]interface{}, defaults map[string]interface{}) map[string]interface{} {
+	out := make(map[string]interface{}, len(spec)+len(defaults))
+	for k, v := range defaults {
+		out[k] = v
+	}
+	for k, v := range spec {
+		specMap, ok := v.(map[string]interface{})
+		defaultsMap, dok := out[k].(map[string]interface{})
+		if ok && dok {
+			out[k] = mergeDefaults(specMap, defaultsMap)
+			continue
+		}
+		out[k] = v
+	}
+	return out
+}
+
+// targetKind is the kind rendered by src, templates are named after their target kind.
+func targetKind(cli CliCli, src client.Object) string {
+	return strings.TrimSuffix(kindOf(cli, src), "Template")
+}
@@ -0,0 +1,151 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"context"
+	pubsub "github.com/GoogleCloudPlatform/k8s-config-connector/pkg/apis/pubsub/v1beta1"
+	api "github.com/slamdev/config-connector-templater/api/v1alpha1"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"strconv"
+	"testing"
+)
+
+func TestTemplateDefaults(t *testing.T) {
+	ctx := context.Background()
+	cluster := &api.ClusterTemplateDefaults{ObjectMeta: metav1.ObjectMeta{Name: "platform"}}
+	cluster.Spec.Defaults = []api.KindDefaults{
+		{Kind: "PubSubSubscription", Spec: runtime.RawExtension{Raw: []byte(`{"ackDeadlineSeconds":10,"retryPolicy":{"minimumBackoff":"10s","maximumBackoff":"600s"}}`)}},
+		{Kind: "PubSubTopic", Spec: runtime.RawExtension{Raw: []byte(`{"resourceID":"ignored"}`)}},
+	}
+	team := &api.TemplateDefaults{ObjectMeta: metav1.ObjectMeta{Name: "team", Namespace: "prod"}}
+	team.Spec.Defaults = []api.KindDefaults{
+		{Kind: "PubSubSubscription", Spec: runtime.RawExtension{Raw: []byte(`{"ackDeadlineSeconds":20,"messageRetentionDuration":"{{ .metadata.name }}"}`)}},
+	}
+	other := &api.TemplateDefaults{ObjectMeta: metav1.ObjectMeta{Name: "other", Namespace: "dev"}}
+	other.Spec.Defaults = []api.KindDefaults{
+		{Kind: "PubSubSubscription", Spec: runtime.RawExtension{Raw: []byte(`{"ackDeadlineSeconds":30}`)}},
+	}
+	subscription := &api.PubSubSubscriptionTemplate{ObjectMeta: metav1.ObjectMeta{Name: "orders-worker", Namespace: "prod"}}
+	maximum := "60s"
+	subscription.Spec.RetryPolicy = &pubsub.SubscriptionRetryPolicy{MaximumBackoff: &maximum}
+	cli := newFakeCli(cluster, team, other, subscription, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "prod"}})
+
+	opts, hash, err := renderInputs(ctx, cli, Config{}, subscription)
+	assert.NoError(t, err)
+	target := &pubsub.PubSubSubscription{}
+	assert.NoError(t, createTemplatedResource(ctx, cli, Config{}, subscription, target, opts, hash))
+	assert.Equal(t, 20, *target.Spec.AckDeadlineSeconds)
+	assert.Equal(t, "orders-worker", *target.Spec.MessageRetentionDuration)
+	assert.Equal(t, "10s", *target.Spec.RetryPolicy.MinimumBackoff)
+	assert.Equal(t, "60s", *target.Spec.RetryPolicy.MaximumBackoff)
+
+	// changing the defaults changes the inputs of the template
+	team.Spec.Defaults[0].Spec.Raw = []byte(`{"ackDeadlineSeconds":40}`)
+	assert.NoError(t, cli.Update(ctx, team))
+	_, changed, err := renderInputs(ctx, cli, Config{}, subscription)
+	assert.NoError(t, err)
+	assert.NotEqual(t, hash, changed)
+
+	team.Spec.Defaults[0].Spec.Raw = []byte(`{"unknownField":true}`)
+	assert.NoError(t, cli.Update(ctx, team))
+	opts, hash, err = renderInputs(ctx, cli, Config{}, subscription)
+	assert.NoError(t, err)
+	err = createTemplatedResource(ctx, cli, Config{}, subscription, &pubsub.PubSubSubscription{}, opts, hash)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "rendered spec does not match")
+
+	// defaults are rendered as part of the spec, errors point to the merged field
+	team.Spec.Defaults[0].Spec.Raw = []byte(`{"filter":"{{ fail \"no filter\" }}"}`)
+	assert.NoError(t, cli.Update(ctx, team))
+	opts, hash, err = renderInputs(ctx, cli, Config{}, subscription)
+	assert.NoError(t, err)
+	err = createTemplatedResource(ctx, cli, Config{}, subscription, &pubsub.PubSubSubscription{}, opts, hash)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to render $.filter")
+	assert.NotContains(t, err.Error(), "failed to render defaults")
+}
+
+func TestTemplateDefaultsDocument(t *testing.T) {
+	ctx := context.Background()
+	team := &api.TemplateDefaults{ObjectMeta: metav1.ObjectMeta{Name: "team", Namespace: "prod"}}
+	team.Spec.Defaults = []api.KindDefaults{
+		{Kind: "PubSubSubscription", Spec: runtime.RawExtension{Raw: []byte(`{"ackDeadlineSeconds":20,"messageRetentionDuration":"{{ .metadata.name }}"}`)}},
+	}
+	subscription := &api.PubSubSubscriptionTemplate{ObjectMeta: metav1.ObjectMeta{Name: "orders-worker", Namespace: "prod"}}
+	subscription.Annotations = map[string]string{TemplateAnnotation: "ackDeadlineSeconds: {{ len .metadata.name }}"}
+	cli := newFakeCli(team, subscription, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "prod"}})
+
+	// documents are merged over the defaults once rendered
+	opts, hash, err := renderInputs(ctx, cli, Config{}, subscription)
+	assert.NoError(t, err)
+	target := &pubsub.PubSubSubscription{}
+	assert.NoError(t, createTemplatedResource(ctx, cli, Config{}, subscription, target, opts, hash))
+	assert.Equal(t, 13, *target.Spec.AckDeadlineSeconds)
+	assert.Equal(t, "orders-worker", *target.Spec.MessageRetentionDuration)
+}
+
+func TestMergeDefaults(t *testing.T) {
+	merged := mergeDefaults(
+		map[string]interface{}{"a": "spec", "nested": map[string]interface{}{"x": "spec"}, "list": []interface{}{"spec"}},
+		map[string]interface{}{"a": "default", "b": "default", "nested": map[string]interface{}{"x": "default", "y": "default"}, "list": []interface{}{"default"}},
+	)
+	assert.Equal(t, map[string]interface{}{
+		"a":      "spec",
+		"b":      "default",
+		"nested": map[string]interface{}{"x": "spec", "y": "default"},
+		"list":   []interface{}{"spec"},
+	}, merged)
+}
+
+func TestTemplateDefaultsSharded(t *testing.T) {
+	ctx := context.Background()
+	var objs []client.Object
+	for _, ns := range []string{"team1", "team2", "team3", "team4"} {
+		objs = append(objs, &api.PubSubSubscriptionTemplate{ObjectMeta: metav1.ObjectMeta{Name: "worker", Namespace: ns}})
+	}
+	// pinned to the other shard than the templates of its namespace
+	pinned := &api.PubSubSubscriptionTemplate{ObjectMeta: metav1.ObjectMeta{Name: "pinned", Namespace: "team1"}}
+	pinned.Labels = map[string]string{ShardLabel: strconv.Itoa(1 - ShardOf(objs[0], 2))}
+	cli := newFakeCli(append(objs, pinned)...)
+
+	// every replica enqueues the templates of its own shard, together they cover the namespace
+	team := &api.TemplateDefaults{ObjectMeta: metav1.ObjectMeta{Name: "team", Namespace: "team1"}}
+	var names []types.NamespacedName
+	for id := 0; id < 2; id++ {
+		shard, err := Sharding{Shards: 2, ID: id}.TemplatesIn(ctx, cli, &api.PubSubSubscriptionTemplate{}, team)
+		assert.NoError(t, err)
+		assert.Len(t, shard, 1)
+		names = append(names, shard...)
+	}
+	assert.ElementsMatch(t, []types.NamespacedName{{Namespace: "team1", Name: "worker"}, {Namespace: "team1", Name: "pinned"}}, names)
+
+	// cluster defaults reach the templates of every namespace
+	cluster := &api.ClusterTemplateDefaults{ObjectMeta: metav1.ObjectMeta{Name: "platform"}}
+	names = nil
+	for id := 0; id < 2; id++ {
+		shard, err := Sharding{Shards: 2, ID: id}.TemplatesIn(ctx, cli, &api.PubSubSubscriptionTemplate{}, cluster)
+		assert.NoError(t, err)
+		names = append(names, shard...)
+	}
+	assert.Len(t, names, len(objs)+1)
+}
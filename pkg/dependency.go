@@ -0,0 +1,134 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"context"
+	"fmt"
+	api "github.com/slamdev/config-connector-templater/api/v1alpha1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"strings"
+)
+
+const (
+	// ReadyCondition mirrors the Ready condition Config Connector reports on the rendered resource.
+	ReadyCondition = "Ready"
+
+	// WaitingCondition reports whether creating the target waits for dependencies to become Ready.
+	WaitingCondition = "Waiting"
+
+	DependencyNotReadyReason = "DependencyNotReady"
+	InvalidDependencyReason  = "InvalidDependency"
+	DependenciesReadyReason  = "DependenciesReady"
+)
+
+// WaitForDependencies reports whether the templates listed in the depends-on annotation of src are
+// not Ready yet and sets the Waiting condition accordingly.
+func WaitForDependencies(ctx context.Context, cli CliCli, src client.Object) (bool, error) {
+	v, ok := getAnnotation(src, DependsOnAnnotation)
+	if !ok {
+		return false, nil
+	}
+	var waiting []string
+	for _, dep := range ParseList(v) {
+		i := strings.Index(dep, "/")
+		if i <= 0 || i == len(dep)-1 {
+			return true, updateCondition(ctx, cli, src, metav1.Condition{
+				Type:    WaitingCondition,
+				Status:  metav1.ConditionTrue,
+				Reason:  InvalidDependencyReason,
+				Message: fmt.Sprintf("invalid dependency %q, expected Kind/name", dep),
+			})
+		}
+		ready, err := isTemplateReady(ctx, cli, dep[:i], src.GetNamespace(), dep[i+1:])
+		if err != nil {
+			return false, err
+		}
+		if !ready {
+			waiting = append(waiting, dep)
+		}
+	}
+	if len(waiting) == 0 {
+		return false, nil
+	}
+	err := updateCondition(ctx, cli, src, metav1.Condition{
+		Type:    WaitingCondition,
+		Status:  metav1.ConditionTrue,
+		Reason:  DependencyNotReadyReason,
+		Message: fmt.Sprintf("waiting for %s to become Ready", strings.Join(waiting, ", ")),
+	})
+	if err != nil {
+		return true, fmt.Errorf("failed to report waiting; %w", err)
+	}
+	return true, nil
+}
+
+func isTemplateReady(ctx context.Context, cli CliCli, kind string, namespace string, name string) (bool, error) {
+	dep := &unstructured.Unstructured{}
+	dep.SetGroupVersionKind(api.GroupVersion.WithKind(kind))
+	if err := cli.Get(ctx, client.ObjectKey{Namespace: namespace, Name: name}, dep); err != nil {
+		if errors.IsNotFound(err) || meta.IsNoMatchError(err) || runtime.IsNotRegisteredError(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to get dependency %s/%s; %w", kind, name, err)
+	}
+	conditions, _, err := unstructured.NestedSlice(dep.Object, "status", "conditions")
+	if err != nil {
+		return false, nil
+	}
+	for _, c := range conditions {
+		if c, ok := c.(map[string]interface{}); ok && c["type"] == ReadyCondition {
+			return c["status"] == string(metav1.ConditionTrue), nil
+		}
+	}
+	return false, nil
+}
+
+// clearWaiting resolves a previously reported wait in memory and reports whether anything changed.
+func clearWaiting(src client.Object) bool {
+	if meta.FindStatusCondition(*getConditions(src), WaitingCondition) == nil {
+		return false
+	}
+	return setCondition(src, metav1.Condition{
+		Type:   WaitingCondition,
+		Status: metav1.ConditionFalse,
+		Reason: DependenciesReadyReason,
+	})
+}
+
+// mirrorReady copies the KCC Ready condition of target to src in memory and reports whether anything changed.
+func mirrorReady(src client.Object, target client.Object) bool {
+	ready := readyCondition(target)
+	if ready == nil {
+		return false
+	}
+	reason := ready.Reason
+	if reason == "" {
+		reason = "Unknown"
+	}
+	return setCondition(src, metav1.Condition{
+		Type:    ReadyCondition,
+		Status:  metav1.ConditionStatus(ready.Status),
+		Reason:  reason,
+		Message: ready.Message,
+	})
+}
@@ -0,0 +1,59 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"context"
+	k8s "github.com/GoogleCloudPlatform/k8s-config-connector/pkg/apis/k8s/v1alpha1"
+	pubsub "github.com/GoogleCloudPlatform/k8s-config-connector/pkg/apis/pubsub/v1beta1"
+	api "github.com/slamdev/config-connector-templater/api/v1alpha1"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"testing"
+)
+
+func TestWaitForDependencies(t *testing.T) {
+	ctx := context.Background()
+	topic := &api.PubSubTopicTemplate{ObjectMeta: metav1.ObjectMeta{Name: "topic", Namespace: "team1"}}
+	subscription := &api.PubSubSubscriptionTemplate{ObjectMeta: metav1.ObjectMeta{
+		Name: "subscription", Namespace: "team1",
+		Annotations: map[string]string{DependsOnAnnotation: "PubSubTopicTemplate/topic"},
+	}}
+	cli := newFakeCli(topic, subscription)
+
+	waiting, err := WaitForDependencies(ctx, cli, subscription)
+	assert.NoError(t, err)
+	assert.True(t, waiting)
+	assert.Equal(t, "waiting for PubSubTopicTemplate/topic to become Ready", subscription.Status.Conditions[0].Message)
+
+	target := &pubsub.PubSubTopic{}
+	target.Status.Conditions = []k8s.Condition{{Type: "Ready", Status: corev1.ConditionTrue, Reason: "UpToDate"}}
+	assert.True(t, mirrorReady(topic, target))
+	assert.NoError(t, cli.Status().Update(ctx, topic))
+
+	waiting, err = WaitForDependencies(ctx, cli, subscription)
+	assert.NoError(t, err)
+	assert.False(t, waiting)
+	assert.True(t, clearWaiting(subscription))
+
+	subscription.Annotations[DependsOnAnnotation] = "topic"
+	waiting, err = WaitForDependencies(ctx, cli, subscription)
+	assert.NoError(t, err)
+	assert.True(t, waiting)
+	assert.Equal(t, InvalidDependencyReason, subscription.Status.Conditions[0].Reason)
+}
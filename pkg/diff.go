@@ -0,0 +1,93 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// FieldDiff is a single field that differs between two specs.
+type FieldDiff struct {
+	Path string      `json:"path"`
+	Old  interface{} `json:"old,omitempty"`
+	New  interface{} `json:"new,omitempty"`
+}
+
+// diffSpecs lists the fields that differ between the old and the new spec by their JSON path.
+func diffSpecs(old interface{}, new interface{}) ([]FieldDiff, error) {
+	oldTree, err := structToTree(old)
+	if err != nil {
+		return nil, err
+	}
+	newTree, err := structToTree(new)
+	if err != nil {
+		return nil, err
+	}
+	var diffs []FieldDiff
+	diffTrees(oldTree, newTree, "$", &diffs)
+	return diffs, nil
+}
+
+func diffTrees(old interface{}, new interface{}, path string, diffs *[]FieldDiff) {
+	oldMap, oldIsMap := old.(map[string]interface{})
+	newMap, newIsMap := new.(map[string]interface{})
+	// a missing object is compared as an empty one, so every field added or removed is listed
+	if (oldIsMap || old == nil) && (newIsMap || new == nil) && (oldIsMap || newIsMap) {
+		keys := make(map[string]interface{}, len(oldMap)+len(newMap))
+		for k := range oldMap {
+			keys[k] = nil
+		}
+		for k := range newMap {
+			keys[k] = nil
+		}
+		for _, k := range sortedKeys(keys) {
+			diffTrees(oldMap[k], newMap[k], path+"."+k, diffs)
+		}
+		return
+	}
+	oldList, oldIsList := old.([]interface{})
+	newList, newIsList := new.([]interface{})
+	if oldIsList && newIsList && len(oldList) == len(newList) {
+		for i := range oldList {
+			diffTrees(oldList[i], newList[i], fmt.Sprintf("%s[%d]", path, i), diffs)
+		}
+		return
+	}
+	if !reflect.DeepEqual(old, new) {
+		*diffs = append(*diffs, FieldDiff{Path: path, Old: old, New: new})
+	}
+}
+
+// renderedDiffs keeps the diffs of fields the new spec sets.
+func renderedDiffs(diffs []FieldDiff) []FieldDiff {
+	var kept []FieldDiff
+	for _, d := range diffs {
+		if d.New != nil {
+			kept = append(kept, d)
+		}
+	}
+	return kept
+}
+
+func diffPaths(diffs []FieldDiff) []string {
+	paths := make([]string, len(diffs))
+	for i, d := range diffs {
+		paths[i] = d.Path
+	}
+	return paths
+}
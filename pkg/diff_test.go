@@ -0,0 +1,41 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestDiffSpecs(t *testing.T) {
+	type spec struct {
+		Name   string            `json:"name,omitempty"`
+		Labels map[string]string `json:"labels,omitempty"`
+		Items  []string          `json:"items,omitempty"`
+	}
+	old := spec{Name: "a", Labels: map[string]string{"x": "1", "y": "2"}, Items: []string{"p", "q"}}
+	new := spec{Name: "a", Labels: map[string]string{"x": "1", "z": "3"}, Items: []string{"p", "r"}}
+
+	diffs, err := diffSpecs(old, new)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"$.items[1]", "$.labels.y", "$.labels.z"}, diffPaths(diffs))
+	assert.Equal(t, FieldDiff{Path: "$.items[1]", Old: "q", New: "r"}, diffs[0])
+
+	diffs, err = diffSpecs(old, old)
+	assert.NoError(t, err)
+	assert.Empty(t, diffs)
+}
@@ -0,0 +1,305 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"cuelang.org/go/cue"
+	"cuelang.org/go/cue/cuecontext"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/checker/decls"
+	"github.com/google/cel-go/interpreter"
+	"github.com/google/go-jsonnet"
+	exprpb "google.golang.org/genproto/googleapis/api/expr/v1alpha1"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/known/structpb"
+	"io"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+const (
+	GoTemplateEngine = "gotemplate"
+	CelEngine        = "cel"
+	JsonnetEngine    = "jsonnet"
+	CueEngine        = "cue"
+)
+
+// Renderer renders template sources written in one expression language.
+// Every renderer receives the same params built by structToMap from the template object.
+type Renderer interface {
+	// RenderString renders a single string leaf of the spec.
+	RenderString(str string, params map[string]interface{}) (string, error)
+	// RenderDocument renders a whole template document into YAML or JSON text.
+	RenderDocument(doc string, params map[string]interface{}) (string, error)
+}
+
+// getRenderer returns a renderer for a single render, it must not be reused
+// because it tracks the resources spent against opts.Limits.
+func getRenderer(opts RenderOptions) (Renderer, error) {
+	b := newBudget(opts.Limits)
+	switch opts.Engine {
+	case "", GoTemplateEngine:
+		funcs := funcMap(opts.Functions)
+		limitLoops(funcs, opts.Limits)
+		return goTemplateRenderer{funcs: funcs, budget: b, parsed: opts.parsed}, nil
+	case CelEngine:
+		return expressionRenderer{eval: evalCel, budget: b}, nil
+	case JsonnetEngine, CueEngine:
+		worker := newEvalWorker(opts.Engine, b)
+		return expressionRenderer{eval: worker.eval, budget: b, worker: worker}, nil
+	}
+	return nil, fmt.Errorf("unknown engine %q", opts.Engine)
+}
+
+// closeRenderer stops what a renderer started for its render, such as the child process of an evalWorker.
+func closeRenderer(renderer Renderer) {
+	if c, ok := renderer.(io.Closer); ok {
+		_ = c.Close()
+	}
+}
+
+type goTemplateRenderer struct {
+	funcs  template.FuncMap
+	budget *budget
+	parsed *parsedTemplates
+}
+
+func (r goTemplateRenderer) RenderString(str string, params map[string]interface{}) (string, error) {
+	if !strings.Contains(str, "{{") {
+		return str, r.budget.spend(len(str))
+	}
+	return r.render(str, params)
+}
+
+func (r goTemplateRenderer) RenderDocument(doc string, params map[string]interface{}) (string, error) {
+	return r.render(doc, params)
+}
+
+func (r goTemplateRenderer) render(str string, params map[string]interface{}) (string, error) {
+	parsed, ok := r.parsed.get(str)
+	if !ok {
+		var err error
+		if parsed, err = parseTemplate(str, r.funcs, r.budget.limits); err != nil {
+			return "", err
+		}
+		r.parsed.put(str, parsed)
+	}
+	// parsed templates are shared, the range iterations are counted against the budget of this render
+	tpl, err := parsed.Clone()
+	if err != nil {
+		return "", fmt.Errorf("failed to clone template; %w", err)
+	}
+	tpl.Funcs(template.FuncMap{iterationFunc: r.budget.iteration})
+	rendered := &limitedWriter{budget: r.budget}
+	if err := tpl.Execute(rendered, params); err != nil {
+		return "", fmt.Errorf("failed to execute template; %w", err)
+	}
+	return rendered.String(), nil
+}
+
+func parseTemplate(str string, funcs template.FuncMap, limits Limits) (*template.Template, error) {
+	tpl := template.New("_").Funcs(funcs)
+	parsed, err := tpl.Parse(str)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse template; %w", err)
+	}
+	if err := checkDepth(parsed, limits.MaxDepth); err != nil {
+		return nil, err
+	}
+	countIterations(parsed)
+	return parsed, nil
+}
+
+// expressionRenderer adapts languages that evaluate expressions to values:
+// string leaves interpolate every {{ expr }} segment, documents are a single expression.
+type expressionRenderer struct {
+	eval   func(expr string, params map[string]interface{}, b *budget) (interface{}, error)
+	budget *budget
+	worker *evalWorker
+}
+
+func (r expressionRenderer) Close() error {
+	if r.worker == nil {
+		return nil
+	}
+	return r.worker.Close()
+}
+
+var interpolation = regexp.MustCompile(`{{(.*?)}}`)
+
+func (r expressionRenderer) RenderString(str string, params map[string]interface{}) (string, error) {
+	var evalErr error
+	rendered := interpolation.ReplaceAllStringFunc(str, func(segment string) string {
+		if evalErr != nil {
+			return ""
+		}
+		val, err := r.eval(interpolation.FindStringSubmatch(segment)[1], params, r.budget)
+		if err != nil {
+			evalErr = err
+			return ""
+		}
+		if s, ok := val.(string); ok {
+			return s
+		}
+		jsonStr, err := json.Marshal(val)
+		if err != nil {
+			evalErr = fmt.Errorf("failed to marshal expression result; %w", err)
+			return ""
+		}
+		return string(jsonStr)
+	})
+	if evalErr != nil {
+		return "", evalErr
+	}
+	return rendered, r.budget.spend(len(rendered))
+}
+
+func (r expressionRenderer) RenderDocument(doc string, params map[string]interface{}) (string, error) {
+	val, err := r.eval(doc, params, r.budget)
+	if err != nil {
+		return "", err
+	}
+	jsonStr, err := json.Marshal(val)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal document; %w", err)
+	}
+	return string(jsonStr), r.budget.spend(len(jsonStr))
+}
+
+func evalCel(expr string, params map[string]interface{}, b *budget) (interface{}, error) {
+	var vars []*exprpb.Decl
+	for _, k := range sortedKeys(params) {
+		vars = append(vars, decls.NewVar(k, decls.Dyn))
+	}
+	env, err := cel.NewEnv(cel.Declarations(vars...))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cel env; %w", err)
+	}
+	ast, iss := env.Compile(expr)
+	if iss.Err() != nil {
+		return nil, fmt.Errorf("failed to compile cel expression; %w", iss.Err())
+	}
+	// nested comprehensions share the check counter, only checking every iteration stops all of them at once
+	progOpts := []cel.ProgramOption{cel.InterruptCheckFrequency(1)}
+	if b.limits.MaxOutputBytes > 0 {
+		progOpts = append(progOpts, cel.CostLimit(uint64(b.limits.MaxOutputBytes)))
+	}
+	prg, err := env.Program(ast, progOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cel program; %w", err)
+	}
+	ctx, cancel := b.context()
+	defer cancel()
+	val, _, err := prg.ContextEval(ctx, params)
+	if ctx.Err() != nil {
+		return nil, b.timeoutError()
+	}
+	if err != nil {
+		var cancelled interpreter.EvalCancelledError
+		if errors.As(err, &cancelled) && cancelled.Cause == interpreter.CostLimitExceeded {
+			return nil, fmt.Errorf("%w: cel expression costs more than %d", ErrRenderLimitExceeded, b.limits.MaxOutputBytes)
+		}
+		return nil, fmt.Errorf("failed to evaluate cel expression; %w", err)
+	}
+	native, err := val.ConvertToNative(reflect.TypeOf(&structpb.Value{}))
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert cel result; %w", err)
+	}
+	jsonStr, err := protojson.Marshal(native.(*structpb.Value))
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal cel result; %w", err)
+	}
+	var out interface{}
+	if err := json.Unmarshal(jsonStr, &out); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal cel result; %w", err)
+	}
+	return out, nil
+}
+
+func evalJsonnet(expr string, params map[string]interface{}, b *budget) (interface{}, error) {
+	vm := jsonnet.MakeVM()
+	if b.limits.MaxDepth > 0 {
+		vm.MaxStack = b.limits.MaxDepth
+	}
+	vm.Importer(noImporter{})
+	// every param is bound to a local of the same name; the prefix has no line breaks,
+	// so line numbers in error messages still match the template
+	var locals []string
+	for _, k := range sortedKeys(params) {
+		jsonStr, err := json.Marshal(params[k])
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal jsonnet param; %w", err)
+		}
+		vm.ExtCode(k, string(jsonStr))
+		locals = append(locals, fmt.Sprintf("%s = std.extVar(%q)", k, k))
+	}
+	snippet := expr
+	if len(locals) > 0 {
+		snippet = "local " + strings.Join(locals, ", ") + "; " + expr
+	}
+	jsonStr, err := vm.EvaluateAnonymousSnippet("template.jsonnet", snippet)
+	if err != nil {
+		return nil, fmt.Errorf("failed to evaluate jsonnet; %w", err)
+	}
+	var out interface{}
+	if err := json.Unmarshal([]byte(jsonStr), &out); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal jsonnet result; %w", err)
+	}
+	return out, nil
+}
+
+// noImporter keeps jsonnet templates from reading files of the controller host.
+type noImporter struct{}
+
+func (noImporter) Import(_, importedPath string) (jsonnet.Contents, string, error) {
+	return jsonnet.Contents{}, "", fmt.Errorf("imports are not allowed: %s", importedPath)
+}
+
+func evalCue(expr string, params map[string]interface{}, _ *budget) (interface{}, error) {
+	ctx := cuecontext.New()
+	scope := ctx.Encode(params)
+	if scope.Err() != nil {
+		return nil, fmt.Errorf("failed to encode cue params; %w", scope.Err())
+	}
+	val := ctx.CompileString(expr, cue.Scope(scope), cue.Filename("template.cue"))
+	if val.Err() != nil {
+		return nil, fmt.Errorf("failed to compile cue; %w", val.Err())
+	}
+	if err := val.Validate(cue.Concrete(true)); err != nil {
+		return nil, fmt.Errorf("failed to evaluate cue; %w", err)
+	}
+	var out interface{}
+	if err := val.Decode(&out); err != nil {
+		return nil, fmt.Errorf("failed to decode cue result; %w", err)
+	}
+	return out, nil
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
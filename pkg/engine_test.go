@@ -0,0 +1,90 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	api "github.com/slamdev/config-connector-templater/api/v1alpha1"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"testing"
+)
+
+func TestEngines(t *testing.T) {
+	template := api.PubSubSubscriptionTemplate{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "orders",
+			Namespace: "prod",
+		},
+	}
+
+	tests := []struct {
+		engine string
+		leaf   string
+		doc    string
+	}{
+		{
+			engine: GoTemplateEngine,
+			leaf:   `{{ .metadata.namespace }}-{{ .metadata.name }}`,
+			doc:    `{topicRef: {name: "{{ .metadata.name }}"}, ackDeadlineSeconds: {{ if eq .metadata.namespace "prod" }}60{{ else }}10{{ end }}}`,
+		},
+		{
+			engine: CelEngine,
+			leaf:   `{{ metadata.namespace }}-{{ metadata.name }}`,
+			doc:    `{"topicRef": {"name": metadata.name}, "ackDeadlineSeconds": metadata.namespace == "prod" ? 60 : 10}`,
+		},
+		{
+			engine: JsonnetEngine,
+			leaf:   `{{ metadata.namespace }}-{{ metadata.name }}`,
+			doc:    `{topicRef: {name: metadata.name}, ackDeadlineSeconds: if metadata.namespace == "prod" then 60 else 10}`,
+		},
+		{
+			engine: CueEngine,
+			leaf:   `{{ metadata.namespace }}-{{ metadata.name }}`,
+			doc:    "topicRef: name: metadata.name\nif metadata.namespace == \"prod\" {ackDeadlineSeconds: 60}",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.engine, func(t *testing.T) {
+			opts := RenderOptions{Engine: tt.engine}
+
+			spec := template.Spec
+			spec.ResourceID = &tt.leaf
+			res, err := Render(spec, template, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, "prod-orders", *res.(api.PubSubSubscriptionTemplateSpec).ResourceID)
+
+			res, err = RenderDocument(tt.doc, template.Spec, template, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resSpec := res.(api.PubSubSubscriptionTemplateSpec)
+			assert.Equal(t, "orders", resSpec.TopicRef.Name)
+			assert.Equal(t, 60, *resSpec.AckDeadlineSeconds)
+		})
+	}
+}
+
+func TestUnknownEngine(t *testing.T) {
+	template := api.PubSubTopicTemplate{}
+
+	_, err := Render(template.Spec, template, RenderOptions{Engine: "python"})
+
+	assert.Error(t, err)
+}
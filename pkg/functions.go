@@ -0,0 +1,94 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"github.com/Masterminds/sprig/v3"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// unsafeFunctions give templates access to the controller host: its environment
+// (including credentials) and its network. They are only available when an
+// administrator puts them on the allow-list explicitly.
+var unsafeFunctions = map[string]bool{
+	"env":           true,
+	"expandenv":     true,
+	"getHostByName": true,
+}
+
+// DefaultFunctions returns the names of the functions available to go templates
+// when no allow-list is configured.
+func DefaultFunctions() []string {
+	var names []string
+	for name := range sprig.TxtFuncMap() {
+		if !unsafeFunctions[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ParseList parses a comma separated list of names, e.g. functions or namespaces.
+func ParseList(list string) []string {
+	names := make([]string, 0)
+	for _, name := range strings.Split(list, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// intersectFunctions narrows the allowed functions down to the ones a namespace permits.
+func intersectFunctions(allowed []string, permitted []string) []string {
+	if allowed == nil {
+		allowed = DefaultFunctions()
+	}
+	set := make(map[string]bool, len(permitted))
+	for _, name := range permitted {
+		set[name] = true
+	}
+	out := make([]string, 0)
+	for _, name := range allowed {
+		if set[name] {
+			out = append(out, name)
+		}
+	}
+	return out
+}
+
+func funcMap(allowed []string) template.FuncMap {
+	all := sprig.TxtFuncMap()
+	out := make(template.FuncMap, len(all))
+	if allowed == nil {
+		for name, fn := range all {
+			if !unsafeFunctions[name] {
+				out[name] = fn
+			}
+		}
+		return out
+	}
+	for _, name := range allowed {
+		if fn, ok := all[name]; ok {
+			out[name] = fn
+		}
+	}
+	return out
+}
@@ -0,0 +1,56 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	api "github.com/slamdev/config-connector-templater/api/v1alpha1"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestUnsafeFunctionsAreBlocked(t *testing.T) {
+	template := api.PubSubTopicTemplate{}
+
+	for _, tpl := range []string{`{{ env "HOME" }}`, `{{ expandenv "$HOME" }}`, `{{ getHostByName "localhost" }}`} {
+		_, err := RenderDocument(tpl, template.Spec, template, RenderOptions{})
+		assert.Error(t, err, tpl)
+	}
+}
+
+func TestAllowedFunctions(t *testing.T) {
+	template := api.PubSubTopicTemplate{}
+	opts := RenderOptions{Functions: ParseList("upper, env")}
+
+	res, err := RenderDocument(`resourceID: {{ "id" | upper }}`, template.Spec, template, opts)
+	assert.NoError(t, err)
+	assert.NotNil(t, res)
+
+	_, err = RenderDocument(`resourceID: {{ "id" | lower }}`, template.Spec, template, opts)
+	assert.Error(t, err)
+
+	opts.Functions = intersectFunctions(opts.Functions, ParseList("upper"))
+	_, err = RenderDocument(`resourceID: {{ env "HOME" }}`, template.Spec, template, opts)
+	assert.Error(t, err)
+}
+
+func TestJsonnetImportsAreBlocked(t *testing.T) {
+	template := api.PubSubTopicTemplate{}
+
+	_, err := RenderDocument(`{resourceID: importstr "/etc/hostname"}`, template.Spec, template, RenderOptions{Engine: JsonnetEngine})
+
+	assert.Error(t, err)
+}
@@ -0,0 +1,350 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"hash/fnv"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+	"sigs.k8s.io/yaml"
+	"strings"
+	"sync"
+	"time"
+)
+
+// gitPullInterval bounds how often reads pick up commits pushed by others.
+const gitPullInterval = time.Minute
+
+// GitOptions configures the GitOps output of rendered resources.
+type GitOptions struct {
+	// Repo is a local worktree committed to in place, or the URL of a repository cloned into Dir and pushed to.
+	Repo string
+	// Branch receives the commits, defaults to main.
+	Branch string
+	// Dir is the worktree a remote Repo is cloned into.
+	Dir string
+	// Path is the directory of the repository holding the rendered resources.
+	Path string
+	// Author of the commits as "name <email>", defaults to the git configuration.
+	Author string
+}
+
+// GitStore writes rendered resources as YAML files to <namespace>/<kind>/<name>.yaml in a Git repository
+// and commits every change. It needs the git binary.
+type GitStore struct {
+	opts     GitOptions
+	scheme   *runtime.Scheme
+	push     bool
+	mu       sync.Mutex
+	lastPull time.Time
+}
+
+// NewGitStore prepares the worktree of the repository, cloning it unless it is a local worktree.
+func NewGitStore(ctx context.Context, opts GitOptions, scheme *runtime.Scheme) (*GitStore, error) {
+	if opts.Branch == "" {
+		opts.Branch = "main"
+	}
+	if _, _, ok := parseAuthor(opts.Author); opts.Author != "" && !ok {
+		return nil, fmt.Errorf("invalid author %q, expected name <email>", opts.Author)
+	}
+	s := &GitStore{opts: opts, scheme: scheme}
+	if _, err := os.Stat(filepath.Join(opts.Repo, ".git")); err == nil {
+		s.opts.Dir = opts.Repo
+		return s, nil
+	}
+	s.push = true
+	if _, err := os.Stat(filepath.Join(opts.Dir, ".git")); os.IsNotExist(err) {
+		if _, err := s.git(ctx, "", "clone", "--quiet", opts.Repo, opts.Dir); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := s.git(ctx, s.opts.Dir, "checkout", "--quiet", opts.Branch); err != nil {
+		// the branch does not exist yet, it is created by the first push
+		if _, err := s.git(ctx, s.opts.Dir, "checkout", "--quiet", "-b", opts.Branch); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (s *GitStore) Get(ctx context.Context, key client.ObjectKey, obj client.Object) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.pull(ctx, false); err != nil {
+		return err
+	}
+	gvk, err := apiutil.GVKForObject(obj, s.scheme)
+	if err != nil {
+		return err
+	}
+	file, err := s.file(key.Namespace, gvk.Kind, key.Name)
+	if err != nil {
+		return err
+	}
+	return s.read(file, gvk, obj)
+}
+
+func (s *GitStore) List(ctx context.Context, list client.ObjectList, opts ...client.ListOption) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.pull(ctx, false); err != nil {
+		return err
+	}
+	gvk, err := apiutil.GVKForObject(list, s.scheme)
+	if err != nil {
+		return err
+	}
+	gvk.Kind = strings.TrimSuffix(gvk.Kind, "List")
+	listOpts := client.ListOptions{}
+	listOpts.ApplyOptions(opts)
+	namespace := listOpts.Namespace
+	if namespace == "" {
+		namespace = "*"
+	}
+	pattern, err := s.file(namespace, gvk.Kind, "*")
+	if err != nil {
+		return err
+	}
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		return err
+	}
+	var items []runtime.Object
+	for _, f := range files {
+		obj, err := s.scheme.New(gvk)
+		if err != nil {
+			return err
+		}
+		if err := s.read(f, gvk, obj.(client.Object)); err != nil {
+			return err
+		}
+		items = append(items, obj)
+	}
+	return meta.SetList(list, items)
+}
+
+func (s *GitStore) Create(ctx context.Context, obj client.Object, _ ...client.CreateOption) error {
+	return s.write(ctx, obj, "Create", true)
+}
+
+func (s *GitStore) Update(ctx context.Context, obj client.Object, _ ...client.UpdateOption) error {
+	return s.write(ctx, obj, "Update", false)
+}
+
+func (s *GitStore) Delete(ctx context.Context, obj client.Object, _ ...client.DeleteOption) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	gvk, err := apiutil.GVKForObject(obj, s.scheme)
+	if err != nil {
+		return err
+	}
+	if err := s.pull(ctx, true); err != nil {
+		return err
+	}
+	file, err := s.file(obj.GetNamespace(), gvk.Kind, obj.GetName())
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(file); os.IsNotExist(err) {
+		return notFound(gvk, obj.GetName())
+	}
+	if _, err := s.git(ctx, s.opts.Dir, "rm", "--quiet", file); err != nil {
+		return err
+	}
+	return s.commit(ctx, fmt.Sprintf("Delete %s %s/%s", gvk.Kind, obj.GetNamespace(), obj.GetName()))
+}
+
+func (s *GitStore) write(ctx context.Context, obj client.Object, action string, create bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	gvk, err := apiutil.GVKForObject(obj, s.scheme)
+	if err != nil {
+		return err
+	}
+	if err := s.pull(ctx, true); err != nil {
+		return err
+	}
+	file, err := s.file(obj.GetNamespace(), gvk.Kind, obj.GetName())
+	if err != nil {
+		return err
+	}
+	_, statErr := os.Stat(file)
+	if create && statErr == nil {
+		return errors.NewAlreadyExists(groupResource(gvk), obj.GetName())
+	}
+	if !create && os.IsNotExist(statErr) {
+		return notFound(gvk, obj.GetName())
+	}
+	data, err := cleanManifest(obj, gvk)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return fmt.Errorf("failed to create directory; %w", err)
+	}
+	if err := os.WriteFile(file, data, 0644); err != nil {
+		return fmt.Errorf("failed to write %s; %w", file, err)
+	}
+	if _, err := s.git(ctx, s.opts.Dir, "add", file); err != nil {
+		return err
+	}
+	if err := s.commit(ctx, fmt.Sprintf("%s %s %s/%s", action, gvk.Kind, obj.GetNamespace(), obj.GetName())); err != nil {
+		return err
+	}
+	setStoredMeta(obj, file, data)
+	return nil
+}
+
+func (s *GitStore) read(file string, gvk schema.GroupVersionKind, obj client.Object) error {
+	data, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return notFound(gvk, strings.TrimSuffix(filepath.Base(file), ".yaml"))
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read %s; %w", file, err)
+	}
+	if err := yaml.Unmarshal(data, obj); err != nil {
+		return fmt.Errorf("failed to parse %s; %w", file, err)
+	}
+	setStoredMeta(obj, file, data)
+	return nil
+}
+
+// commit records the staged changes, nothing is committed when the rendered resource did not change.
+// Commits left behind by a failed push are pushed with the next change.
+func (s *GitStore) commit(ctx context.Context, msg string) error {
+	if _, err := s.git(ctx, s.opts.Dir, "diff", "--cached", "--quiet"); err != nil {
+		if _, err := s.git(ctx, s.opts.Dir, "commit", "--quiet", "-m", msg); err != nil {
+			return err
+		}
+	}
+	if !s.push {
+		return nil
+	}
+	_, err := s.git(ctx, s.opts.Dir, "push", "--quiet", "origin", "HEAD:"+s.opts.Branch)
+	return err
+}
+
+// pull rebases the worktree onto the commits pushed by others, reads do it at most every gitPullInterval.
+func (s *GitStore) pull(ctx context.Context, force bool) error {
+	if !s.push || (!force && time.Since(s.lastPull) < gitPullInterval) {
+		return nil
+	}
+	if _, err := s.git(ctx, s.opts.Dir, "fetch", "--quiet", "origin"); err != nil {
+		return err
+	}
+	s.lastPull = time.Now()
+	if _, err := s.git(ctx, s.opts.Dir, "rev-parse", "--verify", "--quiet", "origin/"+s.opts.Branch); err != nil {
+		// nothing was pushed yet
+		return nil
+	}
+	if _, err := s.git(ctx, s.opts.Dir, "rebase", "--quiet", "origin/"+s.opts.Branch); err != nil {
+		// a worktree left in the middle of a rebase would fail every later write
+		_, _ = s.git(ctx, s.opts.Dir, "rebase", "--abort")
+		return err
+	}
+	return nil
+}
+
+// file returns the path of a resource, names escaping the directory of their namespace and kind are refused.
+func (s *GitStore) file(namespace string, kind string, name string) (string, error) {
+	root := filepath.Join(s.opts.Dir, s.opts.Path)
+	dir := filepath.Join(root, namespace, strings.ToLower(kind))
+	file := filepath.Join(dir, name+".yaml")
+	if filepath.Dir(file) != dir || !strings.HasPrefix(dir, root+string(filepath.Separator)) {
+		return "", fmt.Errorf("invalid path %s/%s/%s.yaml", namespace, strings.ToLower(kind), name)
+	}
+	return file, nil
+}
+
+func (s *GitStore) git(ctx context.Context, dir string, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	if name, email, ok := parseAuthor(s.opts.Author); ok {
+		cmd.Env = append(os.Environ(), "GIT_AUTHOR_NAME="+name, "GIT_AUTHOR_EMAIL="+email,
+			"GIT_COMMITTER_NAME="+name, "GIT_COMMITTER_EMAIL="+email)
+	}
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("git %s failed: %s; %w", args[0], strings.TrimSpace(out.String()), err)
+	}
+	return out.String(), nil
+}
+
+// parseAuthor splits "name <email>".
+func parseAuthor(author string) (string, string, bool) {
+	i := strings.Index(author, "<")
+	if i < 0 || !strings.HasSuffix(author, ">") {
+		return "", "", false
+	}
+	return strings.TrimSpace(author[:i]), author[i+1 : len(author)-1], true
+}
+
+// cleanManifest renders obj as YAML without the fields set by the API server.
+func cleanManifest(obj client.Object, gvk schema.GroupVersionKind) ([]byte, error) {
+	u, err := cleanObject(obj, gvk)
+	if err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(u)
+}
+
+func cleanObject(obj client.Object, gvk schema.GroupVersionKind) (map[string]interface{}, error) {
+	u, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert %s; %w", obj.GetName(), err)
+	}
+	u["apiVersion"] = gvk.GroupVersion().String()
+	u["kind"] = gvk.Kind
+	delete(u, "status")
+	if metadata, ok := u["metadata"].(map[string]interface{}); ok {
+		for _, f := range []string{"uid", "resourceVersion", "generation", "creationTimestamp", "managedFields", "selfLink"} {
+			delete(metadata, f)
+		}
+	}
+	return u, nil
+}
+
+// setStoredMeta fills the fields the API server would set: the file identifies the resource
+// and every change of its content is a new generation.
+func setStoredMeta(obj client.Object, file string, data []byte) {
+	h := fnv.New32a()
+	_, _ = h.Write(data)
+	obj.SetUID(types.UID("git:" + file))
+	obj.SetGeneration(int64(h.Sum32()))
+}
+
+func groupResource(gvk schema.GroupVersionKind) schema.GroupResource {
+	return schema.GroupResource{Group: gvk.Group, Resource: strings.ToLower(gvk.Kind)}
+}
+
+func notFound(gvk schema.GroupVersionKind, name string) error {
+	return errors.NewNotFound(groupResource(gvk), name)
+}
@@ -0,0 +1,148 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"context"
+	pubsub "github.com/GoogleCloudPlatform/k8s-config-connector/pkg/apis/pubsub/v1beta1"
+	api "github.com/slamdev/config-connector-templater/api/v1alpha1"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"strings"
+	"testing"
+)
+
+func TestGitStore(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	bare := filepath.Join(dir, "repo.git")
+	assert.NoError(t, exec.Command("git", "init", "--quiet", "--bare", bare).Run())
+
+	resourceID := "orders"
+	template := &api.PubSubTopicTemplate{ObjectMeta: metav1.ObjectMeta{Name: "orders", Namespace: "team1", UID: "uid"}}
+	template.Spec.ResourceID = &resourceID
+	local := newFakeCli(template, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team1"}})
+	store, err := NewGitStore(ctx, GitOptions{Repo: bare, Dir: filepath.Join(dir, "work"), Path: "kcc", Author: "templater <templater@example.com>"}, local.Scheme())
+	assert.NoError(t, err)
+	cfg := Config{GitOps: store}
+	cli, err := TargetClient(ctx, local, cfg, template)
+	assert.NoError(t, err)
+	key := client.ObjectKey{Namespace: "team1", Name: "orders"}
+
+	assert.NoError(t, CreateTargetResource(ctx, cli, cfg, template, &pubsub.PubSubTopic{}))
+	assert.True(t, errors.IsNotFound(local.Get(ctx, key, &pubsub.PubSubTopic{})))
+
+	checkout := filepath.Join(dir, "checkout")
+	assert.NoError(t, exec.Command("git", "clone", "--quiet", "--branch", "main", bare, checkout).Run())
+	manifest, err := os.ReadFile(filepath.Join(checkout, "kcc", "team1", "pubsubtopic", "orders.yaml"))
+	assert.NoError(t, err)
+	assert.Contains(t, string(manifest), "kind: PubSubTopic")
+	assert.Contains(t, string(manifest), "resourceID: orders")
+	assert.Contains(t, string(manifest), RemoteOwnerLabel+": uid")
+	assert.NotContains(t, string(manifest), "ownerReferences")
+	assert.NotContains(t, string(manifest), "creationTimestamp")
+
+	target := &pubsub.PubSubTopic{}
+	assert.NoError(t, cli.Get(ctx, key, target))
+	assert.True(t, metav1.IsControlledBy(target, template))
+
+	// an unchanged render is not committed again
+	assert.NoError(t, UpdateTargetResource(ctx, cli, cfg, template, target, &pubsub.PubSubTopic{}))
+	resourceID = "payments"
+	assert.NoError(t, UpdateTargetResource(ctx, cli, cfg, template, target, &pubsub.PubSubTopic{}))
+	assert.NoError(t, DeleteTarget(ctx, local, cfg, template, &pubsub.PubSubTopic{}))
+
+	out, err := exec.Command("git", "-C", checkout, "pull", "--quiet").CombinedOutput()
+	assert.NoError(t, err, string(out))
+	out, err = exec.Command("git", "-C", checkout, "log", "--format=%an %s").Output()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"templater Delete PubSubTopic team1/orders",
+		"templater Update PubSubTopic team1/orders",
+		"templater Create PubSubTopic team1/orders",
+	}, strings.Split(strings.TrimSpace(string(out)), "\n"))
+	assert.True(t, errors.IsNotFound(cli.Get(ctx, key, &pubsub.PubSubTopic{})))
+}
+
+func TestGitStoreWorktree(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	assert.NoError(t, exec.Command("git", "init", "--quiet", dir).Run())
+	local := newFakeCli()
+	store, err := NewGitStore(ctx, GitOptions{Repo: dir, Author: "templater <templater@example.com>"}, local.Scheme())
+	assert.NoError(t, err)
+
+	topic := &pubsub.PubSubTopic{ObjectMeta: metav1.ObjectMeta{Name: "orders", Namespace: "team1"}}
+	assert.NoError(t, store.Create(ctx, topic))
+	assert.True(t, errors.IsAlreadyExists(store.Create(ctx, topic)))
+	assert.FileExists(t, filepath.Join(dir, "team1", "pubsubtopic", "orders.yaml"))
+
+	list := &pubsub.PubSubTopicList{}
+	assert.NoError(t, store.List(ctx, list, client.InNamespace("team1")))
+	assert.Len(t, list.Items, 1)
+	assert.Equal(t, topic.GetUID(), list.Items[0].GetUID())
+
+	// names must not escape the directory of their namespace and kind
+	escaping := &pubsub.PubSubTopic{ObjectMeta: metav1.ObjectMeta{Name: "../../team2/pubsubtopic/orders", Namespace: "team1"}}
+	assert.Error(t, store.Create(ctx, escaping))
+	assert.NoFileExists(t, filepath.Join(dir, "team2", "pubsubtopic", "orders.yaml"))
+	escaping.Name, escaping.Namespace = "orders", ".."
+	assert.Error(t, store.Create(ctx, escaping))
+
+	_, err = NewGitStore(ctx, GitOptions{Repo: dir, Author: "templater"}, local.Scheme())
+	assert.Error(t, err)
+}
+
+func TestGitStoreRebaseConflict(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	bare := filepath.Join(dir, "repo.git")
+	work := filepath.Join(dir, "work")
+	assert.NoError(t, exec.Command("git", "init", "--quiet", "--bare", bare).Run())
+	local := newFakeCli()
+	store, err := NewGitStore(ctx, GitOptions{Repo: bare, Dir: work, Author: "templater <templater@example.com>"}, local.Scheme())
+	assert.NoError(t, err)
+	topic := &pubsub.PubSubTopic{ObjectMeta: metav1.ObjectMeta{Name: "orders", Namespace: "team1"}}
+	assert.NoError(t, store.Create(ctx, topic))
+
+	// someone else pushes a change conflicting with an unpushed local commit
+	commit := func(repo string, content string) {
+		file := filepath.Join(repo, "team1", "pubsubtopic", "orders.yaml")
+		assert.NoError(t, os.WriteFile(file, []byte(content), 0644))
+		out, err := exec.Command("git", "-C", repo, "-c", "user.name=t", "-c", "user.email=t@example.com",
+			"commit", "--quiet", "-am", content).CombinedOutput()
+		assert.NoError(t, err, string(out))
+	}
+	checkout := filepath.Join(dir, "checkout")
+	assert.NoError(t, exec.Command("git", "clone", "--quiet", "--branch", "main", bare, checkout).Run())
+	commit(checkout, "theirs")
+	assert.NoError(t, exec.Command("git", "-C", checkout, "push", "--quiet", "origin", "main").Run())
+	commit(work, "ours")
+
+	assert.Error(t, store.Update(ctx, topic))
+	assert.NoDirExists(t, filepath.Join(work, ".git", "rebase-merge"))
+	assert.NoDirExists(t, filepath.Join(work, ".git", "rebase-apply"))
+	out, err := exec.Command("git", "-C", work, "status", "--porcelain").Output()
+	assert.NoError(t, err)
+	assert.Empty(t, string(out))
+}
@@ -0,0 +1,503 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sync/atomic"
+	"text/template"
+	"text/template/parse"
+	"time"
+)
+
+// ErrRenderLimitExceeded is returned when a template runs out of one of its Limits.
+var ErrRenderLimitExceeded = errors.New("render limit exceeded")
+
+// Limits caps the resources a single render may use. A zero value disables the limit.
+type Limits struct {
+	// Timeout is the wall-clock time a render may take.
+	Timeout time.Duration
+	// MaxOutputBytes is the total size of everything a render produces. Every iteration of a go template range
+	// and every cost unit of a cel expression counts as a byte, so loops producing nothing are limited as well.
+	// It also caps the length of ranges built with until, untilStep and seq, of repeat and of random strings.
+	MaxOutputBytes int
+	// MaxDepth is the nesting of template actions, including calls of defined templates,
+	// and the stack depth of jsonnet. Recursive templates are always rejected.
+	MaxDepth int
+}
+
+// budget tracks what a single render has used so far.
+type budget struct {
+	limits   Limits
+	deadline time.Time
+	written  int64
+}
+
+func newBudget(limits Limits) *budget {
+	b := &budget{limits: limits}
+	if limits.Timeout > 0 {
+		b.deadline = time.Now().Add(limits.Timeout)
+	}
+	return b
+}
+
+func (b *budget) spend(n int) error {
+	written := atomic.AddInt64(&b.written, int64(n))
+	if b.limits.MaxOutputBytes > 0 && written > int64(b.limits.MaxOutputBytes) {
+		return fmt.Errorf("%w: output is larger than %d bytes", ErrRenderLimitExceeded, b.limits.MaxOutputBytes)
+	}
+	if !b.deadline.IsZero() && time.Now().After(b.deadline) {
+		return fmt.Errorf("%w: render took longer than %s", ErrRenderLimitExceeded, b.limits.Timeout)
+	}
+	return nil
+}
+
+// iteration is called at the start of every go template range iteration, see countIterations.
+func (b *budget) iteration() (string, error) {
+	return "", b.spend(1)
+}
+
+// context is cancelled at the deadline of the budget.
+func (b *budget) context() (context.Context, context.CancelFunc) {
+	if b.deadline.IsZero() {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithDeadline(context.Background(), b.deadline)
+}
+
+func (b *budget) timeoutError() error {
+	return fmt.Errorf("%w: render took longer than %s", ErrRenderLimitExceeded, b.limits.Timeout)
+}
+
+// limitedWriter fails go template execution as soon as the budget is spent,
+// which stops loops that keep producing output.
+type limitedWriter struct {
+	budget *budget
+	buf    []byte
+}
+
+func (w *limitedWriter) Write(p []byte) (int, error) {
+	if err := w.budget.spend(len(p)); err != nil {
+		return 0, err
+	}
+	w.buf = append(w.buf, p...)
+	return len(p), nil
+}
+
+func (w *limitedWriter) String() string {
+	return string(w.buf)
+}
+
+// withTimeout stops waiting for fn when the timeout passes. The engines stop on their own at the deadline
+// of their budget: go templates on their next write or range iteration, cel expressions are interrupted
+// and jsonnet and cue are evaluated in a child process that is killed, see evalWorker.
+func withTimeout(timeout time.Duration, fn func() (interface{}, error)) (interface{}, error) {
+	if timeout <= 0 {
+		return fn()
+	}
+	type result struct {
+		out interface{}
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				done <- result{err: fmt.Errorf("render panicked; %v", r)}
+			}
+		}()
+		out, err := fn()
+		done <- result{out: out, err: err}
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case r := <-done:
+		return r.out, r.err
+	case <-timer.C:
+		return nil, fmt.Errorf("%w: render took longer than %s", ErrRenderLimitExceeded, timeout)
+	}
+}
+
+// iterationFunc is called by the nodes countIterations adds to range loops. Functions are bound per render,
+// while parsed templates are cached and shared, see goTemplateRenderer.
+const iterationFunc = "_rangeIteration"
+
+// countIterations calls iterationFunc at the start of every range iteration of tpl. Go templates check
+// their budget only when they write, a range producing nothing would otherwise run past the deadline.
+func countIterations(tpl *template.Template) {
+	for _, t := range tpl.Templates() {
+		if t.Tree != nil {
+			countNodeIterations(t.Tree, t.Tree.Root)
+		}
+	}
+}
+
+func countNodeIterations(tree *parse.Tree, node parse.Node) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, child := range n.Nodes {
+			countNodeIterations(tree, child)
+		}
+	case *parse.IfNode:
+		countNodeIterations(tree, n.List)
+		countNodeIterations(tree, n.ElseList)
+	case *parse.WithNode:
+		countNodeIterations(tree, n.List)
+		countNodeIterations(tree, n.ElseList)
+	case *parse.RangeNode:
+		countNodeIterations(tree, n.List)
+		countNodeIterations(tree, n.ElseList)
+		call := &parse.CommandNode{NodeType: parse.NodeCommand, Pos: n.Pos,
+			Args: []parse.Node{parse.NewIdentifier(iterationFunc).SetTree(tree).SetPos(n.Pos)}}
+		action := &parse.ActionNode{NodeType: parse.NodeAction, Pos: n.Pos, Line: n.Line,
+			Pipe: &parse.PipeNode{NodeType: parse.NodePipe, Pos: n.Pos, Line: n.Line, Cmds: []*parse.CommandNode{call}}}
+		n.List.Nodes = append([]parse.Node{action}, n.List.Nodes...)
+	}
+}
+
+// evalRequest is sent to the child process evaluating the isolated expressions of a render, see evalWorker.
+type evalRequest struct {
+	Engine string                 `json:"engine"`
+	Expr   string                 `json:"expr"`
+	Params map[string]interface{} `json:"params"`
+	Limits Limits                 `json:"limits"`
+}
+
+type evalResponse struct {
+	Value interface{} `json:"value,omitempty"`
+	Error string      `json:"error,omitempty"`
+}
+
+// isolatedEvals are the evaluators that can not be interrupted.
+var isolatedEvals = map[string]func(expr string, params map[string]interface{}, b *budget) (interface{}, error){
+	JsonnetEngine: evalJsonnet,
+	CueEngine:     evalCue,
+}
+
+// evalWorker evaluates the jsonnet or cue expressions of a single render in one child process running
+// ServeEval when the budget has a deadline. The jsonnet and cue evaluators can not be interrupted:
+// a runaway expression evaluated in the manager would keep a CPU busy after the render timed out,
+// the child process is killed instead. It is started on the first expression and stopped by Close.
+type evalWorker struct {
+	engine string
+	budget *budget
+	cancel context.CancelFunc
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	in     *json.Encoder
+	out    *json.Decoder
+	stderr bytes.Buffer
+}
+
+func newEvalWorker(engine string, b *budget) *evalWorker {
+	return &evalWorker{engine: engine, budget: b}
+}
+
+func (w *evalWorker) eval(expr string, params map[string]interface{}, b *budget) (interface{}, error) {
+	if b.deadline.IsZero() {
+		return isolatedEvals[w.engine](expr, params, b)
+	}
+	if w.cmd == nil {
+		if err := w.start(); err != nil {
+			return nil, err
+		}
+	}
+	res := evalResponse{}
+	err := w.in.Encode(evalRequest{Engine: w.engine, Expr: expr, Params: params, Limits: b.limits})
+	if err == nil {
+		err = w.out.Decode(&res)
+	}
+	if err != nil {
+		_ = w.Close()
+		if !time.Now().Before(b.deadline) {
+			return nil, b.timeoutError()
+		}
+		return nil, fmt.Errorf("failed to evaluate %s; %s; %w", w.engine, w.stderr.String(), err)
+	}
+	if res.Error != "" {
+		return nil, errors.New(res.Error)
+	}
+	return res.Value, nil
+}
+
+func (w *evalWorker) start() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := w.budget.context()
+	cmd := exec.CommandContext(ctx, exe, "eval")
+	cmd.Stderr = &w.stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		cancel()
+		return fmt.Errorf("failed to start %s evaluation; %w", w.engine, err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		cancel()
+		return fmt.Errorf("failed to start %s evaluation; %w", w.engine, err)
+	}
+	if err := cmd.Start(); err != nil {
+		cancel()
+		return fmt.Errorf("failed to start %s evaluation; %w", w.engine, err)
+	}
+	w.cmd, w.cancel, w.stdin = cmd, cancel, stdin
+	w.in, w.out = json.NewEncoder(stdin), json.NewDecoder(stdout)
+	return nil
+}
+
+// Close stops the child process, it exits once its input is closed.
+func (w *evalWorker) Close() error {
+	if w.cmd == nil {
+		return nil
+	}
+	defer w.cancel()
+	_ = w.stdin.Close()
+	err := w.cmd.Wait()
+	w.cmd = nil
+	return err
+}
+
+// ServeEval evaluates the expressions sent by an evalWorker until its input is closed and returns
+// the exit code of the process. The manager runs it as its eval subcommand.
+func ServeEval(in io.Reader, out io.Writer) int {
+	dec := json.NewDecoder(in)
+	enc := json.NewEncoder(out)
+	for {
+		req := evalRequest{}
+		if err := dec.Decode(&req); err == io.EOF {
+			return 0
+		} else if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to parse request; %s\n", err)
+			return 1
+		}
+		eval, ok := isolatedEvals[req.Engine]
+		if !ok {
+			fmt.Fprintf(os.Stderr, "engine %q is not evaluated in a child process\n", req.Engine)
+			return 1
+		}
+		res := evalResponse{}
+		// the parent process enforces the timeout
+		req.Limits.Timeout = 0
+		val, err := eval(req.Expr, req.Params, newBudget(req.Limits))
+		if err != nil {
+			res.Error = err.Error()
+		}
+		res.Value = val
+		if err := enc.Encode(res); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to write result; %s\n", err)
+			return 1
+		}
+	}
+}
+
+// checkDepth rejects templates nested deeper than maxDepth and templates that call themselves.
+func checkDepth(tpl *template.Template, maxDepth int) error {
+	depths := make(map[string]int)
+	visiting := make(map[string]bool)
+
+	var templateDepth func(name string) (int, error)
+	var nodeDepth func(node parse.Node) (int, error)
+
+	templateDepth = func(name string) (int, error) {
+		if d, ok := depths[name]; ok {
+			return d, nil
+		}
+		if visiting[name] {
+			return 0, fmt.Errorf("%w: template %q is recursive", ErrRenderLimitExceeded, name)
+		}
+		t := tpl.Lookup(name)
+		if t == nil || t.Tree == nil {
+			return 0, nil
+		}
+		visiting[name] = true
+		d, err := nodeDepth(t.Tree.Root)
+		visiting[name] = false
+		if err != nil {
+			return 0, err
+		}
+		depths[name] = d
+		return d, nil
+	}
+
+	nodeDepth = func(node parse.Node) (int, error) {
+		var children []parse.Node
+		switch n := node.(type) {
+		case *parse.ListNode:
+			if n == nil {
+				return 0, nil
+			}
+			max := 0
+			for _, child := range n.Nodes {
+				d, err := nodeDepth(child)
+				if err != nil {
+					return 0, err
+				}
+				if d > max {
+					max = d
+				}
+			}
+			return max, nil
+		case *parse.IfNode:
+			children = []parse.Node{n.List, n.ElseList}
+		case *parse.RangeNode:
+			children = []parse.Node{n.List, n.ElseList}
+		case *parse.WithNode:
+			children = []parse.Node{n.List, n.ElseList}
+		case *parse.TemplateNode:
+			d, err := templateDepth(n.Name)
+			if err != nil {
+				return 0, err
+			}
+			return d + 1, nil
+		default:
+			return 0, nil
+		}
+		max := 0
+		for _, child := range children {
+			d, err := nodeDepth(child)
+			if err != nil {
+				return 0, err
+			}
+			if d > max {
+				max = d
+			}
+		}
+		return max + 1, nil
+	}
+
+	d, err := templateDepth(tpl.Name())
+	if err != nil {
+		return err
+	}
+	if maxDepth > 0 && d > maxDepth {
+		return fmt.Errorf("%w: template is nested %d levels deep, the limit is %d", ErrRenderLimitExceeded, d, maxDepth)
+	}
+	return nil
+}
+
+// limitLoops replaces the sprig functions that build their whole result before the template writes it,
+// the range builders, seq, repeat and the random strings, with ones that refuse to allocate more items
+// than the output limit allows. A render that timed out is abandoned and can not stop them otherwise.
+func limitLoops(funcs template.FuncMap, limits Limits) {
+	if limits.MaxOutputBytes <= 0 {
+		return
+	}
+	check := func(what string, n int) error {
+		if n > limits.MaxOutputBytes {
+			return fmt.Errorf("%w: %s of %d items is longer than %d", ErrRenderLimitExceeded, what, n, limits.MaxOutputBytes)
+		}
+		return nil
+	}
+	untilStep := func(start, stop, step int) ([]int, error) {
+		if err := check("range", rangeLength(start, stop, step)); err != nil {
+			return nil, err
+		}
+		var v []int
+		if step > 0 {
+			for i := start; i < stop; i += step {
+				v = append(v, i)
+			}
+		} else if step < 0 {
+			for i := start; i > stop; i += step {
+				v = append(v, i)
+			}
+		}
+		return v, nil
+	}
+	if _, ok := funcs["untilStep"]; ok {
+		funcs["untilStep"] = untilStep
+	}
+	if _, ok := funcs["until"]; ok {
+		funcs["until"] = func(count int) ([]int, error) {
+			if count < 0 {
+				return untilStep(0, count, -1)
+			}
+			return untilStep(0, count, 1)
+		}
+	}
+	if seq, ok := funcs["seq"].(func(...int) string); ok {
+		funcs["seq"] = func(params ...int) (string, error) {
+			if err := check("seq", seqLength(params...)); err != nil {
+				return "", err
+			}
+			return seq(params...), nil
+		}
+	}
+	if repeat, ok := funcs["repeat"].(func(int, string) string); ok {
+		funcs["repeat"] = func(count int, str string) (string, error) {
+			if len(str) > 0 && count > limits.MaxOutputBytes/len(str) {
+				return "", fmt.Errorf("%w: repeat of %d times %d bytes is longer than %d", ErrRenderLimitExceeded, count, len(str), limits.MaxOutputBytes)
+			}
+			return repeat(count, str), nil
+		}
+	}
+	for _, name := range []string{"randAlphaNum", "randAlpha", "randAscii", "randNumeric"} {
+		if random, ok := funcs[name].(func(int) string); ok {
+			funcs[name] = func(count int) (string, error) {
+				if err := check("random string", count); err != nil {
+					return "", err
+				}
+				return random(count), nil
+			}
+		}
+	}
+}
+
+// seqLength is the number of items sprig's seq returns for params.
+func seqLength(params ...int) int {
+	switch len(params) {
+	case 1:
+		if params[0] < 1 {
+			return rangeLength(1, params[0]-1, -1)
+		}
+		return rangeLength(1, params[0]+1, 1)
+	case 2:
+		if params[1] < params[0] {
+			return rangeLength(params[0], params[1]-1, -1)
+		}
+		return rangeLength(params[0], params[1]+1, 1)
+	case 3:
+		if params[2] < params[0] {
+			return rangeLength(params[0], params[2]-1, params[1])
+		}
+		return rangeLength(params[0], params[2]+1, params[1])
+	}
+	return 0
+}
+
+func rangeLength(start, stop, step int) int {
+	switch {
+	case step > 0 && stop > start:
+		return (stop - start + step - 1) / step
+	case step < 0 && stop < start:
+		return (start - stop - step - 1) / -step
+	}
+	return 0
+}
@@ -0,0 +1,183 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	k8s "github.com/GoogleCloudPlatform/k8s-config-connector/pkg/apis/k8s/v1alpha1"
+	pubsub "github.com/GoogleCloudPlatform/k8s-config-connector/pkg/apis/pubsub/v1beta1"
+	"github.com/Masterminds/sprig/v3"
+	api "github.com/slamdev/config-connector-templater/api/v1alpha1"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRenderLimits(t *testing.T) {
+	template := api.PubSubTopicTemplate{}
+	limits := Limits{Timeout: 100 * time.Millisecond, MaxOutputBytes: 1000, MaxDepth: 3}
+
+	tests := map[string]string{
+		"output":    `resourceID: {{ range until 500 }}xx{{ end }}`,
+		"loop":      `resourceID: {{ range until 100000000 }}{{ end }}`,
+		"timeout":   `resourceID: {{ range until 1000 }}{{ range until 1000 }}{{ range until 1000 }}{{ end }}{{ end }}{{ end }}`,
+		"depth":     `resourceID: {{ if true }}{{ if true }}{{ if true }}{{ if true }}x{{ end }}{{ end }}{{ end }}{{ end }}`,
+		"recursion": `{{ define "loop" }}{{ template "loop" . }}{{ end }}resourceID: {{ template "loop" . }}`,
+	}
+
+	for name, doc := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := RenderDocument(doc, template.Spec, template, RenderOptions{Limits: limits})
+			assert.True(t, errors.Is(err, ErrRenderLimitExceeded), "%v", err)
+		})
+	}
+
+	res, err := RenderDocument(`resourceID: {{ if true }}{{ range until 3 }}x{{ end }}{{ end }}`, template.Spec, template, RenderOptions{Limits: limits})
+	assert.NoError(t, err)
+	assert.NotNil(t, res)
+}
+
+func TestMain(m *testing.M) {
+	// the test binary evaluates the expressions isolated in a child process like the manager does
+	if len(os.Args) > 1 && os.Args[1] == "eval" {
+		os.Exit(ServeEval(os.Stdin, os.Stdout))
+	}
+	os.Exit(m.Run())
+}
+
+func TestRenderTimeoutStopsRender(t *testing.T) {
+	template := api.PubSubTopicTemplate{}
+	limits := Limits{Timeout: 100 * time.Millisecond}
+	list := "[" + strings.Repeat("0, ", 999) + "0]"
+
+	tests := map[string]struct {
+		engine string
+		doc    string
+	}{
+		"gotemplate": {GoTemplateEngine, `resourceID: {{ range until 1000 }}{{ range until 1000 }}{{ range until 1000 }}{{ end }}{{ end }}{{ end }}`},
+		"cel":        {CelEngine, fmt.Sprintf(`{"resourceID": string(size(%s.map(a, %s.map(b, %s.map(c, c)))))}`, list, list, list)},
+		"jsonnet":    {JsonnetEngine, `local f(n) = if n == 0 then 0 else f(n - 1) + f(n - 1); {resourceID: std.toString(f(40))}`},
+		"cue":        {CueEngine, fmt.Sprintf(`{resourceID: "\(len([for a in %s for b in %s for c in %s {c}]))"}`, list, list, list)},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			before := runtime.NumGoroutine()
+			start := time.Now()
+			_, err := RenderDocument(test.doc, template.Spec, template, RenderOptions{Engine: test.engine, Limits: limits})
+			assert.True(t, errors.Is(err, ErrRenderLimitExceeded), "%v", err)
+			assert.Less(t, int64(time.Since(start)), int64(time.Second))
+			// the render itself stops, not only the wait for it
+			for wait := time.Now().Add(time.Second); runtime.NumGoroutine() > before && time.Now().Before(wait); {
+				time.Sleep(10 * time.Millisecond)
+			}
+			assert.LessOrEqual(t, runtime.NumGoroutine(), before)
+		})
+	}
+}
+
+func TestEvalWorkerEvaluatesRenderInOneProcess(t *testing.T) {
+	template := api.PubSubTopicTemplate{ObjectMeta: metav1.ObjectMeta{Name: "orders", Namespace: "prod"}}
+	opts := RenderOptions{Engine: JsonnetEngine, Limits: Limits{Timeout: 5 * time.Second}}
+
+	leaf := `{{ metadata.namespace }}-{{ metadata.name }}`
+	spec := template.Spec
+	spec.ResourceID = &leaf
+	spec.KmsKeyRef = &k8s.ResourceRef{Name: leaf}
+	res, err := Render(spec, template, opts)
+	assert.NoError(t, err)
+	assert.Equal(t, "prod-orders", *res.(pubsub.PubSubTopicSpec).ResourceID)
+	assert.Equal(t, "prod-orders", res.(pubsub.PubSubTopicSpec).KmsKeyRef.Name)
+
+	worker := newEvalWorker(JsonnetEngine, newBudget(opts.Limits))
+	var pids []int
+	for i := 0; i < 3; i++ {
+		val, err := worker.eval(fmt.Sprintf("%d + 1", i), nil, worker.budget)
+		assert.NoError(t, err)
+		assert.Equal(t, float64(i+1), val)
+		pids = append(pids, worker.cmd.Process.Pid)
+	}
+	assert.Equal(t, []int{pids[0], pids[0], pids[0]}, pids)
+	assert.NoError(t, worker.Close())
+	assert.Nil(t, worker.cmd)
+}
+
+func TestAllocatingFunctionsLimited(t *testing.T) {
+	template := api.PubSubTopicTemplate{}
+	limits := Limits{Timeout: time.Second, MaxOutputBytes: 1000}
+
+	tests := map[string]string{
+		"repeat":       `resourceID: {{ repeat 1000000000 "x" | len }}`,
+		"repeat bytes": `resourceID: {{ repeat 400 "xyz" | len }}`,
+		"seq":          `resourceID: {{ seq 1000000000 | len }}`,
+		"seq step":     `resourceID: {{ seq 0 1 1000000000 | len }}`,
+		"randAlpha":    `resourceID: {{ randAlpha 1000000000 | len }}`,
+		"randAscii":    `resourceID: {{ randAscii 1000000000 | len }}`,
+		"randNumeric":  `resourceID: {{ randNumeric 1000000000 | len }}`,
+		"randAlphaNum": `resourceID: {{ randAlphaNum 1000000000 | len }}`,
+	}
+
+	for name, doc := range tests {
+		t.Run(name, func(t *testing.T) {
+			start := time.Now()
+			_, err := RenderDocument(doc, template.Spec, template, RenderOptions{Limits: limits})
+			assert.True(t, errors.Is(err, ErrRenderLimitExceeded), "%v", err)
+			assert.Less(t, int64(time.Since(start)), int64(100*time.Millisecond))
+		})
+	}
+
+	res, err := RenderDocument(`resourceID: "{{ repeat 3 "x" }}-{{ seq 3 }}-{{ randAlpha 3 | len }}"`, template.Spec, template, RenderOptions{Limits: limits})
+	assert.NoError(t, err)
+	assert.Equal(t, "xxx-1 2 3-3", *res.(pubsub.PubSubTopicSpec).ResourceID)
+}
+
+func TestSeqLength(t *testing.T) {
+	seq := sprig.TxtFuncMap()["seq"].(func(...int) string)
+	for _, params := range [][]int{{}, {0}, {1}, {5}, {-3}, {2, 6}, {6, 2}, {3, 3}, {1, 2, 10}, {10, -3, 1}, {10, 3, 1}, {1, -2, 10}, {0, 5, 4}} {
+		assert.Equal(t, len(strings.Fields(seq(params...))), seqLength(params...), "seq %v", params)
+	}
+}
+
+func TestRangeIterationsSpendBudget(t *testing.T) {
+	template := api.PubSubTopicTemplate{}
+	limits := Limits{MaxOutputBytes: 1000}
+
+	_, err := RenderDocument(`resourceID: {{ range until 1000 }}{{ range until 1000 }}{{ end }}{{ end }}x`, template.Spec, template, RenderOptions{Limits: limits})
+	assert.True(t, errors.Is(err, ErrRenderLimitExceeded), "%v", err)
+
+	res, err := RenderDocument(`resourceID: {{ range until 10 }}{{ range until 10 }}{{ end }}{{ end }}x`, template.Spec, template, RenderOptions{Limits: limits})
+	assert.NoError(t, err)
+	assert.Equal(t, "x", *res.(pubsub.PubSubTopicSpec).ResourceID)
+}
+
+func TestCelCostLimit(t *testing.T) {
+	template := api.PubSubTopicTemplate{}
+	list := "[" + strings.Repeat("0, ", 99) + "0]"
+	doc := fmt.Sprintf(`{"resourceID": string(size(%s.map(a, %s.map(b, b))))}`, list, list)
+
+	_, err := RenderDocument(doc, template.Spec, template, RenderOptions{Engine: CelEngine, Limits: Limits{MaxOutputBytes: 1000}})
+	assert.True(t, errors.Is(err, ErrRenderLimitExceeded), "%v", err)
+
+	res, err := RenderDocument(doc, template.Spec, template, RenderOptions{Engine: CelEngine, Limits: Limits{MaxOutputBytes: 1000000}})
+	assert.NoError(t, err)
+	assert.Equal(t, "100", *res.(pubsub.PubSubTopicSpec).ResourceID)
+}
@@ -0,0 +1,89 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"fmt"
+	"golang.org/x/time/rate"
+	"k8s.io/client-go/util/workqueue"
+	"sigs.k8s.io/controller-runtime/pkg/ratelimiter"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AllKinds is the MaxConcurrentReconciles key applying to template kinds without their own entry.
+const AllKinds = "*"
+
+// RateLimiterOptions configures the workqueue rate limiter of every template controller.
+// Zero values fall back to the controller-runtime defaults.
+type RateLimiterOptions struct {
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	QPS       int
+	Burst     int
+}
+
+// NewRateLimiter combines a per-template exponential backoff with an overall token bucket,
+// like the controller-runtime default does.
+func NewRateLimiter(opts RateLimiterOptions) ratelimiter.RateLimiter {
+	if opts.BaseDelay <= 0 {
+		opts.BaseDelay = 5 * time.Millisecond
+	}
+	if opts.MaxDelay <= 0 {
+		opts.MaxDelay = 1000 * time.Second
+	}
+	if opts.QPS <= 0 {
+		opts.QPS = 10
+	}
+	if opts.Burst <= 0 {
+		opts.Burst = 100
+	}
+	return workqueue.NewMaxOfRateLimiter(
+		workqueue.NewItemExponentialFailureRateLimiter(opts.BaseDelay, opts.MaxDelay),
+		&workqueue.BucketRateLimiter{Limiter: rate.NewLimiter(rate.Limit(opts.QPS), opts.Burst)},
+	)
+}
+
+// ParseConcurrency parses a comma separated list of Kind=count pairs. A bare count applies to all kinds.
+func ParseConcurrency(str string) (map[string]int, error) {
+	res := make(map[string]int)
+	for _, item := range strings.Split(str, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		kind, count := AllKinds, item
+		if i := strings.Index(item, "="); i >= 0 {
+			kind, count = strings.TrimSpace(item[:i]), strings.TrimSpace(item[i+1:])
+		}
+		n, err := strconv.Atoi(count)
+		if err != nil || n <= 0 || kind == "" {
+			return nil, fmt.Errorf("invalid concurrency %q, expected Kind=count or count", item)
+		}
+		res[kind] = n
+	}
+	return res, nil
+}
+
+// Concurrency looks up the number of parallel reconciles for kind, 0 means the controller default.
+func Concurrency(counts map[string]int, kind string) int {
+	if n, ok := counts[kind]; ok {
+		return n
+	}
+	return counts[AllKinds]
+}
@@ -0,0 +1,49 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestParseConcurrency(t *testing.T) {
+	counts, err := ParseConcurrency("4, PubSubTopicTemplate=8")
+	assert.NoError(t, err)
+	assert.Equal(t, 8, Concurrency(counts, "PubSubTopicTemplate"))
+	assert.Equal(t, 4, Concurrency(counts, "PubSubSubscriptionTemplate"))
+
+	counts, err = ParseConcurrency("")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, Concurrency(counts, "PubSubTopicTemplate"))
+
+	_, err = ParseConcurrency("PubSubTopicTemplate=zero")
+	assert.Error(t, err)
+	_, err = ParseConcurrency("=2")
+	assert.Error(t, err)
+}
+
+func TestNewRateLimiter(t *testing.T) {
+	limiter := NewRateLimiter(RateLimiterOptions{BaseDelay: time.Second, MaxDelay: 4 * time.Second})
+	assert.Equal(t, time.Second, limiter.When("a"))
+	assert.Equal(t, 2*time.Second, limiter.When("a"))
+	assert.Equal(t, 4*time.Second, limiter.When("a"))
+	assert.Equal(t, 4*time.Second, limiter.When("a"))
+	limiter.Forget("a")
+	assert.Equal(t, time.Second, limiter.When("a"))
+}
@@ -0,0 +1,141 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"context"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"strings"
+)
+
+const (
+	// AnnotationPrefix is shared by all annotations that configure the templater itself.
+	// Such annotations are never propagated to the rendered resource.
+	AnnotationPrefix = "templater.slamdev.net/"
+
+	// TemplateAnnotation switches a template to whole-document mode: its value is a raw
+	// YAML document that is rendered as text and decoded into the target spec,
+	// the template's own spec is ignored.
+	TemplateAnnotation = AnnotationPrefix + "template"
+
+	// EngineAnnotation selects the expression language of the template:
+	// gotemplate (default), cel, jsonnet or cue.
+	EngineAnnotation = AnnotationPrefix + "engine"
+
+	// AllowedFunctionsAnnotation on a namespace restricts the functions that go templates
+	// in that namespace may call to a comma separated list. It narrows the cluster-wide
+	// allow-list and can not extend it.
+	AllowedFunctionsAnnotation = AnnotationPrefix + "allowed-functions"
+
+	// TargetNameAnnotation overrides the name of the rendered resource. It is rendered
+	// like a string field of the spec and defaults to the name of the template.
+	TargetNameAnnotation = AnnotationPrefix + "target-name"
+
+	// AdoptionPolicyAnnotation decides what happens when the rendered resource already exists
+	// without an owner: Never (default) leaves it alone, IfUnowned adopts it only when its spec
+	// matches the render and Force adopts it and overwrites its spec.
+	AdoptionPolicyAnnotation = AnnotationPrefix + "adoption-policy"
+
+	// PausedAnnotation set to "true" on a template or a namespace suspends creating and updating
+	// the rendered resources, status and drift are still reported.
+	PausedAnnotation = AnnotationPrefix + "paused"
+
+	// ClassAnnotation assigns a template to the templater installation started with the same --class,
+	// templates without it belong to the installation without a class.
+	ClassAnnotation = AnnotationPrefix + "class"
+
+	// RollbackToAnnotation pins the target to the spec of a previous revision, see RevisionTemplateLabel.
+	RollbackToAnnotation = AnnotationPrefix + "rollback-to"
+
+	// AutoRollbackWindowAnnotation enables rolling the target back to the newest known-good revision
+	// when KCC reports UpdateFailed within the given duration after a change, e.g. 10m.
+	AutoRollbackWindowAnnotation = AnnotationPrefix + "auto-rollback-window"
+
+	// AppliedRevisionAnnotation, AppliedAtAnnotation and FailedInputsHashAnnotation are set on the
+	// target to track the revision applied last, when it was applied and the render that failed.
+	AppliedRevisionAnnotation  = AnnotationPrefix + "revision"
+	AppliedAtAnnotation        = AnnotationPrefix + "applied-at"
+	FailedInputsHashAnnotation = AnnotationPrefix + "failed-inputs-hash"
+
+	// KnownGoodAnnotation marks revisions KCC applied successfully.
+	KnownGoodAnnotation = AnnotationPrefix + "known-good"
+
+	// DependsOnAnnotation lists the templates in the same namespace, as Kind/name, that must be Ready
+	// before the target of the template is created.
+	DependsOnAnnotation = AnnotationPrefix + "depends-on"
+
+	// TargetClusterAnnotation names a Secret in the namespace of the template holding, under the kubeconfig key,
+	// the kubeconfig of the remote cluster the target is rendered into.
+	TargetClusterAnnotation = AnnotationPrefix + "target-cluster"
+
+	// TargetNamespaceAnnotation names the namespace of the rendered resource. Owner references can not cross
+	// namespaces, so it has to be the namespace of the template, see v1alpha2 spec.target.namespace.
+	TargetNamespaceAnnotation = AnnotationPrefix + "target-namespace"
+
+	// ValuesAnnotation holds a JSON object exposed to templates as values.
+	ValuesAnnotation = AnnotationPrefix + "values"
+
+	// InputsHashAnnotation is set on rendered resources to the hash of all inputs of their render.
+	InputsHashAnnotation = AnnotationPrefix + "inputs-hash"
+)
+
+const (
+	AdoptNever     = "Never"
+	AdoptIfUnowned = "IfUnowned"
+	AdoptForce     = "Force"
+)
+
+func renderOptions(ctx context.Context, cli CliCli, cfg Config, src client.Object) (RenderOptions, error) {
+	engine, _ := getAnnotation(src, EngineAnnotation)
+	opts := RenderOptions{Engine: engine, Functions: cfg.AllowedFunctions, Limits: cfg.Limits}
+
+	ns := &corev1.Namespace{}
+	if err := cli.Get(ctx, client.ObjectKey{Name: src.GetNamespace()}, ns); err != nil {
+		return opts, fmt.Errorf("failed to get namespace; %w", err)
+	}
+	if list, ok := getAnnotation(ns, AllowedFunctionsAnnotation); ok {
+		opts.Functions = intersectFunctions(opts.Functions, ParseList(list))
+	}
+
+	optsKey, err := inputsHash(nil, opts)
+	if err != nil {
+		return opts, err
+	}
+	opts.parsed = cfg.Cache.parsedTemplates(src.GetUID(), src.GetGeneration(), optsKey)
+
+	return opts, nil
+}
+
+func getAnnotation(obj client.Object, key string) (string, bool) {
+	v, ok := obj.GetAnnotations()[key]
+	return strings.TrimSpace(v), ok
+}
+
+func setAnnotation(obj client.Object, key string, value string) {
+	annotations := obj.GetAnnotations()
+	if annotations == nil {
+		annotations = make(map[string]string)
+	}
+	annotations[key] = value
+	obj.SetAnnotations(annotations)
+}
+
+func isTemplaterKey(key string) bool {
+	return strings.HasPrefix(key, AnnotationPrefix)
+}
@@ -0,0 +1,113 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"context"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"reflect"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"strconv"
+	"strings"
+)
+
+const (
+	// PausedCondition reports whether changes to the target are suspended.
+	PausedCondition = "Paused"
+
+	TemplatePausedReason  = "TemplatePaused"
+	NamespacePausedReason = "NamespacePaused"
+	ManagerPausedReason   = "ManagerPaused"
+	ResumedReason         = "Resumed"
+)
+
+// PauseReason tells why reconciliation of src is paused, an empty string means it is not.
+func PauseReason(ctx context.Context, cli CliCli, cfg Config, src client.Object) (string, error) {
+	if cfg.Paused {
+		return ManagerPausedReason, nil
+	}
+	if isPaused(src) {
+		return TemplatePausedReason, nil
+	}
+	ns := &corev1.Namespace{}
+	if err := cli.Get(ctx, client.ObjectKey{Name: src.GetNamespace()}, ns); err != nil {
+		return "", fmt.Errorf("failed to get namespace; %w", err)
+	}
+	if isPaused(ns) {
+		return NamespacePausedReason, nil
+	}
+	return "", nil
+}
+
+// ReportPaused sets the Paused condition of src with the drift between the rendered spec and
+// target without changing target. A nil target means it does not exist yet.
+func ReportPaused(ctx context.Context, cli CliCli, cfg Config, src client.Object, target client.Object, reason string, name string) error {
+	opts, hash, err := renderInputs(ctx, cli, cfg, src)
+	if err != nil {
+		return err
+	}
+
+	var msg string
+	if target == nil {
+		msg = fmt.Sprintf("%s/%s does not exist and will be created on resume", src.GetNamespace(), name)
+	} else {
+		rendered := reflect.New(reflect.TypeOf(target).Elem()).Interface().(client.Object)
+		if err := createTemplatedResource(ctx, cli, cfg, src, rendered, opts, hash); err != nil {
+			return err
+		}
+		diffs, err := diffSpecs(getSpec(target), getSpec(rendered))
+		if err != nil {
+			return fmt.Errorf("failed to compare specs; %w", err)
+		}
+		if len(diffs) > 0 {
+			msg = fmt.Sprintf("fields to change on resume: %s", strings.Join(diffPaths(diffs), ", "))
+		} else {
+			msg = "target is in sync"
+		}
+	}
+
+	return updateCondition(ctx, cli, src, metav1.Condition{
+		Type:    PausedCondition,
+		Status:  metav1.ConditionTrue,
+		Reason:  reason,
+		Message: msg,
+	})
+}
+
+// clearPaused resolves a previously reported pause in memory and reports whether anything changed.
+func clearPaused(src client.Object) bool {
+	if meta.FindStatusCondition(*getConditions(src), PausedCondition) == nil {
+		return false
+	}
+	return setCondition(src, metav1.Condition{
+		Type:   PausedCondition,
+		Status: metav1.ConditionFalse,
+		Reason: ResumedReason,
+	})
+}
+
+func isPaused(obj client.Object) bool {
+	v, ok := getAnnotation(obj, PausedAnnotation)
+	if !ok {
+		return false
+	}
+	paused, err := strconv.ParseBool(v)
+	return err == nil && paused
+}
@@ -0,0 +1,48 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	api "github.com/slamdev/config-connector-templater/api/v1alpha1"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"testing"
+)
+
+func TestIsPaused(t *testing.T) {
+	template := &api.PubSubTopicTemplate{}
+	assert.False(t, isPaused(template))
+
+	template.Annotations = map[string]string{PausedAnnotation: " true "}
+	assert.True(t, isPaused(template))
+
+	template.Annotations[PausedAnnotation] = "false"
+	assert.False(t, isPaused(template))
+
+	template.Annotations[PausedAnnotation] = "yes"
+	assert.False(t, isPaused(template))
+}
+
+func TestClearPaused(t *testing.T) {
+	template := &api.PubSubTopicTemplate{ObjectMeta: metav1.ObjectMeta{Generation: 1}}
+	assert.False(t, clearPaused(template))
+
+	setCondition(template, metav1.Condition{Type: PausedCondition, Status: metav1.ConditionTrue, Reason: TemplatePausedReason})
+	assert.True(t, clearPaused(template))
+	assert.Equal(t, metav1.ConditionFalse, template.Status.Conditions[0].Status)
+	assert.False(t, clearPaused(template))
+}
@@ -0,0 +1,185 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	api "github.com/slamdev/config-connector-templater/api/v1alpha1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"reflect"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sort"
+	"strings"
+)
+
+const (
+	// CompliantCondition reports whether the rendered resource satisfies the TemplatePolicies.
+	CompliantCondition = "Compliant"
+
+	PolicyViolatedReason    = "PolicyViolated"
+	PoliciesSatisfiedReason = "PoliciesSatisfied"
+)
+
+// ErrPolicyViolated is returned when the rendered resource violates a TemplatePolicy,
+// retrying does not help until the template or the policy changes.
+var ErrPolicyViolated = errors.New("policy violated")
+
+// templatePolicies lists the TemplatePolicies applying to the given target kind sorted by name.
+func templatePolicies(ctx context.Context, cli CliCli, kind string) ([]api.TemplatePolicy, error) {
+	list := &api.TemplatePolicyList{}
+	if err := cli.List(ctx, list); err != nil {
+		return nil, fmt.Errorf("failed to list template policies; %w", err)
+	}
+	sort.Slice(list.Items, func(i, j int) bool { return list.Items[i].Name < list.Items[j].Name })
+	var out []api.TemplatePolicy
+	for _, p := range list.Items {
+		if len(p.Spec.Kinds) == 0 || contains(p.Spec.Kinds, kind) {
+			out = append(out, p)
+		}
+	}
+	return out, nil
+}
+
+// Violations evaluates the rules of the policies against the rendered target. Rules that fail to
+// evaluate or do not return a bool are violated too.
+func Violations(target client.Object, kind string, policies []api.TemplatePolicy) ([]api.PolicyViolation, error) {
+	object, err := templateParams(target)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse rendered resource; %w", err)
+	}
+	object["kind"] = kind
+	params := map[string]interface{}{"object": object}
+	var violations []api.PolicyViolation
+	for _, p := range policies {
+		for _, rule := range p.Spec.Rules {
+			msg := rule.Message
+			if msg == "" {
+				msg = rule.Expression
+			}
+			res, err := evalCel(rule.Expression, params, newBudget(Limits{}))
+			if err != nil {
+				msg = err.Error()
+			} else if ok, isBool := res.(bool); !isBool {
+				msg = fmt.Sprintf("rule returned %T, expected bool", res)
+			} else if ok {
+				continue
+			}
+			violations = append(violations, api.PolicyViolation{Policy: p.Name, Rule: rule.Name, Message: msg})
+		}
+	}
+	return violations, nil
+}
+
+// CheckPolicies renders src into target without reporting anything on src and returns the policy violations.
+func CheckPolicies(ctx context.Context, cli CliCli, cfg Config, src client.Object, target client.Object) ([]api.PolicyViolation, error) {
+	cli = dryRun{cli}
+	opts, hash, err := renderInputs(ctx, cli, cfg, src)
+	if err != nil {
+		return nil, err
+	}
+	if len(opts.policies) == 0 {
+		return nil, nil
+	}
+	if err := createTemplatedResource(ctx, cli, cfg, src, target, opts, hash); err != nil {
+		return nil, err
+	}
+	return Violations(target, targetKind(cli, src), opts.policies)
+}
+
+// enforcePolicies reports the policy violations of the rendered target on src and fails with ErrPolicyViolated.
+func enforcePolicies(ctx context.Context, cli CliCli, src client.Object, target client.Object, opts RenderOptions) error {
+	violations, err := Violations(target, targetKind(cli, src), opts.policies)
+	if err != nil {
+		return err
+	}
+	if len(violations) == 0 {
+		return nil
+	}
+	setViolations(src, violations)
+	var rules []string
+	for _, v := range violations {
+		rules = append(rules, v.Policy+"/"+v.Rule)
+	}
+	setCondition(src, metav1.Condition{
+		Type:    CompliantCondition,
+		Status:  metav1.ConditionFalse,
+		Reason:  PolicyViolatedReason,
+		Message: "violated " + strings.Join(rules, ", "),
+	})
+	if err := cli.Status().Update(ctx, src); err != nil {
+		return fmt.Errorf("failed to report policy violations; %w", err)
+	}
+	return fmt.Errorf("%w: %s", ErrPolicyViolated, strings.Join(rules, ", "))
+}
+
+// clearViolations marks src compliant in memory if it was not and reports whether anything changed.
+func clearViolations(src client.Object) bool {
+	if meta.FindStatusCondition(*getConditions(src), CompliantCondition) == nil {
+		return false
+	}
+	changed := len(getViolations(src)) > 0
+	setViolations(src, nil)
+	if setCondition(src, metav1.Condition{
+		Type:   CompliantCondition,
+		Status: metav1.ConditionTrue,
+		Reason: PoliciesSatisfiedReason,
+	}) {
+		changed = true
+	}
+	return changed
+}
+
+func setViolations(src client.Object, violations []api.PolicyViolation) {
+	v := reflect.ValueOf(src).Elem().FieldByName("Status").FieldByName("Violations")
+	v.Set(reflect.ValueOf(violations))
+}
+
+func getViolations(src client.Object) []api.PolicyViolation {
+	v := reflect.ValueOf(src).Elem().FieldByName("Status").FieldByName("Violations")
+	return v.Interface().([]api.PolicyViolation)
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// dryRun discards status updates, so templates can be rendered before they are stored.
+type dryRun struct {
+	CliCli
+}
+
+func (dryRun) Status() client.StatusWriter {
+	return dryRunStatus{}
+}
+
+type dryRunStatus struct{}
+
+func (dryRunStatus) Update(context.Context, client.Object, ...client.UpdateOption) error {
+	return nil
+}
+
+func (dryRunStatus) Patch(context.Context, client.Object, client.Patch, ...client.PatchOption) error {
+	return nil
+}
@@ -0,0 +1,112 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"context"
+	"errors"
+	pubsub "github.com/GoogleCloudPlatform/k8s-config-connector/pkg/apis/pubsub/v1beta1"
+	api "github.com/slamdev/config-connector-templater/api/v1alpha1"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"testing"
+)
+
+func TestViolations(t *testing.T) {
+	resourceID := "team1.orders"
+	target := &pubsub.PubSubTopic{ObjectMeta: metav1.ObjectMeta{Name: "orders", Namespace: "team1", Labels: map[string]string{"cost-center": "42"}}}
+	target.Spec.ResourceID = &resourceID
+	target.Spec.MessageStoragePolicy = &pubsub.TopicMessageStoragePolicy{AllowedPersistenceRegions: []string{"europe-west1", "us-east1"}}
+	policies := []api.TemplatePolicy{{
+		ObjectMeta: metav1.ObjectMeta{Name: "platform"},
+		Spec: api.TemplatePolicySpec{Rules: []api.PolicyRule{
+			{Name: "prefix", Expression: "object.spec.resourceID.startsWith(object.metadata.namespace + '.')"},
+			{Name: "cost-center", Expression: "'cost-center' in object.metadata.labels"},
+			{Name: "regions", Expression: "object.spec.messageStoragePolicy.allowedPersistenceRegions.all(r, r.startsWith('europe-'))", Message: "EU regions only"},
+			{Name: "kind", Expression: "object.kind == 'PubSubTopic'"},
+			{Name: "not-bool", Expression: "object.metadata.name"},
+			{Name: "missing", Expression: "object.spec.kmsKeyRef.name == 'key'"},
+		}},
+	}}
+	violations, err := Violations(target, "PubSubTopic", policies)
+	assert.NoError(t, err)
+	assert.Len(t, violations, 3)
+	assert.Equal(t, api.PolicyViolation{Policy: "platform", Rule: "regions", Message: "EU regions only"}, violations[0])
+	assert.Equal(t, "not-bool", violations[1].Rule)
+	assert.Contains(t, violations[1].Message, "expected bool")
+	assert.Equal(t, "missing", violations[2].Rule)
+	assert.Contains(t, violations[2].Message, "no such key")
+}
+
+func TestEnforcePolicies(t *testing.T) {
+	ctx := context.Background()
+	policy := &api.TemplatePolicy{ObjectMeta: metav1.ObjectMeta{Name: "platform"}}
+	policy.Spec.Rules = []api.PolicyRule{{Name: "prefix", Expression: "object.spec.resourceID.startsWith(object.metadata.namespace + '.')"}}
+	ignored := &api.TemplatePolicy{ObjectMeta: metav1.ObjectMeta{Name: "subscriptions"}}
+	ignored.Spec.Kinds = []string{"PubSubSubscription"}
+	ignored.Spec.Rules = []api.PolicyRule{{Name: "never", Expression: "false"}}
+	resourceID := "orders"
+	template := &api.PubSubTopicTemplate{ObjectMeta: metav1.ObjectMeta{Name: "orders", Namespace: "team1"}}
+	template.Spec.ResourceID = &resourceID
+	cli := newFakeCli(policy, ignored, template, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team1"}})
+
+	violations, err := CheckPolicies(ctx, cli, Config{}, template, &pubsub.PubSubTopic{})
+	assert.NoError(t, err)
+	assert.Len(t, violations, 1)
+
+	err = CreateTargetResource(ctx, cli, Config{}, template, &pubsub.PubSubTopic{})
+	assert.True(t, errors.Is(err, ErrPolicyViolated))
+	assert.NoError(t, cli.Get(ctx, client.ObjectKeyFromObject(template), template))
+	assert.Equal(t, []api.PolicyViolation{{Policy: "platform", Rule: "prefix", Message: policy.Spec.Rules[0].Expression}}, template.Status.Violations)
+	assert.True(t, meta.IsStatusConditionFalse(template.Status.Conditions, CompliantCondition))
+	assert.Error(t, cli.Get(ctx, client.ObjectKey{Namespace: "team1", Name: "orders"}, &pubsub.PubSubTopic{}))
+
+	resourceID = "{{ .metadata.namespace }}.orders"
+	template.Spec.ResourceID = &resourceID
+	assert.NoError(t, cli.Update(ctx, template))
+	assert.NoError(t, CreateTargetResource(ctx, cli, Config{}, template, &pubsub.PubSubTopic{}))
+	assert.True(t, clearViolations(template))
+	assert.Empty(t, template.Status.Violations)
+	assert.True(t, meta.IsStatusConditionTrue(template.Status.Conditions, CompliantCondition))
+}
+
+func TestTemplatePolicySharded(t *testing.T) {
+	ctx := context.Background()
+	var objs []client.Object
+	for _, ns := range []string{"team1", "team2", "team3", "team4", "team5", "team6"} {
+		objs = append(objs, &api.PubSubTopicTemplate{ObjectMeta: metav1.ObjectMeta{Name: "orders", Namespace: ns}})
+	}
+	cli := newFakeCli(objs...)
+	policy := &api.TemplatePolicy{ObjectMeta: metav1.ObjectMeta{Name: "platform"}}
+
+	// a policy reaches every replica, each one re-checks the templates of its own shard
+	seen := make(map[types.NamespacedName]bool)
+	for id := 0; id < 3; id++ {
+		sharding := Sharding{Shards: 3, ID: id}
+		names, err := sharding.TemplatesIn(ctx, cli, &api.PubSubTopicTemplate{}, policy)
+		assert.NoError(t, err)
+		for _, name := range names {
+			assert.Equal(t, id, ShardOf(&api.PubSubTopicTemplate{ObjectMeta: metav1.ObjectMeta{Name: name.Name, Namespace: name.Namespace}}, 3))
+			seen[name] = true
+		}
+	}
+	assert.Len(t, seen, len(objs))
+}
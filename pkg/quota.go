@@ -0,0 +1,300 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"context"
+	"fmt"
+	api "github.com/slamdev/config-connector-templater/api/v1alpha1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+	"sort"
+	"time"
+)
+
+const (
+	// QuotaExceededCondition reports whether creating the target is blocked by a TemplateQuota.
+	QuotaExceededCondition = "QuotaExceeded"
+
+	QuotaExceededReason = "QuotaExceeded"
+	WithinQuotaReason   = "WithinQuota"
+)
+
+// quotaReservationTTL is how long a reservation charges a quota while its resource does not exist,
+// a create that failed without releasing it is long over by then.
+const quotaReservationTTL = time.Minute
+
+// Quotas reads the TemplateQuotas and counts the rendered resources in the local cluster bypassing the cache,
+// which lags behind the reservations and creates of other reconciles.
+type Quotas struct {
+	reader client.Reader
+}
+
+// NewQuotas reads with reader, e.g. the API reader of the manager.
+func NewQuotas(reader client.Reader) *Quotas {
+	return &Quotas{reader: reader}
+}
+
+// quotaReader reads the quotas bypassing the cache when cfg allows, quotas are always local.
+func quotaReader(cli CliCli, cfg Config) client.Reader {
+	if cfg.Quotas != nil && cfg.Quotas.reader != nil {
+		return cfg.Quotas.reader
+	}
+	return cli
+}
+
+// renderedReader counts the rendered resources of src bypassing the cache when they are local.
+func renderedReader(cli CliCli, cfg Config, src client.Object) client.Reader {
+	if IsExternal(cfg, src) {
+		return cli
+	}
+	return quotaReader(cli, cfg)
+}
+
+// CreateWithinQuota creates the target of src like CreateTargetResource unless that would exceed a TemplateQuota
+// in the namespace of src. Every quota limiting the kind of target is charged for it first, see reserveQuota,
+// so replicas and installations reconciling the namespace can not take the same slot. The reservations
+// are released when the create fails.
+func CreateWithinQuota(ctx context.Context, cli CliCli, cfg Config, src client.Object, target client.Object) (bool, error) {
+	list := &api.TemplateQuotaList{}
+	if err := cli.List(ctx, list, client.InNamespace(src.GetNamespace())); err != nil {
+		return false, fmt.Errorf("failed to list template quotas; %w", err)
+	}
+	sort.Slice(list.Items, func(i, j int) bool { return list.Items[i].Name < list.Items[j].Name })
+	kind := kindOf(cli, target)
+	var reserved []string
+	for _, q := range list.Items {
+		if _, ok := q.Spec.Hard[kind]; !ok {
+			continue
+		}
+		exceeded, err := reserveQuota(ctx, cli, cfg, src, target, q.Name)
+		if err != nil || exceeded {
+			releaseQuotas(ctx, cli, cfg, src, reserved)
+			return exceeded, err
+		}
+		reserved = append(reserved, q.Name)
+	}
+	if err := CreateTargetResource(ctx, cli, cfg, src, target); err != nil {
+		releaseQuotas(ctx, cli, cfg, src, reserved)
+		return false, err
+	}
+	return false, nil
+}
+
+// reserveQuota adds a reservation for the target of src to the quota with an update guarded by its
+// resourceVersion: concurrent reservations conflict and count again. It reports whether the quota is exceeded.
+func reserveQuota(ctx context.Context, cli CliCli, cfg Config, src client.Object, target client.Object, name string) (bool, error) {
+	kind := kindOf(cli, target)
+	exceeded := false
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		exceeded = false
+		quota := &api.TemplateQuota{}
+		if err := quotaReader(cli, cfg).Get(ctx, types.NamespacedName{Namespace: src.GetNamespace(), Name: name}, quota); err != nil {
+			if errors.IsNotFound(err) {
+				return nil
+			}
+			return fmt.Errorf("failed to get template quota; %w", err)
+		}
+		hard, ok := quota.Spec.Hard[kind]
+		if !ok {
+			return nil
+		}
+		used, owners, err := countRendered(ctx, renderedReader(cli, cfg, src), cli.GetScheme(), src.GetNamespace(), target)
+		if err != nil {
+			return err
+		}
+		reservations := pendingReservations(quota.Status.Reserved, owners, src.GetUID())
+		used += countReservations(reservations, kind)
+		if used >= hard {
+			exceeded = true
+			return reportQuotaExceeded(ctx, cli, src, quota.Name, hard, kind, used)
+		}
+		quota.Status.Reserved = append(reservations, api.TemplateQuotaReservation{
+			Kind: kind, Template: src.GetName(), UID: src.GetUID(), Time: metav1.Now()})
+		return cli.Status().Update(ctx, quota)
+	})
+	if err != nil && !exceeded {
+		return false, fmt.Errorf("failed to reserve template quota; %w", err)
+	}
+	return exceeded, err
+}
+
+// releaseQuotas drops the reservations of src from the quotas. Reservations that can not be dropped
+// expire, the create they guarded failed anyway.
+func releaseQuotas(ctx context.Context, cli CliCli, cfg Config, src client.Object, names []string) {
+	for _, name := range names {
+		_ = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+			quota := &api.TemplateQuota{}
+			if err := quotaReader(cli, cfg).Get(ctx, types.NamespacedName{Namespace: src.GetNamespace(), Name: name}, quota); err != nil {
+				return client.IgnoreNotFound(err)
+			}
+			var reservations []api.TemplateQuotaReservation
+			for _, r := range quota.Status.Reserved {
+				if r.UID != src.GetUID() {
+					reservations = append(reservations, r)
+				}
+			}
+			quota.Status.Reserved = reservations
+			return cli.Status().Update(ctx, quota)
+		})
+	}
+}
+
+// pendingReservations drops the reservations settled by a rendered resource controlled by one of owners,
+// the expired ones and the one of the template with uid.
+func pendingReservations(reservations []api.TemplateQuotaReservation, owners map[types.UID]bool, uid types.UID) []api.TemplateQuotaReservation {
+	var pending []api.TemplateQuotaReservation
+	for _, r := range reservations {
+		if owners[r.UID] || r.UID == uid || time.Since(r.Time.Time) > quotaReservationTTL {
+			continue
+		}
+		pending = append(pending, r)
+	}
+	return pending
+}
+
+func countReservations(reservations []api.TemplateQuotaReservation, kind string) int {
+	n := 0
+	for _, r := range reservations {
+		if r.Kind == kind {
+			n++
+		}
+	}
+	return n
+}
+
+// CheckQuota reports whether creating the target of src would exceed a TemplateQuota in the namespace of src
+// and sets the QuotaExceeded condition accordingly. The reservations of other templates count as used.
+func CheckQuota(ctx context.Context, cli CliCli, cfg Config, src client.Object, target client.Object) (bool, error) {
+	list := &api.TemplateQuotaList{}
+	if err := cli.List(ctx, list, client.InNamespace(src.GetNamespace())); err != nil {
+		return false, fmt.Errorf("failed to list template quotas; %w", err)
+	}
+	sort.Slice(list.Items, func(i, j int) bool { return list.Items[i].Name < list.Items[j].Name })
+	kind := kindOf(cli, target)
+	var owners map[types.UID]bool
+	count := -1
+	for _, q := range list.Items {
+		hard, ok := q.Spec.Hard[kind]
+		if !ok {
+			continue
+		}
+		if count < 0 {
+			var err error
+			if count, owners, err = countRendered(ctx, renderedReader(cli, cfg, src), cli.GetScheme(), src.GetNamespace(), target); err != nil {
+				return false, err
+			}
+		}
+		used := count + countReservations(pendingReservations(q.Status.Reserved, owners, src.GetUID()), kind)
+		if used < hard {
+			continue
+		}
+		return true, reportQuotaExceeded(ctx, cli, src, q.Name, hard, kind, used)
+	}
+	return false, nil
+}
+
+func reportQuotaExceeded(ctx context.Context, cli CliCli, src client.Object, quota string, hard int, kind string, used int) error {
+	err := updateCondition(ctx, cli, src, metav1.Condition{
+		Type:    QuotaExceededCondition,
+		Status:  metav1.ConditionTrue,
+		Reason:  QuotaExceededReason,
+		Message: fmt.Sprintf("%s allows %d %s in %s, %d used", quota, hard, kind, src.GetNamespace(), used),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to report exceeded quota; %w", err)
+	}
+	return nil
+}
+
+// QuotaUsage counts the resources of the type of target in the namespace rendered by templates.
+func QuotaUsage(ctx context.Context, cli CliCli, namespace string, target client.Object) (int, error) {
+	used, _, err := countRendered(ctx, cli, cli.GetScheme(), namespace, target)
+	return used, err
+}
+
+// SettleReservations drops the reservations of quota settled by a resource of renderTypes, keyed by kind,
+// and the expired ones. It reports whether reservations are left, they expire within quotaReservationTTL.
+func SettleReservations(ctx context.Context, cli CliCli, quota *api.TemplateQuota, renderTypes map[string]client.Object) (bool, error) {
+	owners := make(map[types.UID]bool)
+	for kind, renderType := range renderTypes {
+		if countReservations(quota.Status.Reserved, kind) == 0 {
+			continue
+		}
+		_, kindOwners, err := countRendered(ctx, cli, cli.GetScheme(), quota.Namespace, renderType)
+		if err != nil {
+			return false, err
+		}
+		for uid := range kindOwners {
+			owners[uid] = true
+		}
+	}
+	quota.Status.Reserved = pendingReservations(quota.Status.Reserved, owners, "")
+	return len(quota.Status.Reserved) > 0, nil
+}
+
+// countRendered counts the resources of the type of target in the namespace rendered by templates
+// and returns the UIDs of the templates controlling them.
+func countRendered(ctx context.Context, reader client.Reader, scheme *runtime.Scheme, namespace string, target client.Object) (int, map[types.UID]bool, error) {
+	gvk, err := apiutil.GVKForObject(target, scheme)
+	if err != nil {
+		return 0, nil, err
+	}
+	obj, err := scheme.New(gvk.GroupVersion().WithKind(gvk.Kind + "List"))
+	if err != nil {
+		return 0, nil, err
+	}
+	list := obj.(client.ObjectList)
+	if err := reader.List(ctx, list, client.InNamespace(namespace)); err != nil {
+		return 0, nil, fmt.Errorf("failed to list %s; %w", gvk.Kind, err)
+	}
+	items, err := meta.ExtractList(list)
+	if err != nil {
+		return 0, nil, err
+	}
+	used := 0
+	owners := make(map[types.UID]bool)
+	for _, item := range items {
+		accessor, err := meta.Accessor(item)
+		if err != nil {
+			return 0, nil, err
+		}
+		if owner := metav1.GetControllerOf(accessor); owner != nil && isTemplaterOwner(*owner) {
+			used++
+			owners[owner.UID] = true
+		}
+	}
+	return used, owners, nil
+}
+
+// clearQuotaExceeded marks src within quota in memory if it was not and reports whether anything changed.
+func clearQuotaExceeded(src client.Object) bool {
+	if meta.FindStatusCondition(*getConditions(src), QuotaExceededCondition) == nil {
+		return false
+	}
+	return setCondition(src, metav1.Condition{
+		Type:   QuotaExceededCondition,
+		Status: metav1.ConditionFalse,
+		Reason: WithinQuotaReason,
+	})
+}
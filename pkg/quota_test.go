@@ -0,0 +1,183 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"context"
+	"fmt"
+	pubsub "github.com/GoogleCloudPlatform/k8s-config-connector/pkg/apis/pubsub/v1beta1"
+	api "github.com/slamdev/config-connector-templater/api/v1alpha1"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCheckQuota(t *testing.T) {
+	ctx := context.Background()
+	controller := true
+	owner := metav1.OwnerReference{APIVersion: api.GroupVersion.String(), Kind: "PubSubTopicTemplate", Name: "a", UID: "a", Controller: &controller}
+	rendered := &pubsub.PubSubTopic{ObjectMeta: metav1.ObjectMeta{Name: "a", Namespace: "team1", OwnerReferences: []metav1.OwnerReference{owner}}}
+	unmanaged := &pubsub.PubSubTopic{ObjectMeta: metav1.ObjectMeta{Name: "b", Namespace: "team1"}}
+	other := &pubsub.PubSubTopic{ObjectMeta: metav1.ObjectMeta{Name: "c", Namespace: "team2", OwnerReferences: []metav1.OwnerReference{owner}}}
+	quota := &api.TemplateQuota{ObjectMeta: metav1.ObjectMeta{Name: "quota", Namespace: "team1"}}
+	quota.Spec.Hard = map[string]int{"PubSubTopic": 1, "PubSubSubscription": 0}
+	template := &api.PubSubTopicTemplate{ObjectMeta: metav1.ObjectMeta{Name: "d", Namespace: "team1"}}
+	cli := newFakeCli(rendered, unmanaged, other, quota, template)
+
+	used, err := QuotaUsage(ctx, cli, "team1", &pubsub.PubSubTopic{})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, used)
+
+	exceeded, err := CheckQuota(ctx, cli, Config{}, template, &pubsub.PubSubTopic{})
+	assert.NoError(t, err)
+	assert.True(t, exceeded)
+	assert.NoError(t, cli.Get(ctx, client.ObjectKeyFromObject(template), template))
+	cond := meta.FindStatusCondition(template.Status.Conditions, QuotaExceededCondition)
+	assert.Equal(t, metav1.ConditionTrue, cond.Status)
+	assert.Equal(t, "quota allows 1 PubSubTopic in team1, 1 used", cond.Message)
+
+	quota.Spec.Hard["PubSubTopic"] = 2
+	assert.NoError(t, cli.Update(ctx, quota))
+	exceeded, err = CheckQuota(ctx, cli, Config{}, template, &pubsub.PubSubTopic{})
+	assert.NoError(t, err)
+	assert.False(t, exceeded)
+	assert.True(t, clearQuotaExceeded(template))
+	assert.True(t, meta.IsStatusConditionFalse(template.Status.Conditions, QuotaExceededCondition))
+}
+
+// staleCli lists from a cache that has not seen any rendered resource yet.
+type staleCli struct {
+	fakeCli
+}
+
+func (c staleCli) List(ctx context.Context, list client.ObjectList, opts ...client.ListOption) error {
+	if _, ok := list.(*pubsub.PubSubTopicList); ok {
+		return nil
+	}
+	return c.fakeCli.List(ctx, list, opts...)
+}
+
+// slowReader answers from the API server only after a while, so concurrent
+// checks all see the usage from before any of them created a resource.
+type slowReader struct {
+	client.Reader
+}
+
+func (r slowReader) List(ctx context.Context, list client.ObjectList, opts ...client.ListOption) error {
+	err := r.Reader.List(ctx, list, opts...)
+	time.Sleep(50 * time.Millisecond)
+	return err
+}
+
+func TestCreateWithinQuotaConcurrently(t *testing.T) {
+	ctx := context.Background()
+	quota := &api.TemplateQuota{ObjectMeta: metav1.ObjectMeta{Name: "quota", Namespace: "team1"}}
+	quota.Spec.Hard = map[string]int{"PubSubTopic": 3}
+	objs := []client.Object{quota, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team1"}}}
+	var templates []*api.PubSubTopicTemplate
+	for i := 0; i < 10; i++ {
+		template := &api.PubSubTopicTemplate{ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("topic-%d", i), Namespace: "team1", UID: types.UID(fmt.Sprintf("uid-%d", i))}}
+		templates = append(templates, template)
+		objs = append(objs, template)
+	}
+	store := newFakeCli(objs...)
+	cli := staleCli{store}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	created := 0
+	start := make(chan struct{})
+	for _, template := range templates {
+		wg.Add(1)
+		go func(template *api.PubSubTopicTemplate) {
+			defer wg.Done()
+			// every template is reconciled by another replica or installation
+			cfg := Config{Quotas: NewQuotas(slowReader{store})}
+			<-start
+			exceeded, err := CreateWithinQuota(ctx, cli, cfg, template.DeepCopy(), &pubsub.PubSubTopic{})
+			assert.NoError(t, err)
+			if !exceeded {
+				mu.Lock()
+				created++
+				mu.Unlock()
+			}
+		}(template)
+	}
+	close(start)
+	wg.Wait()
+	assert.Equal(t, 3, created)
+	used, err := QuotaUsage(ctx, store, "team1", &pubsub.PubSubTopic{})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, used)
+}
+
+func TestQuotaReservations(t *testing.T) {
+	ctx := context.Background()
+	quota := &api.TemplateQuota{ObjectMeta: metav1.ObjectMeta{Name: "quota", Namespace: "team1"}}
+	quota.Spec.Hard = map[string]int{"PubSubTopic": 1}
+	quota.Status.Reserved = []api.TemplateQuotaReservation{{Kind: "PubSubTopic", Template: "a", UID: "a", Time: metav1.Now()}}
+	template := &api.PubSubTopicTemplate{ObjectMeta: metav1.ObjectMeta{Name: "b", Namespace: "team1", UID: "b"}}
+	// the target name is taken by a resource the templater does not own, creating it fails
+	taken := &pubsub.PubSubTopic{ObjectMeta: metav1.ObjectMeta{Name: "b", Namespace: "team1"}}
+	cli := newFakeCli(quota, template, taken, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team1"}})
+	cfg := Config{Quotas: NewQuotas(cli)}
+
+	// the reservation of another template counts as used
+	exceeded, err := CheckQuota(ctx, cli, cfg, template, &pubsub.PubSubTopic{})
+	assert.NoError(t, err)
+	assert.True(t, exceeded)
+	exceeded, err = CreateWithinQuota(ctx, cli, cfg, template, &pubsub.PubSubTopic{})
+	assert.NoError(t, err)
+	assert.True(t, exceeded)
+
+	// expired reservations do not
+	assert.NoError(t, cli.Get(ctx, client.ObjectKeyFromObject(quota), quota))
+	quota.Status.Reserved[0].Time = metav1.NewTime(time.Now().Add(-2 * quotaReservationTTL))
+	assert.NoError(t, cli.Status().Update(ctx, quota))
+	exceeded, err = CheckQuota(ctx, cli, cfg, template, &pubsub.PubSubTopic{})
+	assert.NoError(t, err)
+	assert.False(t, exceeded)
+
+	// a failed create releases its reservation
+	exceeded, err = CreateWithinQuota(ctx, cli, cfg, template, &pubsub.PubSubTopic{})
+	assert.Error(t, err)
+	assert.False(t, exceeded)
+	assert.NoError(t, cli.Get(ctx, client.ObjectKeyFromObject(quota), quota))
+	assert.Len(t, quota.Status.Reserved, 1)
+	assert.Equal(t, "a", quota.Status.Reserved[0].Template)
+
+	// the quota controller drops reservations settled by a rendered resource and the expired ones
+	controller := true
+	owner := metav1.OwnerReference{APIVersion: api.GroupVersion.String(), Kind: "PubSubTopicTemplate", Name: "c", UID: "c", Controller: &controller}
+	assert.NoError(t, cli.Create(ctx, &pubsub.PubSubTopic{ObjectMeta: metav1.ObjectMeta{Name: "c", Namespace: "team1", OwnerReferences: []metav1.OwnerReference{owner}}}))
+	quota.Status.Reserved = []api.TemplateQuotaReservation{
+		{Kind: "PubSubTopic", Template: "a", UID: "a", Time: metav1.NewTime(time.Now().Add(-2 * quotaReservationTTL))},
+		{Kind: "PubSubTopic", Template: "c", UID: "c", Time: metav1.Now()},
+		{Kind: "PubSubTopic", Template: "d", UID: "d", Time: metav1.Now()},
+	}
+	pending, err := SettleReservations(ctx, cli, quota, map[string]client.Object{"PubSubTopic": &pubsub.PubSubTopic{}})
+	assert.NoError(t, err)
+	assert.True(t, pending)
+	assert.Len(t, quota.Status.Reserved, 1)
+	assert.Equal(t, "d", quota.Status.Reserved[0].Template)
+}
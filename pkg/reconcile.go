@@ -19,45 +19,143 @@ package pkg
 import (
 	"context"
 	"fmt"
+	api "github.com/slamdev/config-connector-templater/api/v1alpha1"
 	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"reflect"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/log"
-	"strings"
 )
 
 type CliCli interface {
+	Get(ctx context.Context, key client.ObjectKey, obj client.Object) error
+	List(ctx context.Context, list client.ObjectList, opts ...client.ListOption) error
 	Create(ctx context.Context, obj client.Object, opts ...client.CreateOption) error
 	Update(ctx context.Context, obj client.Object, opts ...client.UpdateOption) error
+	Delete(ctx context.Context, obj client.Object, opts ...client.DeleteOption) error
 	Status() client.StatusWriter
 	GetScheme() *runtime.Scheme
 }
 
-func CreateTargetResource(ctx context.Context, cli CliCli, src client.Object, typedContainer client.Object) error {
-	if err := createTemplatedResource(cli, src, typedContainer); err != nil {
+func CreateTargetResource(ctx context.Context, cli CliCli, cfg Config, src client.Object, typedContainer client.Object) error {
+	opts, hash, err := renderInputs(ctx, cli, cfg, src)
+	if err != nil {
+		return err
+	}
+	if err := createTemplatedResource(ctx, cli, cfg, src, typedContainer, opts, hash); err != nil {
 		return fmt.Errorf("failed to create templated resource; %w", err)
 	}
-	return cli.Create(ctx, typedContainer)
+	if err := enforcePolicies(ctx, cli, src, typedContainer, opts); err != nil {
+		return err
+	}
+	if err := markAppliedRevision(src, typedContainer, getSpec(typedContainer)); err != nil {
+		return err
+	}
+	if err := cli.Create(ctx, typedContainer); err != nil {
+		return err
+	}
+	diff, err := diffSpecs(nil, getSpec(typedContainer))
+	if err != nil {
+		return fmt.Errorf("failed to compare specs; %w", err)
+	}
+	if err := recordChange(cli, cfg, AuditCreate, CauseTargetMissing, src, typedContainer, diff); err != nil {
+		log.FromContext(ctx).Error(err, "Failed to audit change")
+	}
+	if err := recordRevision(ctx, cli, cfg, src, getSpec(typedContainer)); err != nil {
+		return err
+	}
+	cfg.Cache.markApplied(typedContainer.GetUID(), typedContainer.GetGeneration(), hash)
+	return nil
 }
 
-func UpdateTargetResource(ctx context.Context, cli CliCli, src client.Object, target client.Object, typedContainer client.Object) error {
+func UpdateTargetResource(ctx context.Context, cli CliCli, cfg Config, src client.Object, target client.Object, typedContainer client.Object) error {
+	opts, hash, err := renderInputs(ctx, cli, cfg, src)
+	if err != nil {
+		return err
+	}
+	if err := checkRollout(ctx, cli, src, target); err != nil {
+		return err
+	}
+	rollback, rollbackHash, err := rollbackSpec(ctx, cli, src, target)
+	if err != nil {
+		return err
+	}
+	autoRollback := false
+	if rollback == nil {
+		rollback, rollbackHash, err = failedRenderSpec(ctx, cli, src, target, hash)
+		if err != nil {
+			return err
+		}
+		autoRollback = rollback != nil
+	}
+	if rollback != nil {
+		hash = rollbackHash
+	} else if err := clearDegraded(ctx, cli, src); err != nil {
+		return fmt.Errorf("failed to report recovery; %w", err)
+	}
+
+	// Skip rendering if neither the render inputs nor the PubSubTopic changed since the last render
+	if target.GetAnnotations()[InputsHashAnnotation] == hash && metav1.IsControlledBy(target, src) &&
+		cfg.Cache.isApplied(target.GetUID(), target.GetGeneration(), hash) {
+		return updateStatusRef(ctx, cli, target, src)
+	}
+
 	// Build the PubSubTopic spec from PubSubTopicTemplate
-	if err := createTemplatedResource(cli, src, typedContainer); err != nil {
-		return fmt.Errorf("failed to create templated resource; %w", err)
+	resSpec := rollback
+	if rollback == nil {
+		if err := createTemplatedResource(ctx, cli, cfg, src, typedContainer, opts, hash); err != nil {
+			return fmt.Errorf("failed to create templated resource; %w", err)
+		}
+		if err := enforcePolicies(ctx, cli, src, typedContainer, opts); err != nil {
+			return err
+		}
+		resSpec = getSpec(typedContainer)
 	}
-	resSpec := getSpec(typedContainer)
 
 	// Update PubSubTopic if needed
-	if !reflect.DeepEqual(resSpec, getSpec(target)) {
-		log.FromContext(ctx).Info("changes detected", "src", resSpec, "dst", getSpec(target))
-		setSpec(target, resSpec)
-		err := cli.Update(ctx, target)
+	if !reflect.DeepEqual(resSpec, getSpec(target)) || target.GetAnnotations()[InputsHashAnnotation] != hash ||
+		!metav1.IsControlledBy(target, src) {
+		cause := CauseDrift
+		if !metav1.IsControlledBy(target, src) {
+			cause = CauseOwnerChanged
+		} else if autoRollback {
+			cause = CauseAutoRollback
+		} else if rollback != nil {
+			cause = CauseRollback
+		} else if target.GetAnnotations()[InputsHashAnnotation] != hash {
+			cause = CauseTemplateChanged
+		}
+		diff, err := diffSpecs(getSpec(target), resSpec)
 		if err != nil {
+			return fmt.Errorf("failed to compare specs; %w", err)
+		}
+		log.FromContext(ctx).Info("Updating resource", "cause", cause, "fields", diffPaths(diff))
+		setSpec(target, resSpec)
+		setAnnotation(target, InputsHashAnnotation, hash)
+		if !autoRollback {
+			delete(target.GetAnnotations(), FailedInputsHashAnnotation)
+		}
+		if err := markAppliedRevision(src, target, resSpec); err != nil {
+			return err
+		}
+		if err := setController(cli, src, target); err != nil {
+			return fmt.Errorf("failed to set ctrl ref; %w", err)
+		}
+		if err := cli.Update(ctx, target); err != nil {
 			return fmt.Errorf("failed to update dest resource; %w", err)
 		}
+		if err := recordChange(cli, cfg, AuditUpdate, cause, src, target, diff); err != nil {
+			log.FromContext(ctx).Error(err, "Failed to audit change")
+		}
+		if rollback == nil {
+			if err := recordRevision(ctx, cli, cfg, src, resSpec); err != nil {
+				return err
+			}
+		}
 	}
+	cfg.Cache.markApplied(target.GetUID(), target.GetGeneration(), hash)
 
 	if err := updateStatusRef(ctx, cli, target, src); err != nil {
 		return fmt.Errorf("failed to update dest resource status; %w", err)
@@ -66,6 +164,43 @@ func UpdateTargetResource(ctx context.Context, cli CliCli, src client.Object, ta
 	return nil
 }
 
+// renderInputs resolves the render options of src and the hash of everything the render depends on.
+func renderInputs(ctx context.Context, cli CliCli, cfg Config, src client.Object) (RenderOptions, string, error) {
+	opts, err := renderOptions(ctx, cli, cfg, src)
+	if err != nil {
+		return opts, "", fmt.Errorf("failed to resolve render options; %w", err)
+	}
+	params, err := templateParams(src)
+	if err != nil {
+		return opts, "", fmt.Errorf("failed to parse template params; %w", err)
+	}
+	if opts.refs, err = templateRefs(ctx, cli, cfg, src, opts); err != nil {
+		return opts, "", err
+	}
+	if len(opts.refs) > 0 {
+		// the rendered resources of referenced templates are inputs too
+		params["$templateRefs"] = opts.refs
+	}
+	if opts.defaults, err = templateDefaults(ctx, cli, src); err != nil {
+		return opts, "", err
+	}
+	if len(opts.defaults) > 0 {
+		params["$defaults"] = opts.defaults
+	}
+	if opts.policies, err = templatePolicies(ctx, cli, targetKind(cli, src)); err != nil {
+		return opts, "", err
+	}
+	if len(opts.policies) > 0 {
+		// a new or changed policy has to be checked against the current render
+		params["$policies"] = opts.policies
+	}
+	hash, err := inputsHash(params, opts)
+	if err != nil {
+		return opts, "", err
+	}
+	return opts, hash, nil
+}
+
 func updateStatusRef(ctx context.Context, cli CliCli, src client.Object, target client.Object) error {
 	// Build the PubSubTopicTemplate status ref with from PubSubTopic
 	ref := corev1.ObjectReference{
@@ -77,37 +212,81 @@ func updateStatusRef(ctx context.Context, cli CliCli, src client.Object, target
 	}
 
 	// Update status.Ref if needed
+	changed := setCondition(target, metav1.Condition{
+		Type:   RenderedCondition,
+		Status: metav1.ConditionTrue,
+		Reason: RenderSucceededReason,
+	})
+	if clearConflict(target) {
+		changed = true
+	}
+	if clearPaused(target) {
+		changed = true
+	}
+	if clearWaiting(target) {
+		changed = true
+	}
+	if clearViolations(target) {
+		changed = true
+	}
+	if clearQuotaExceeded(target) {
+		changed = true
+	}
+	if mirrorReady(target, src) {
+		changed = true
+	}
+	if _, ok := getAnnotation(target, RollbackToAnnotation); !ok && clearRolledBack(target) {
+		changed = true
+	}
 	if !reflect.DeepEqual(ref, getStatusRef(target)) {
 		setStatusRef(target, ref)
+		changed = true
+	}
+	if changed {
 		return cli.Status().Update(ctx, target)
 	}
 
 	return nil
 }
 
-func createTemplatedResource(cli CliCli, src client.Object, target client.Object) error {
-	spec, err := Render(getSpec(src), src)
+func createTemplatedResource(ctx context.Context, cli CliCli, cfg Config, src client.Object, target client.Object, opts RenderOptions, hash string) error {
+	spec, err := renderSpec(src, opts)
+	if err != nil {
+		return failRender(ctx, cli, src, err)
+	}
+	spec, err = convertSpec(applyTemplateRefs(spec, opts.refs), getSpec(target))
 	if err != nil {
-		return fmt.Errorf("failed to render template; %w", err)
+		return err
+	}
+	if err := validateSpec(kindOf(cli, src), spec); err != nil {
+		return failRender(ctx, cli, src, err)
+	}
+	name, err := renderTargetName(src, opts)
+	if err != nil {
+		return failRender(ctx, cli, src, err)
+	}
+	if ns, _ := getAnnotation(src, TargetNamespaceAnnotation); ns != "" && ns != src.GetNamespace() {
+		return failRender(ctx, cli, src, fmt.Errorf("target namespace %s is not the namespace of the template", ns))
 	}
-	target.SetName(src.GetName())
+	target.SetName(name)
 	target.SetNamespace(src.GetNamespace())
 
 	if len(target.GetAnnotations()) == 0 {
 		target.SetAnnotations(make(map[string]string))
 	}
 	for k, v := range src.GetAnnotations() {
-		if strings.Contains(k, "fluxcd.io") || strings.Contains(k, "last-applied-configuration") {
+		if cfg.isExcluded(k) || isTemplaterKey(k) {
 			continue
 		}
 		target.GetAnnotations()[k] = v
 	}
+	target.GetAnnotations()[InputsHashAnnotation] = hash
 
 	if len(target.GetLabels()) == 0 {
 		target.SetLabels(make(map[string]string))
 	}
 	for k, v := range src.GetLabels() {
-		if strings.Contains(k, "fluxcd.io") {
+		if cfg.isExcluded(k) {
 			continue
 		}
 		target.GetLabels()[k] = v
@@ -121,6 +300,18 @@ func createTemplatedResource(cli CliCli, src client.Object, target client.Object
 	return nil
 }
 
+func renderSpec(src client.Object, opts RenderOptions) (interface{}, error) {
+	if doc, ok := getAnnotation(src, TemplateAnnotation); ok {
+		spec, err := RenderDocument(doc, getSpec(src), src, opts)
+		if err != nil {
+			return nil, err
+		}
+		return applyDefaults(spec, opts.defaults, src, opts)
+	}
+	opts.templated = getTemplated(src)
+	return Render(getSpec(src), src, opts)
+}
+
 func setSpec(target interface{}, spec interface{}) {
 	v := reflect.ValueOf(target).Elem()
 	f := v.FieldByName("Spec")
@@ -133,6 +324,16 @@ func getSpec(target interface{}) interface{} {
 	return f.Interface()
 }
 
+// getTemplated returns the non-string spec fields of a template set to a template expression.
+func getTemplated(src interface{}) api.TemplatedFields {
+	f := reflect.ValueOf(src).Elem().FieldByName("Templated")
+	if !f.IsValid() {
+		return nil
+	}
+	fields, _ := f.Interface().(api.TemplatedFields)
+	return fields
+}
+
 func setStatusRef(target interface{}, ref corev1.ObjectReference) {
 	v := reflect.ValueOf(target).Elem()
 	statusValue := v.FieldByName("Status")
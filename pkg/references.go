@@ -0,0 +1,126 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	k8s "github.com/GoogleCloudPlatform/k8s-config-connector/pkg/apis/k8s/v1alpha1"
+	api "github.com/slamdev/config-connector-templater/api/v1alpha1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"reflect"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"strings"
+)
+
+const topicRefField = "topicRef"
+
+// templateRefs resolves the template references in the spec of src to the resources rendered by
+// the referenced templates, keyed by the spec field they fill.
+func templateRefs(ctx context.Context, cli CliCli, cfg Config, src client.Object, opts RenderOptions) (map[string]k8s.ResourceRef, error) {
+	switch t := src.(type) {
+	case *api.PubSubSubscriptionTemplate:
+		if t.Spec.TopicTemplateRef == nil {
+			return nil, nil
+		}
+		ref, err := resolveTemplateRef(ctx, cli, cfg, src, &api.PubSubTopicTemplate{}, *t.Spec.TopicTemplateRef, opts)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]k8s.ResourceRef{topicRefField: ref}, nil
+	}
+	return nil, nil
+}
+
+func resolveTemplateRef(ctx context.Context, cli CliCli, cfg Config, src client.Object, ref client.Object, tplRef api.TemplateRef, opts RenderOptions) (k8s.ResourceRef, error) {
+	name, err := RenderString(tplRef.Name, src, opts)
+	if err != nil {
+		return k8s.ResourceRef{}, failRender(ctx, cli, src, fmt.Errorf("failed to render template reference; %w", err))
+	}
+	namespace := tplRef.Namespace
+	if namespace == "" {
+		namespace = src.GetNamespace()
+	}
+	if err := cli.Get(ctx, client.ObjectKey{Namespace: namespace, Name: name}, ref); err != nil {
+		if errors.IsNotFound(err) {
+			return k8s.ResourceRef{}, failRender(ctx, cli, src, fmt.Errorf("referenced %s %s/%s not found", kindOf(cli, ref), namespace, name))
+		}
+		return k8s.ResourceRef{}, fmt.Errorf("failed to get referenced template; %w", err)
+	}
+	target, err := TargetName(ctx, cli, cfg, ref)
+	if err != nil {
+		return k8s.ResourceRef{}, fmt.Errorf("failed to resolve target of referenced template; %w", err)
+	}
+	res := k8s.ResourceRef{Name: target}
+	if namespace != src.GetNamespace() {
+		res.Namespace = namespace
+	}
+	return res, nil
+}
+
+// applyTemplateRefs fills the spec fields resolved from template references.
+func applyTemplateRefs(spec interface{}, refs map[string]k8s.ResourceRef) interface{} {
+	switch s := spec.(type) {
+	case api.PubSubSubscriptionTemplateSpec:
+		if ref, ok := refs[topicRefField]; ok {
+			s.TopicRef = ref
+		}
+		return s
+	}
+	return spec
+}
+
+// convertSpec turns the rendered template spec into the spec type of the target,
+// dropping the fields that only exist on templates.
+func convertSpec(spec interface{}, targetSpec interface{}) (interface{}, error) {
+	specType := reflect.TypeOf(targetSpec)
+	if reflect.TypeOf(spec) == specType {
+		return spec, nil
+	}
+	data, err := json.Marshal(spec)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal spec; %w", err)
+	}
+	out := reflect.New(specType)
+	if err := json.Unmarshal(data, out.Interface()); err != nil {
+		return nil, fmt.Errorf("failed to convert spec to %s; %w", specType.Name(), err)
+	}
+	return out.Elem().Interface(), nil
+}
+
+// ReferencesTemplate reports whether one of the template references in the spec of obj may point to ref.
+// References with a templated name are assumed to match.
+func ReferencesTemplate(obj *unstructured.Unstructured, ref client.Object) bool {
+	spec, _, _ := unstructured.NestedMap(obj.Object, "spec")
+	for field, v := range spec {
+		tplRef, ok := v.(map[string]interface{})
+		if !ok || !strings.HasSuffix(field, "TemplateRef") {
+			continue
+		}
+		name, _ := tplRef["name"].(string)
+		namespace, _ := tplRef["namespace"].(string)
+		if namespace == "" {
+			namespace = obj.GetNamespace()
+		}
+		if namespace == ref.GetNamespace() && (name == ref.GetName() || strings.Contains(name, "{{")) {
+			return true
+		}
+	}
+	return false
+}
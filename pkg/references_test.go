@@ -0,0 +1,125 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"context"
+	pubsub "github.com/GoogleCloudPlatform/k8s-config-connector/pkg/apis/pubsub/v1beta1"
+	api "github.com/slamdev/config-connector-templater/api/v1alpha1"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"os"
+	"sigs.k8s.io/yaml"
+	"strconv"
+	"testing"
+)
+
+func TestTopicTemplateRef(t *testing.T) {
+	ctx := context.Background()
+	topic := &api.PubSubTopicTemplate{ObjectMeta: metav1.ObjectMeta{
+		Name: "orders", Namespace: "prod",
+		Annotations: map[string]string{TargetNameAnnotation: "{{ .metadata.namespace }}-{{ .metadata.name }}"},
+	}}
+	subscription := &api.PubSubSubscriptionTemplate{ObjectMeta: metav1.ObjectMeta{Name: "orders-worker", Namespace: "prod"}}
+	subscription.Spec.TopicTemplateRef = &api.TemplateRef{Name: "orders"}
+	cli := newFakeCli(topic, subscription, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "prod"}})
+
+	opts, hash, err := renderInputs(ctx, cli, Config{}, subscription)
+	assert.NoError(t, err)
+	assert.Equal(t, "prod-orders", opts.refs[topicRefField].Name)
+
+	target := &pubsub.PubSubSubscription{}
+	assert.NoError(t, createTemplatedResource(ctx, cli, Config{}, subscription, target, opts, hash))
+	assert.Equal(t, "prod-orders", target.Spec.TopicRef.Name)
+
+	// renaming the topic target changes the inputs of the subscription
+	topic.Annotations[TargetNameAnnotation] = "{{ .metadata.name }}"
+	assert.NoError(t, cli.Update(ctx, topic))
+	_, changed, err := renderInputs(ctx, cli, Config{}, subscription)
+	assert.NoError(t, err)
+	assert.NotEqual(t, hash, changed)
+
+	subscription.Spec.TopicTemplateRef.Name = "missing"
+	_, _, err = renderInputs(ctx, cli, Config{}, subscription)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "referenced PubSubTopicTemplate prod/missing not found")
+}
+
+func TestReferencesTemplate(t *testing.T) {
+	topic := &api.PubSubTopicTemplate{ObjectMeta: metav1.ObjectMeta{Name: "orders", Namespace: "prod"}}
+	subscription := &unstructured.Unstructured{Object: map[string]interface{}{
+		"metadata": map[string]interface{}{"name": "orders-worker", "namespace": "prod"},
+		"spec":     map[string]interface{}{"topicTemplateRef": map[string]interface{}{"name": "orders"}},
+	}}
+	assert.True(t, ReferencesTemplate(subscription, topic))
+
+	topic.Name = "payments"
+	assert.False(t, ReferencesTemplate(subscription, topic))
+
+	_ = unstructured.SetNestedField(subscription.Object, "{{ .metadata.namespace }}", "spec", "topicTemplateRef", "name")
+	assert.True(t, ReferencesTemplate(subscription, topic))
+}
+
+func TestTemplatesReferencingSharded(t *testing.T) {
+	ctx := context.Background()
+	topic := &api.PubSubTopicTemplate{ObjectMeta: metav1.ObjectMeta{Name: "orders", Namespace: "prod"}}
+	shard := ShardOf(topic, 2)
+	worker := &api.PubSubSubscriptionTemplate{ObjectMeta: metav1.ObjectMeta{Name: "orders-worker", Namespace: "prod"}}
+	worker.Spec.TopicTemplateRef = &api.TemplateRef{Name: "orders"}
+	// the subscription is reconciled by the other shard than its topic
+	audit := &api.PubSubSubscriptionTemplate{ObjectMeta: metav1.ObjectMeta{Name: "orders-audit", Namespace: "prod",
+		Labels: map[string]string{ShardLabel: strconv.Itoa(1 - shard)}}}
+	audit.Spec.TopicTemplateRef = &api.TemplateRef{Name: "orders"}
+	other := &api.PubSubSubscriptionTemplate{ObjectMeta: metav1.ObjectMeta{Name: "payments-worker", Namespace: "prod"}}
+	other.Spec.TopicTemplateRef = &api.TemplateRef{Name: "payments"}
+	cli := newFakeCli(topic, worker, audit, other)
+
+	names, err := Sharding{Shards: 2, ID: shard}.TemplatesReferencing(ctx, cli, &api.PubSubSubscriptionTemplate{}, topic)
+	assert.NoError(t, err)
+	assert.Equal(t, []types.NamespacedName{{Namespace: "prod", Name: "orders-worker"}}, names)
+
+	names, err = Sharding{Shards: 2, ID: 1 - shard}.TemplatesReferencing(ctx, cli, &api.PubSubSubscriptionTemplate{}, topic)
+	assert.NoError(t, err)
+	assert.Equal(t, []types.NamespacedName{{Namespace: "prod", Name: "orders-audit"}}, names)
+}
+
+func TestTopicRefRequiredOnceRendered(t *testing.T) {
+	// templates may set topicTemplateRef instead of topicRef
+	data, err := os.ReadFile("../config/crd/bases/config-connector-templater.slamdev.net_pubsubsubscriptiontemplates.yaml")
+	assert.NoError(t, err)
+	crd := &apiextensionsv1.CustomResourceDefinition{}
+	assert.NoError(t, yaml.Unmarshal(data, crd))
+	for _, version := range crd.Spec.Versions {
+		spec := version.Schema.OpenAPIV3Schema.Properties["spec"]
+		if version.Name == "v1alpha2" {
+			spec = spec.Properties["template"]
+		}
+		assert.Contains(t, spec.Properties, "topicRef", version.Name)
+		assert.NotContains(t, spec.Required, "topicRef", version.Name)
+	}
+
+	// the generated schema still requires topicRef, it is set from topicTemplateRef once rendered
+	validator, err := specValidator("PubSubSubscriptionTemplate")
+	assert.NoError(t, err)
+	err = validateTree(validator, map[string]interface{}{"ackDeadlineSeconds": 10})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "spec.topicRef")
+}
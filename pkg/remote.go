@@ -0,0 +1,373 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"strings"
+	"sync"
+)
+
+const (
+	// RemoteOwnerLabel replaces the owner reference on targets in remote clusters, its value is the template UID.
+	RemoteOwnerLabel = AnnotationPrefix + "owner-uid"
+
+	// RemoteTargetFinalizer is set on templates rendering into a remote cluster, their target is not garbage collected.
+	RemoteTargetFinalizer = AnnotationPrefix + "remote-target"
+
+	// remoteOwnerAnnotation holds the owner reference of targets in remote clusters.
+	remoteOwnerAnnotation = AnnotationPrefix + "owner"
+
+	kubeconfigKey = "kubeconfig"
+
+	// rendered resources are the only objects kept in remote clusters
+	kccGroupSuffix = ".cnrm.cloud.google.com"
+)
+
+// IsRemote reports whether the target of src is rendered into a remote cluster.
+func IsRemote(src client.Object) bool {
+	name, _ := getAnnotation(src, TargetClusterAnnotation)
+	return name != ""
+}
+
+// IsExternal reports whether the target of src is kept outside of the local cluster, in a remote cluster
+// or in the GitOps repository, so it is not garbage collected with src.
+func IsExternal(cfg Config, src client.Object) bool {
+	return IsRemote(src) || cfg.GitOps != nil
+}
+
+// TargetClient returns the client managing the target of src: cli itself, or a client sending rendered resources
+// to the cluster in the target-cluster annotation of src or to the GitOps repository and everything else to cli.
+func TargetClient(ctx context.Context, cli CliCli, cfg Config, src client.Object) (CliCli, error) {
+	if !IsRemote(src) {
+		if cfg.GitOps != nil {
+			return remoteCli{CliCli: cli, remote: cfg.GitOps}, nil
+		}
+		return cli, nil
+	}
+	name, _ := getAnnotation(src, TargetClusterAnnotation)
+	key := client.ObjectKey{Namespace: src.GetNamespace(), Name: name}
+	secret := &corev1.Secret{}
+	if err := cli.Get(ctx, key, secret); err != nil {
+		if errors.IsNotFound(err) {
+			cfg.Remotes.forget(key)
+		}
+		return nil, fmt.Errorf("failed to get target cluster secret; %w", err)
+	}
+	remote, err := cfg.Remotes.client(secret, cli.GetScheme())
+	if err != nil {
+		return nil, err
+	}
+	return remoteCli{CliCli: cli, remote: remote}, nil
+}
+
+// DeleteTarget deletes the target of src if src still owns it and audits the delete. Targets in the local
+// cluster are deleted by the templater rather than garbage collected when auditing, see TargetFinalizer.
+func DeleteTarget(ctx context.Context, cli CliCli, cfg Config, src client.Object, target client.Object) error {
+	cli, err := TargetClient(ctx, cli, cfg, src)
+	if err != nil {
+		return err
+	}
+	name, err := TargetName(ctx, cli, cfg, src)
+	if err != nil {
+		return err
+	}
+	if err := cli.Get(ctx, client.ObjectKey{Namespace: src.GetNamespace(), Name: name}, target); err != nil {
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to get target; %w", err)
+	}
+	if !metav1.IsControlledBy(target, src) {
+		return nil
+	}
+	if err := cli.Delete(ctx, target); err != nil {
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to delete target; %w", err)
+	}
+	return recordChange(cli, cfg, AuditDelete, CauseTemplateDeleted, src, target, nil)
+}
+
+// TargetFinalizer is the finalizer src needs: external targets are not garbage collected, and with an audit log
+// local targets are deleted by the templater as well, so every delete is recorded even when it happens while
+// no replica is running. Empty when the target is left to the garbage collector.
+func TargetFinalizer(cfg Config, src client.Object) string {
+	if IsExternal(cfg, src) {
+		return RemoteTargetFinalizer
+	}
+	if cfg.Audit != nil {
+		return AuditDeleteFinalizer
+	}
+	return ""
+}
+
+// SetTargetFinalizer sets the finalizer src needs, see TargetFinalizer, removes the other ones and reports
+// whether src changed.
+func SetTargetFinalizer(cfg Config, src client.Object) bool {
+	want := TargetFinalizer(cfg, src)
+	changed := false
+	for _, finalizer := range []string{RemoteTargetFinalizer, AuditDeleteFinalizer} {
+		if has := controllerutil.ContainsFinalizer(src, finalizer); has != (finalizer == want) {
+			if has {
+				controllerutil.RemoveFinalizer(src, finalizer)
+			} else {
+				controllerutil.AddFinalizer(src, finalizer)
+			}
+			changed = true
+		}
+	}
+	return changed
+}
+
+// HasTargetFinalizer reports whether the target of src is deleted by the templater.
+func HasTargetFinalizer(src client.Object) bool {
+	return controllerutil.ContainsFinalizer(src, RemoteTargetFinalizer) || controllerutil.ContainsFinalizer(src, AuditDeleteFinalizer)
+}
+
+// RemoveTargetFinalizers lets a deleted src go once its target is deleted.
+func RemoveTargetFinalizers(src client.Object) {
+	controllerutil.RemoveFinalizer(src, RemoteTargetFinalizer)
+	controllerutil.RemoveFinalizer(src, AuditDeleteFinalizer)
+}
+
+// maxRemoteClients bounds the clients of remote clusters kept in memory, every client holds its own REST mapper.
+const maxRemoteClients = 100
+
+// Remotes caches the clients of remote clusters per kubeconfig Secret. The least recently used clients
+// and the clients of deleted Secrets are dropped.
+type Remotes struct {
+	mu      sync.Mutex
+	clients *lru
+}
+
+type remoteClient struct {
+	resourceVersion string
+	client          client.Client
+}
+
+func NewRemotes() *Remotes {
+	return &Remotes{clients: newLRU(maxRemoteClients)}
+}
+
+func (r *Remotes) client(secret *corev1.Secret, scheme *runtime.Scheme) (client.Client, error) {
+	if r == nil {
+		return newRemoteClient(secret, scheme)
+	}
+	key := secret.Namespace + "/" + secret.Name
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if c, ok := r.clients.get(key); ok && c.(remoteClient).resourceVersion == secret.ResourceVersion {
+		return c.(remoteClient).client, nil
+	}
+	c, err := newRemoteClient(secret, scheme)
+	if err != nil {
+		r.clients.remove(key)
+		return nil, err
+	}
+	r.clients.put(key, remoteClient{resourceVersion: secret.ResourceVersion, client: c})
+	return c, nil
+}
+
+// forget drops the client of a deleted Secret.
+func (r *Remotes) forget(key client.ObjectKey) {
+	if r == nil {
+		return
+	}
+	r.clients.remove(key.Namespace + "/" + key.Name)
+}
+
+func newRemoteClient(secret *corev1.Secret, scheme *runtime.Scheme) (client.Client, error) {
+	kubeconfig, ok := secret.Data[kubeconfigKey]
+	if !ok {
+		return nil, fmt.Errorf("secret %s/%s has no %s key", secret.Namespace, secret.Name, kubeconfigKey)
+	}
+	restConfig, err := restConfigFromKubeconfig(kubeconfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse kubeconfig of %s/%s; %w", secret.Namespace, secret.Name, err)
+	}
+	return client.New(restConfig, client.Options{Scheme: scheme})
+}
+
+// restConfigFromKubeconfig parses a kubeconfig written by namespace users. Only inline credentials are accepted:
+// exec commands and auth providers would run in the controller pod and file paths would read its files,
+// both with the cluster wide permissions of the controller.
+func restConfigFromKubeconfig(data []byte) (*rest.Config, error) {
+	cfg, err := clientcmd.Load(data)
+	if err != nil {
+		return nil, err
+	}
+	for name, auth := range cfg.AuthInfos {
+		switch {
+		case auth.Exec != nil:
+			return nil, fmt.Errorf("user %s uses an exec command, only inline credentials are allowed", name)
+		case auth.AuthProvider != nil:
+			return nil, fmt.Errorf("user %s uses an auth provider, only inline credentials are allowed", name)
+		case auth.TokenFile != "" || auth.ClientCertificate != "" || auth.ClientKey != "":
+			return nil, fmt.Errorf("user %s references files, only inline credentials are allowed", name)
+		}
+	}
+	for name, cluster := range cfg.Clusters {
+		if cluster.CertificateAuthority != "" {
+			return nil, fmt.Errorf("cluster %s references files, only inline certificate data is allowed", name)
+		}
+	}
+	return clientcmd.NewDefaultClientConfig(*cfg, &clientcmd.ConfigOverrides{}).ClientConfig()
+}
+
+// targetStore keeps rendered resources outside of the local cluster: in a remote cluster or a GitStore.
+type targetStore interface {
+	Get(ctx context.Context, key client.ObjectKey, obj client.Object) error
+	List(ctx context.Context, list client.ObjectList, opts ...client.ListOption) error
+	Create(ctx context.Context, obj client.Object, opts ...client.CreateOption) error
+	Update(ctx context.Context, obj client.Object, opts ...client.UpdateOption) error
+	Delete(ctx context.Context, obj client.Object, opts ...client.DeleteOption) error
+}
+
+// remoteCli sends rendered resources to a targetStore. Owner references can not point outside of the cluster,
+// so the owner of remote targets is kept in a label and an annotation and restored on read.
+type remoteCli struct {
+	CliCli
+	remote targetStore
+}
+
+func (c remoteCli) Get(ctx context.Context, key client.ObjectKey, obj client.Object) error {
+	if !c.isRemote(obj) {
+		return c.CliCli.Get(ctx, key, obj)
+	}
+	if err := c.remote.Get(ctx, key, obj); err != nil {
+		return err
+	}
+	return restoreOwner(obj)
+}
+
+func (c remoteCli) List(ctx context.Context, list client.ObjectList, opts ...client.ListOption) error {
+	if !c.isRemote(list) {
+		return c.CliCli.List(ctx, list, opts...)
+	}
+	if err := c.remote.List(ctx, list, opts...); err != nil {
+		return err
+	}
+	items, err := meta.ExtractList(list)
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		if obj, ok := item.(client.Object); ok {
+			if err := restoreOwner(obj); err != nil {
+				return err
+			}
+		}
+	}
+	return meta.SetList(list, items)
+}
+
+func (c remoteCli) Create(ctx context.Context, obj client.Object, opts ...client.CreateOption) error {
+	if !c.isRemote(obj) {
+		return c.CliCli.Create(ctx, obj, opts...)
+	}
+	if err := storeOwner(obj); err != nil {
+		return err
+	}
+	if err := c.remote.Create(ctx, obj, opts...); err != nil {
+		return err
+	}
+	return restoreOwner(obj)
+}
+
+func (c remoteCli) Update(ctx context.Context, obj client.Object, opts ...client.UpdateOption) error {
+	if !c.isRemote(obj) {
+		return c.CliCli.Update(ctx, obj, opts...)
+	}
+	if err := storeOwner(obj); err != nil {
+		return err
+	}
+	if err := c.remote.Update(ctx, obj, opts...); err != nil {
+		return err
+	}
+	return restoreOwner(obj)
+}
+
+func (c remoteCli) Delete(ctx context.Context, obj client.Object, opts ...client.DeleteOption) error {
+	if !c.isRemote(obj) {
+		return c.CliCli.Delete(ctx, obj, opts...)
+	}
+	return c.remote.Delete(ctx, obj, opts...)
+}
+
+func (c remoteCli) isRemote(obj runtime.Object) bool {
+	gvk, err := apiutil.GVKForObject(obj, c.GetScheme())
+	return err == nil && strings.HasSuffix(gvk.Group, kccGroupSuffix)
+}
+
+// storeOwner moves the template controller reference of obj into its labels and annotations.
+func storeOwner(obj client.Object) error {
+	owner := metav1.GetControllerOf(obj)
+	if owner == nil || !isTemplaterOwner(*owner) {
+		return nil
+	}
+	data, err := json.Marshal(owner)
+	if err != nil {
+		return fmt.Errorf("failed to marshal owner reference; %w", err)
+	}
+	var refs []metav1.OwnerReference
+	for _, ref := range obj.GetOwnerReferences() {
+		if ref.UID != owner.UID {
+			refs = append(refs, ref)
+		}
+	}
+	obj.SetOwnerReferences(refs)
+	labels := obj.GetLabels()
+	if labels == nil {
+		labels = make(map[string]string)
+	}
+	labels[RemoteOwnerLabel] = string(owner.UID)
+	obj.SetLabels(labels)
+	setAnnotation(obj, remoteOwnerAnnotation, string(data))
+	return nil
+}
+
+// restoreOwner turns the owner kept in the annotations of obj back into a controller reference.
+func restoreOwner(obj client.Object) error {
+	v, ok := obj.GetAnnotations()[remoteOwnerAnnotation]
+	if !ok || metav1.GetControllerOf(obj) != nil {
+		return nil
+	}
+	owner := metav1.OwnerReference{}
+	if err := json.Unmarshal([]byte(v), &owner); err != nil {
+		return fmt.Errorf("failed to parse owner of %s; %w", obj.GetName(), err)
+	}
+	if obj.GetLabels()[RemoteOwnerLabel] != string(owner.UID) {
+		// the label was changed by hand, the owner annotation is stale
+		return nil
+	}
+	obj.SetOwnerReferences(append(obj.GetOwnerReferences(), owner))
+	return nil
+}
@@ -0,0 +1,143 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"context"
+	pubsub "github.com/GoogleCloudPlatform/k8s-config-connector/pkg/apis/pubsub/v1beta1"
+	api "github.com/slamdev/config-connector-templater/api/v1alpha1"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"testing"
+)
+
+func TestRemoteTarget(t *testing.T) {
+	ctx := context.Background()
+	resourceID := "orders"
+	template := &api.PubSubTopicTemplate{ObjectMeta: metav1.ObjectMeta{
+		Name: "orders", Namespace: "team1", UID: "uid",
+		Annotations: map[string]string{TargetClusterAnnotation: "hub"},
+	}}
+	template.Spec.ResourceID = &resourceID
+	local := newFakeCli(template, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team1"}})
+	remote := newFakeCli()
+	cli := remoteCli{CliCli: local, remote: remote.Client}
+	key := client.ObjectKey{Namespace: "team1", Name: "orders"}
+
+	assert.NoError(t, CreateTargetResource(ctx, cli, Config{}, template, &pubsub.PubSubTopic{}))
+	assert.Error(t, local.Get(ctx, key, &pubsub.PubSubTopic{}))
+
+	// the remote target is tracked by label
+	stored := &pubsub.PubSubTopic{}
+	assert.NoError(t, remote.Get(ctx, key, stored))
+	assert.Empty(t, stored.OwnerReferences)
+	assert.Equal(t, "uid", stored.Labels[RemoteOwnerLabel])
+
+	target := &pubsub.PubSubTopic{}
+	assert.NoError(t, cli.Get(ctx, key, target))
+	assert.True(t, metav1.IsControlledBy(target, template))
+	owned, err := ResolveConflict(ctx, cli, Config{}, template, target)
+	assert.NoError(t, err)
+	assert.True(t, owned)
+
+	resourceID = "payments"
+	assert.NoError(t, UpdateTargetResource(ctx, cli, Config{}, template, target, &pubsub.PubSubTopic{}))
+	assert.NoError(t, remote.Get(ctx, key, stored))
+	assert.Equal(t, "payments", *stored.Spec.ResourceID)
+	assert.Empty(t, stored.OwnerReferences)
+
+	list := &pubsub.PubSubTopicList{}
+	assert.NoError(t, cli.List(ctx, list))
+	assert.Len(t, list.Items, 1)
+	assert.True(t, metav1.IsControlledBy(&list.Items[0], template))
+}
+
+func TestTargetClient(t *testing.T) {
+	ctx := context.Background()
+	template := &api.PubSubTopicTemplate{ObjectMeta: metav1.ObjectMeta{Name: "orders", Namespace: "team1"}}
+	local := newFakeCli(&corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "hub", Namespace: "team1"}})
+
+	cli, err := TargetClient(ctx, local, Config{}, template)
+	assert.NoError(t, err)
+	assert.Equal(t, local, cli)
+
+	template.Annotations = map[string]string{TargetClusterAnnotation: "hub"}
+	_, err = TargetClient(ctx, local, Config{}, template)
+	assert.EqualError(t, err, "secret team1/hub has no kubeconfig key")
+
+	template.Annotations[TargetClusterAnnotation] = "missing"
+	_, err = TargetClient(ctx, local, Config{}, template)
+	assert.Error(t, err)
+
+	// the client of a deleted secret is dropped
+	remotes := NewRemotes()
+	remotes.clients.put("team1/missing", remoteClient{client: local})
+	_, err = TargetClient(ctx, local, Config{Remotes: remotes}, template)
+	assert.Error(t, err)
+	_, ok := remotes.clients.get("team1/missing")
+	assert.False(t, ok)
+}
+
+func TestRestConfigFromKubeconfig(t *testing.T) {
+	kubeconfig := func(user string) []byte {
+		return []byte(`apiVersion: v1
+kind: Config
+clusters:
+- name: hub
+  cluster:
+    server: https://hub.example.com
+contexts:
+- name: hub
+  context:
+    cluster: hub
+    user: hub
+current-context: hub
+users:
+- name: hub
+  user:
+` + user)
+	}
+
+	cfg, err := restConfigFromKubeconfig(kubeconfig("    token: secret\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, "https://hub.example.com", cfg.Host)
+	assert.Equal(t, "secret", cfg.BearerToken)
+
+	_, err = restConfigFromKubeconfig(kubeconfig(`    exec:
+      apiVersion: client.authentication.k8s.io/v1beta1
+      command: sh
+      args: ["-c", "touch /tmp/pwned"]
+`))
+	assert.EqualError(t, err, "user hub uses an exec command, only inline credentials are allowed")
+
+	_, err = restConfigFromKubeconfig(kubeconfig(`    auth-provider:
+      name: gcp
+      config:
+        cmd-path: /bin/sh
+`))
+	assert.EqualError(t, err, "user hub uses an auth provider, only inline credentials are allowed")
+
+	_, err = restConfigFromKubeconfig(kubeconfig("    tokenFile: /var/run/secrets/kubernetes.io/serviceaccount/token\n"))
+	assert.EqualError(t, err, "user hub references files, only inline credentials are allowed")
+
+	secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "hub", Namespace: "team1"},
+		Data: map[string][]byte{kubeconfigKey: kubeconfig("    exec:\n      command: sh\n")}}
+	_, err = NewRemotes().client(secret, newFakeCli().GetScheme())
+	assert.Error(t, err)
+}
@@ -17,35 +17,99 @@ limitations under the License.
 package pkg
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
-	"github.com/Masterminds/sprig/v3"
-	"html/template"
+	k8s "github.com/GoogleCloudPlatform/k8s-config-connector/pkg/apis/k8s/v1alpha1"
+	api "github.com/slamdev/config-connector-templater/api/v1alpha1"
 	"reflect"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/yaml"
+	"strconv"
 	"strings"
 )
 
-func Render(templated interface{}, data interface{}) (interface{}, error) {
-	params, err := structToMap(data)
+// RenderOptions selects how a template is rendered.
+type RenderOptions struct {
+	// Engine is one of gotemplate (default), cel, jsonnet or cue.
+	Engine string
+	// Functions lists the functions go templates may call;
+	// nil means every sprig function except the unsafe ones.
+	Functions []string
+	// Limits caps the resources the render may use.
+	Limits Limits
+
+	parsed *parsedTemplates
+	// refs holds the resolved template references, see templateRefs.
+	refs map[string]k8s.ResourceRef
+	// defaults holds the merged TemplateDefaults of the target kind, see templateDefaults.
+	defaults map[string]interface{}
+	// policies holds the TemplatePolicies applying to the target kind, see templatePolicies.
+	policies []api.TemplatePolicy
+	// templated holds the non-string spec fields set to a template expression, see api.TemplatedFields.
+	templated api.TemplatedFields
+}
+
+// Render walks the templated struct and renders every string leaf on its own,
+// so rendered values never have to be valid JSON and errors point to the field.
+func Render(templated interface{}, data interface{}, opts RenderOptions) (interface{}, error) {
+	return withTimeout(opts.Limits.Timeout, func() (interface{}, error) {
+		return render(templated, data, opts)
+	})
+}
+
+func render(templated interface{}, data interface{}, opts RenderOptions) (interface{}, error) {
+	renderer, err := getRenderer(opts)
+	if err != nil {
+		return nil, err
+	}
+	defer closeRenderer(renderer)
+
+	params, err := templateParams(data)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse template params; %w", err)
 	}
 
-	jsonStr, err := json.Marshal(templated)
+	tree, err := structToTree(templated)
 	if err != nil {
-		return nil, fmt.Errorf("failed to marshal struct; %w", err)
+		return nil, fmt.Errorf("failed to parse templated struct; %w", err)
+	}
+	if obj, ok := tree.(map[string]interface{}); ok {
+		opts.templated.Inject(obj)
+		if len(opts.defaults) > 0 {
+			// defaults are merged under the spec before rendering, so fields set by the template win
+			// even when they render empty and both are rendered within the same limits
+			tree = mergeDefaults(obj, opts.defaults)
+		}
+	}
+
+	rendered, err := renderTree(renderer, tree, "$", params)
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range opts.templated.Pointers() {
+		if err := updateLeaf(rendered, path, parseScalar); err != nil {
+			return nil, fmt.Errorf("failed to parse rendered $.%s; %w", strings.Join(path, "."), err)
+		}
 	}
 
-	rendered, err := renderString(string(jsonStr), params)
+	jsonStr, err := json.Marshal(rendered)
 	if err != nil {
-		return nil, fmt.Errorf("failed to render string; %w", err)
+		return nil, fmt.Errorf("failed to marshal rendered tree; %w", err)
 	}
 
 	structType := reflect.TypeOf(templated)
 	outPtr := reflect.New(structType).Interface()
 
-	if err := json.Unmarshal([]byte(rendered), outPtr); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal struct to map; %w", err)
+	if len(opts.templated) > 0 || len(opts.defaults) > 0 {
+		// rendered non-string fields and defaults are checked against the KCC type like whole documents
+		decoder := json.NewDecoder(bytes.NewReader(jsonStr))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(outPtr); err != nil {
+			return nil, fmt.Errorf("rendered spec does not match %s schema; %w", structType.Name(), err)
+		}
+	} else if err := json.Unmarshal(jsonStr, outPtr); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal rendered tree to struct; %w", err)
 	}
 
 	out := reflect.ValueOf(outPtr).Elem().Interface()
@@ -53,17 +117,175 @@ func Render(templated interface{}, data interface{}) (interface{}, error) {
 	return out, nil
 }
 
-func renderString(str string, params map[string]interface{}) (string, error) {
-	tpl := template.New("_").Funcs(sprig.FuncMap())
-	parsed, err := tpl.Parse(str)
+// RenderDocument renders a raw YAML document as text and decodes the result into a
+// value of the same type as specType. Fields unknown to the type are rejected.
+func RenderDocument(doc string, specType interface{}, data interface{}, opts RenderOptions) (interface{}, error) {
+	return withTimeout(opts.Limits.Timeout, func() (interface{}, error) {
+		return renderDocument(doc, specType, data, opts)
+	})
+}
+
+func renderDocument(doc string, specType interface{}, data interface{}, opts RenderOptions) (interface{}, error) {
+	renderer, err := getRenderer(opts)
 	if err != nil {
-		return "", fmt.Errorf("failed to parse template; %w", err)
+		return nil, err
 	}
-	rendered := new(strings.Builder)
-	if err := parsed.Execute(rendered, params); err != nil {
-		return "", fmt.Errorf("failed to execute template; %w", err)
+	defer closeRenderer(renderer)
+
+	params, err := templateParams(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse template params; %w", err)
 	}
-	return rendered.String(), nil
+
+	rendered, err := renderer.RenderDocument(doc, params)
+	if err != nil {
+		return nil, fmt.Errorf("failed to render document; %w", err)
+	}
+
+	jsonStr, err := yaml.YAMLToJSON([]byte(rendered))
+	if err != nil {
+		return nil, fmt.Errorf("rendered document is not valid yaml; %w", err)
+	}
+
+	structType := reflect.TypeOf(specType)
+	outPtr := reflect.New(structType).Interface()
+
+	decoder := json.NewDecoder(bytes.NewReader(jsonStr))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(outPtr); err != nil {
+		return nil, fmt.Errorf("rendered document does not match %s schema; %w", structType.Name(), err)
+	}
+
+	out := reflect.ValueOf(outPtr).Elem().Interface()
+
+	return out, nil
+}
+
+// RenderString renders a single string, such as the name of the rendered resource.
+func RenderString(str string, data interface{}, opts RenderOptions) (string, error) {
+	out, err := withTimeout(opts.Limits.Timeout, func() (interface{}, error) {
+		renderer, err := getRenderer(opts)
+		if err != nil {
+			return nil, err
+		}
+		defer closeRenderer(renderer)
+		params, err := templateParams(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse template params; %w", err)
+		}
+		return renderer.RenderString(str, params)
+	})
+	if err != nil {
+		return "", err
+	}
+	return out.(string), nil
+}
+
+// parseScalar turns a rendered non-string field into the value it spells, an empty render unsets the field.
+func parseScalar(v interface{}) (interface{}, error) {
+	s, ok := v.(string)
+	if !ok {
+		return v, nil
+	}
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	var out interface{}
+	if err := yaml.Unmarshal([]byte(s), &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// updateLeaf replaces the value at path in tree, paths missing in tree are ignored.
+func updateLeaf(tree interface{}, path []string, update func(interface{}) (interface{}, error)) error {
+	if len(path) == 0 {
+		return nil
+	}
+	switch node := tree.(type) {
+	case map[string]interface{}:
+		v, ok := node[path[0]]
+		if !ok {
+			return nil
+		}
+		if len(path) > 1 {
+			return updateLeaf(v, path[1:], update)
+		}
+		v, err := update(v)
+		node[path[0]] = v
+		return err
+	case []interface{}:
+		i, err := strconv.Atoi(path[0])
+		if err != nil || i >= len(node) {
+			return nil
+		}
+		if len(path) > 1 {
+			return updateLeaf(node[i], path[1:], update)
+		}
+		node[i], err = update(node[i])
+		return err
+	}
+	return nil
+}
+
+func renderTree(renderer Renderer, node interface{}, path string, params map[string]interface{}) (interface{}, error) {
+	switch v := node.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for _, k := range sortedKeys(v) {
+			rendered, err := renderTree(renderer, v[k], path+"."+k, params)
+			if err != nil {
+				return nil, err
+			}
+			out[k] = rendered
+		}
+		return out, nil
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, item := range v {
+			rendered, err := renderTree(renderer, item, fmt.Sprintf("%s[%d]", path, i), params)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = rendered
+		}
+		return out, nil
+	case string:
+		rendered, err := renderer.RenderString(v, params)
+		if err != nil {
+			return nil, fmt.Errorf("failed to render %s; %w", path, err)
+		}
+		return rendered, nil
+	default:
+		return v, nil
+	}
+}
+
+// templateParams builds the context templates are rendered with. Fields that change
+// on every write of the template are left out, they are not meaningful inputs.
+func templateParams(data interface{}) (map[string]interface{}, error) {
+	params, err := structToMap(data)
+	if err != nil {
+		return nil, err
+	}
+	delete(params, "status")
+	if metadata, ok := params["metadata"].(map[string]interface{}); ok {
+		delete(metadata, "resourceVersion")
+		delete(metadata, "managedFields")
+		if annotations, ok := metadata["annotations"].(map[string]interface{}); ok {
+			delete(annotations, LastModifiedByAnnotation)
+		}
+	}
+	if obj, ok := data.(client.Object); ok {
+		if v, ok := getAnnotation(obj, ValuesAnnotation); ok {
+			var values map[string]interface{}
+			if err := json.Unmarshal([]byte(v), &values); err != nil {
+				return nil, fmt.Errorf("%s is not a JSON object; %w", ValuesAnnotation, err)
+			}
+			params["values"] = values
+		}
+	}
+	return params, nil
 }
 
 func structToMap(in interface{}) (map[string]interface{}, error) {
@@ -77,3 +299,17 @@ func structToMap(in interface{}) (map[string]interface{}, error) {
 	}
 	return out, nil
 }
+
+func structToTree(in interface{}) (interface{}, error) {
+	var out interface{}
+	jsonStr, err := json.Marshal(in)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal struct; %w", err)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(jsonStr))
+	decoder.UseNumber()
+	if err := decoder.Decode(&out); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal struct to tree; %w", err)
+	}
+	return out, nil
+}
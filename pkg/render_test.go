@@ -46,7 +46,7 @@ func TestRender(t *testing.T) {
 		},
 	}
 
-	res, err := Render(template.Spec, template)
+	res, err := Render(template.Spec, template, RenderOptions{})
 	if err != nil {
 		t.Error(err)
 	}
@@ -57,3 +57,132 @@ func TestRender(t *testing.T) {
 	assert.Equal(t, "test-ns-ref-name", resSpec.KmsKeyRef.Name)
 	assert.Equal(t, template.Spec.KmsKeyRef.Namespace, resSpec.KmsKeyRef.Namespace)
 }
+
+func TestRenderSpecialCharacters(t *testing.T) {
+	template := api.PubSubTopicTemplate{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "test-ns",
+			Annotations: map[string]string{
+				"description": "quote \" newline \n backslash \\ <tag>",
+			},
+		},
+		Spec: pubsub.PubSubTopicSpec{
+			KmsKeyRef: &v1alpha1.ResourceRef{
+				Name: `{{ index .metadata.annotations "description" }}`,
+			},
+		},
+	}
+
+	res, err := Render(template.Spec, template, RenderOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resSpec := res.(pubsub.PubSubTopicSpec)
+
+	assert.Equal(t, template.Annotations["description"], resSpec.KmsKeyRef.Name)
+}
+
+func TestRenderErrorPath(t *testing.T) {
+	template := api.PubSubTopicTemplate{
+		Spec: pubsub.PubSubTopicSpec{
+			MessageStoragePolicy: &pubsub.TopicMessageStoragePolicy{
+				AllowedPersistenceRegions: []string{"r1", "{{ .metadata.namespace | unknownFunc }}"},
+			},
+		},
+	}
+
+	_, err := Render(template.Spec, template, RenderOptions{})
+
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "$.messageStoragePolicy.allowedPersistenceRegions[1]")
+}
+
+func TestRenderDocument(t *testing.T) {
+	template := api.PubSubSubscriptionTemplate{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "prod",
+		},
+	}
+
+	doc := `
+topicRef:
+  name: "{{ .metadata.namespace }}-topic"
+ackDeadlineSeconds: {{ if eq .metadata.namespace "prod" }}60{{ else }}10{{ end }}
+{{- if eq .metadata.namespace "prod" }}
+retainAckedMessages: true
+{{- end }}
+`
+
+	res, err := RenderDocument(doc, template.Spec, template, RenderOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resSpec := res.(api.PubSubSubscriptionTemplateSpec)
+
+	assert.Equal(t, "prod-topic", resSpec.TopicRef.Name)
+	assert.Equal(t, 60, *resSpec.AckDeadlineSeconds)
+	assert.Equal(t, true, *resSpec.RetainAckedMessages)
+	assert.Nil(t, resSpec.RetryPolicy)
+}
+
+func TestRenderDocumentSchemaError(t *testing.T) {
+	template := api.PubSubSubscriptionTemplate{}
+
+	_, err := RenderDocument("ackDeadlineSeconds: ten", template.Spec, template, RenderOptions{})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "PubSubSubscriptionTemplateSpec")
+
+	_, err = RenderDocument("unknownField: 1", template.Spec, template, RenderOptions{})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "unknownField")
+}
+
+func TestRenderValues(t *testing.T) {
+	resourceID := "{{ .values.service }}-{{ index .values.regions 0 }}"
+	template := &api.PubSubTopicTemplate{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{ValuesAnnotation: `{"service": "orders", "regions": ["europe-west1"]}`},
+		},
+		Spec: pubsub.PubSubTopicSpec{ResourceID: &resourceID},
+	}
+
+	res, err := Render(template.Spec, template, RenderOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, "orders-europe-west1", *res.(pubsub.PubSubTopicSpec).ResourceID)
+
+	template.Annotations[ValuesAnnotation] = "orders"
+	_, err = Render(template.Spec, template, RenderOptions{})
+	assert.Error(t, err)
+}
+
+func TestRenderTemplatedFields(t *testing.T) {
+	template := &api.PubSubSubscriptionTemplate{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{ValuesAnnotation: `{"ack": 20, "retain": "yes"}`},
+		},
+		Spec: api.PubSubSubscriptionTemplateSpec{
+			PubSubSubscriptionSpec: pubsub.PubSubSubscriptionSpec{TopicRef: v1alpha1.ResourceRef{Name: "orders"}},
+		},
+		Templated: api.TemplatedFields{
+			"/ackDeadlineSeconds":  "{{ .values.ack }}",
+			"/retainAckedMessages": "{{ if .values.retain }}true{{ end }}",
+		},
+	}
+
+	res, err := renderSpec(template, RenderOptions{})
+	assert.NoError(t, err)
+	spec := res.(api.PubSubSubscriptionTemplateSpec)
+	assert.Equal(t, 20, *spec.AckDeadlineSeconds)
+	assert.True(t, *spec.RetainAckedMessages)
+	assert.Equal(t, "orders", spec.TopicRef.Name)
+
+	template.Annotations[ValuesAnnotation] = `{"ack": 20}`
+	res, err = renderSpec(template, RenderOptions{})
+	assert.NoError(t, err)
+	assert.Nil(t, res.(api.PubSubSubscriptionTemplateSpec).RetainAckedMessages)
+
+	template.Annotations[ValuesAnnotation] = `{"ack": "soon"}`
+	_, err = renderSpec(template, RenderOptions{})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "rendered spec does not match PubSubSubscriptionTemplateSpec schema")
+}
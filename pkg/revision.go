@@ -0,0 +1,195 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"reflect"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sort"
+	"strconv"
+)
+
+const (
+	// RevisionTemplateLabel is set on ControllerRevisions to the uid of the template they belong to.
+	RevisionTemplateLabel = AnnotationPrefix + "template-uid"
+
+	// RolledBackCondition reports whether the target is pinned to a previous revision.
+	RolledBackCondition = "RolledBack"
+
+	RollbackRequestedReason = "RollbackRequested"
+	RevisionNotFoundReason  = "RevisionNotFound"
+	RollbackClearedReason   = "RollbackCleared"
+
+	// rollbackHashPrefix marks the inputs hash of a target running a previous revision.
+	rollbackHashPrefix = "rollback-"
+)
+
+// rollbackSpec returns the spec of the revision requested by the rollback-to annotation of src
+// and the hash identifying it, a nil spec means no rollback is requested.
+func rollbackSpec(ctx context.Context, cli CliCli, src client.Object, target client.Object) (interface{}, string, error) {
+	v, ok := getAnnotation(src, RollbackToAnnotation)
+	if !ok {
+		return nil, "", nil
+	}
+	number, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return nil, "", failRollback(ctx, cli, src, fmt.Sprintf("invalid revision %q", v))
+	}
+	revisions, err := listRevisions(ctx, cli, src)
+	if err != nil {
+		return nil, "", err
+	}
+	for _, rev := range revisions {
+		if rev.Revision != number {
+			continue
+		}
+		spec := reflect.New(reflect.TypeOf(getSpec(target)))
+		if err := json.Unmarshal(rev.Data.Raw, spec.Interface()); err != nil {
+			return nil, "", fmt.Errorf("failed to decode revision %s; %w", rev.Name, err)
+		}
+		err := updateCondition(ctx, cli, src, metav1.Condition{
+			Type:    RolledBackCondition,
+			Status:  metav1.ConditionTrue,
+			Reason:  RollbackRequestedReason,
+			Message: fmt.Sprintf("target is pinned to revision %d, remove the %s annotation to render the template again", number, RollbackToAnnotation),
+		})
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to report rollback; %w", err)
+		}
+		return spec.Elem().Interface(), rollbackHashPrefix + rev.Name, nil
+	}
+	return nil, "", failRollback(ctx, cli, src, fmt.Sprintf("revision %d not found", number))
+}
+
+func failRollback(ctx context.Context, cli CliCli, src client.Object, msg string) error {
+	err := updateCondition(ctx, cli, src, metav1.Condition{
+		Type:    RolledBackCondition,
+		Status:  metav1.ConditionFalse,
+		Reason:  RevisionNotFoundReason,
+		Message: msg,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to report rollback; %w", err)
+	}
+	return fmt.Errorf("failed to roll back; %s", msg)
+}
+
+// clearRolledBack resolves a previously reported rollback in memory and reports whether anything changed.
+func clearRolledBack(src client.Object) bool {
+	if meta.FindStatusCondition(*getConditions(src), RolledBackCondition) == nil {
+		return false
+	}
+	return setCondition(src, metav1.Condition{
+		Type:   RolledBackCondition,
+		Status: metav1.ConditionFalse,
+		Reason: RollbackClearedReason,
+	})
+}
+
+// recordRevision stores spec as the newest revision of src and prunes the ones above the history limit.
+// A spec seen before gets its revision renumbered instead of a copy.
+func recordRevision(ctx context.Context, cli CliCli, cfg Config, src client.Object, spec interface{}) error {
+	if cfg.RevisionHistoryLimit <= 0 {
+		return nil
+	}
+	data, err := json.Marshal(spec)
+	if err != nil {
+		return fmt.Errorf("failed to marshal spec; %w", err)
+	}
+	revisions, err := listRevisions(ctx, cli, src)
+	if err != nil {
+		return err
+	}
+	name := revisionName(src, data)
+
+	next := int64(1)
+	if len(revisions) > 0 {
+		next = revisions[len(revisions)-1].Revision + 1
+	}
+	var existing *appsv1.ControllerRevision
+	for i := range revisions {
+		if revisions[i].Name == name {
+			existing = &revisions[i]
+		}
+	}
+
+	switch {
+	case existing != nil && existing.Revision == next-1:
+		// already the newest revision
+	case existing != nil:
+		existing.Revision = next
+		if err := cli.Update(ctx, existing); err != nil {
+			return fmt.Errorf("failed to update revision; %w", err)
+		}
+	default:
+		rev := &appsv1.ControllerRevision{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: src.GetNamespace(),
+				Labels:    map[string]string{RevisionTemplateLabel: string(src.GetUID())},
+			},
+			Data:     runtime.RawExtension{Raw: data},
+			Revision: next,
+		}
+		if err := ctrl.SetControllerReference(src, rev, cli.GetScheme()); err != nil {
+			return fmt.Errorf("failed to set ctrl ref; %w", err)
+		}
+		if err := cli.Create(ctx, rev); err != nil && !errors.IsAlreadyExists(err) {
+			return fmt.Errorf("failed to create revision; %w", err)
+		}
+		revisions = append(revisions, *rev)
+	}
+
+	sort.Slice(revisions, func(i, j int) bool { return revisions[i].Revision < revisions[j].Revision })
+	for i := 0; i < len(revisions)-cfg.RevisionHistoryLimit; i++ {
+		if err := cli.Delete(ctx, &revisions[i]); err != nil && !errors.IsNotFound(err) {
+			return fmt.Errorf("failed to prune revision; %w", err)
+		}
+	}
+	return nil
+}
+
+// listRevisions returns the revisions of src ordered from the oldest to the newest.
+func listRevisions(ctx context.Context, cli CliCli, src client.Object) ([]appsv1.ControllerRevision, error) {
+	list := &appsv1.ControllerRevisionList{}
+	err := cli.List(ctx, list, client.InNamespace(src.GetNamespace()), client.MatchingLabels{RevisionTemplateLabel: string(src.GetUID())})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list revisions; %w", err)
+	}
+	sort.Slice(list.Items, func(i, j int) bool { return list.Items[i].Revision < list.Items[j].Revision })
+	return list.Items, nil
+}
+
+func revisionName(src client.Object, data []byte) string {
+	sum := sha256.Sum256(data)
+	prefix := src.GetName()
+	if len(prefix) > 242 {
+		prefix = prefix[:242]
+	}
+	return prefix + "-" + hex.EncodeToString(sum[:])[:10]
+}
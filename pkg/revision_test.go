@@ -0,0 +1,97 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"context"
+	pubsub "github.com/GoogleCloudPlatform/k8s-config-connector/pkg/apis/pubsub/v1beta1"
+	api "github.com/slamdev/config-connector-templater/api/v1alpha1"
+	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"testing"
+)
+
+type fakeCli struct {
+	client.Client
+}
+
+func (c fakeCli) GetScheme() *runtime.Scheme {
+	return c.Scheme()
+}
+
+func newFakeCli(objs ...client.Object) fakeCli {
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	_ = pubsub.AddToScheme(scheme)
+	_ = api.AddToScheme(scheme)
+	return fakeCli{fake.NewClientBuilder().WithScheme(scheme).WithObjects(objs...).Build()}
+}
+
+func TestRecordRevision(t *testing.T) {
+	ctx := context.Background()
+	template := &api.PubSubTopicTemplate{ObjectMeta: metav1.ObjectMeta{Name: "topic", Namespace: "team1", UID: "uid"}}
+	cli := newFakeCli(template)
+	cfg := Config{RevisionHistoryLimit: 2}
+
+	specs := []string{"topic-a", "topic-b", "topic-a", "topic-c"}
+	for _, id := range specs {
+		r := id
+		assert.NoError(t, recordRevision(ctx, cli, cfg, template, pubsub.PubSubTopicSpec{ResourceID: &r}))
+	}
+
+	revisions, err := listRevisions(ctx, cli, template)
+	assert.NoError(t, err)
+	assert.Len(t, revisions, 2)
+	assert.Equal(t, int64(3), revisions[0].Revision)
+	assert.Equal(t, int64(4), revisions[1].Revision)
+	assert.Equal(t, `{"resourceID":"topic-a"}`, string(revisions[0].Data.Raw))
+}
+
+func TestRollbackSpec(t *testing.T) {
+	ctx := context.Background()
+	template := &api.PubSubTopicTemplate{ObjectMeta: metav1.ObjectMeta{Name: "topic", Namespace: "team1", UID: "uid"}}
+	cli := newFakeCli(template)
+	target := &pubsub.PubSubTopic{}
+
+	spec, _, err := rollbackSpec(ctx, cli, template, target)
+	assert.NoError(t, err)
+	assert.Nil(t, spec)
+
+	resourceID := "topic-a"
+	assert.NoError(t, recordRevision(ctx, cli, Config{RevisionHistoryLimit: 10}, template, pubsub.PubSubTopicSpec{ResourceID: &resourceID}))
+
+	template.Annotations = map[string]string{RollbackToAnnotation: "1"}
+	spec, hash, err := rollbackSpec(ctx, cli, template, target)
+	assert.NoError(t, err)
+	assert.Equal(t, "topic-a", *spec.(pubsub.PubSubTopicSpec).ResourceID)
+	assert.Contains(t, hash, "rollback-topic-")
+	assert.Equal(t, RollbackRequestedReason, template.Status.Conditions[0].Reason)
+
+	template.Annotations[RollbackToAnnotation] = "2"
+	_, _, err = rollbackSpec(ctx, cli, template, target)
+	assert.Error(t, err)
+	assert.Equal(t, RevisionNotFoundReason, template.Status.Conditions[0].Reason)
+
+	revisions := &appsv1.ControllerRevisionList{}
+	assert.NoError(t, cli.List(ctx, revisions))
+	assert.Len(t, revisions.Items, 1)
+}
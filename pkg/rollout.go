@@ -0,0 +1,186 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	k8s "github.com/GoogleCloudPlatform/k8s-config-connector/pkg/apis/k8s/v1alpha1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"reflect"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"strings"
+	"time"
+)
+
+const (
+	// DegradedCondition reports that the rendered spec was rejected and the target runs a previous revision.
+	DegradedCondition = "Degraded"
+
+	UpdateFailedReason        = "UpdateFailed"
+	NoKnownGoodRevisionReason = "NoKnownGoodRevision"
+	RecoveredReason           = "Recovered"
+
+	// kccUpdateFailedReason is the reason of the KCC Ready condition when GCP rejects a change.
+	kccUpdateFailedReason = "UpdateFailed"
+	kccReadyCondition     = "Ready"
+)
+
+// checkRollout watches the target after a change when src has an auto-rollback window. A target KCC
+// reports as Ready marks its revision as known-good. A target that fails to update within the window
+// gets the inputs hash of the failed render recorded, so the known-good revision is applied instead
+// until the template changes.
+func checkRollout(ctx context.Context, cli CliCli, src client.Object, target client.Object) error {
+	v, ok := getAnnotation(src, AutoRollbackWindowAnnotation)
+	if !ok {
+		return nil
+	}
+	window, err := time.ParseDuration(v)
+	if err != nil {
+		return fmt.Errorf("invalid %s annotation; %w", AutoRollbackWindowAnnotation, err)
+	}
+	ready := readyCondition(target)
+	if ready == nil {
+		return nil
+	}
+	applied, _ := getAnnotation(target, AppliedRevisionAnnotation)
+
+	if ready.Status == corev1.ConditionTrue {
+		return markKnownGood(ctx, cli, src, applied)
+	}
+	if ready.Reason != kccUpdateFailedReason || isRollbackHash(target.GetAnnotations()[InputsHashAnnotation]) {
+		return nil
+	}
+	appliedAt, err := time.Parse(time.RFC3339, target.GetAnnotations()[AppliedAtAnnotation])
+	if err != nil || time.Since(appliedAt) > window {
+		return nil
+	}
+
+	rev, err := knownGoodRevision(ctx, cli, src, applied)
+	if err != nil {
+		return err
+	}
+	cond := metav1.Condition{Type: DegradedCondition, Status: metav1.ConditionTrue}
+	if rev == nil {
+		cond.Reason = NoKnownGoodRevisionReason
+		cond.Message = fmt.Sprintf("update failed and there is no known-good revision to roll back to: %s", ready.Message)
+	} else {
+		cond.Reason = UpdateFailedReason
+		cond.Message = fmt.Sprintf("update failed, rolled back to revision %d: %s", rev.Revision, ready.Message)
+		setAnnotation(target, FailedInputsHashAnnotation, target.GetAnnotations()[InputsHashAnnotation])
+	}
+	if err := updateCondition(ctx, cli, src, cond); err != nil {
+		return fmt.Errorf("failed to report degraded; %w", err)
+	}
+	return nil
+}
+
+// failedRenderSpec returns the spec of the newest known-good revision when hash is the one that failed
+// to apply, a nil spec means the render may be applied.
+func failedRenderSpec(ctx context.Context, cli CliCli, src client.Object, target client.Object, hash string) (interface{}, string, error) {
+	if failed, ok := target.GetAnnotations()[FailedInputsHashAnnotation]; !ok || failed != hash {
+		return nil, "", nil
+	}
+	rev, err := knownGoodRevision(ctx, cli, src, "")
+	if err != nil || rev == nil {
+		return nil, "", err
+	}
+	spec := reflect.New(reflect.TypeOf(getSpec(target)))
+	if err := json.Unmarshal(rev.Data.Raw, spec.Interface()); err != nil {
+		return nil, "", fmt.Errorf("failed to decode revision %s; %w", rev.Name, err)
+	}
+	return spec.Elem().Interface(), rollbackHashPrefix + rev.Name, nil
+}
+
+// clearDegraded resolves a previously reported failure once a new render is applied.
+func clearDegraded(ctx context.Context, cli CliCli, src client.Object) error {
+	if meta.FindStatusCondition(*getConditions(src), DegradedCondition) == nil {
+		return nil
+	}
+	return updateCondition(ctx, cli, src, metav1.Condition{
+		Type:   DegradedCondition,
+		Status: metav1.ConditionFalse,
+		Reason: RecoveredReason,
+	})
+}
+
+// markAppliedRevision records the revision of spec and the time it was applied on target.
+func markAppliedRevision(src client.Object, target client.Object, spec interface{}) error {
+	data, err := json.Marshal(spec)
+	if err != nil {
+		return fmt.Errorf("failed to marshal spec; %w", err)
+	}
+	setAnnotation(target, AppliedRevisionAnnotation, revisionName(src, data))
+	setAnnotation(target, AppliedAtAnnotation, time.Now().UTC().Format(time.RFC3339))
+	return nil
+}
+
+func markKnownGood(ctx context.Context, cli CliCli, src client.Object, name string) error {
+	if name == "" {
+		return nil
+	}
+	rev := &appsv1.ControllerRevision{}
+	if err := cli.Get(ctx, client.ObjectKey{Namespace: src.GetNamespace(), Name: name}, rev); err != nil {
+		return client.IgnoreNotFound(err)
+	}
+	if _, ok := getAnnotation(rev, KnownGoodAnnotation); ok {
+		return nil
+	}
+	setAnnotation(rev, KnownGoodAnnotation, "true")
+	if err := cli.Update(ctx, rev); err != nil {
+		return fmt.Errorf("failed to mark revision as known-good; %w", err)
+	}
+	return nil
+}
+
+// knownGoodRevision returns the newest known-good revision of src other than the excluded one.
+func knownGoodRevision(ctx context.Context, cli CliCli, src client.Object, exclude string) (*appsv1.ControllerRevision, error) {
+	revisions, err := listRevisions(ctx, cli, src)
+	if err != nil {
+		return nil, err
+	}
+	for i := len(revisions) - 1; i >= 0; i-- {
+		if _, ok := getAnnotation(&revisions[i], KnownGoodAnnotation); ok && revisions[i].Name != exclude {
+			return &revisions[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// readyCondition returns the KCC Ready condition of target when it describes the current generation.
+func readyCondition(target client.Object) *k8s.Condition {
+	status := reflect.ValueOf(target).Elem().FieldByName("Status")
+	observed := status.FieldByName("ObservedGeneration")
+	if !observed.IsValid() || observed.Int() != target.GetGeneration() {
+		return nil
+	}
+	for _, c := range status.FieldByName("Conditions").Interface().([]k8s.Condition) {
+		if c.Type == kccReadyCondition {
+			c := c
+			return &c
+		}
+	}
+	return nil
+}
+
+func isRollbackHash(hash string) bool {
+	return strings.HasPrefix(hash, rollbackHashPrefix)
+}
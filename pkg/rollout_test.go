@@ -0,0 +1,74 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"context"
+	k8s "github.com/GoogleCloudPlatform/k8s-config-connector/pkg/apis/k8s/v1alpha1"
+	pubsub "github.com/GoogleCloudPlatform/k8s-config-connector/pkg/apis/pubsub/v1beta1"
+	api "github.com/slamdev/config-connector-templater/api/v1alpha1"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"testing"
+	"time"
+)
+
+func TestCheckRollout(t *testing.T) {
+	ctx := context.Background()
+	template := &api.PubSubTopicTemplate{ObjectMeta: metav1.ObjectMeta{
+		Name: "topic", Namespace: "team1", UID: "uid",
+		Annotations: map[string]string{AutoRollbackWindowAnnotation: "10m"},
+	}}
+	cli := newFakeCli(template)
+	cfg := Config{RevisionHistoryLimit: 10}
+
+	good, bad := "good", "bad"
+	target := &pubsub.PubSubTopic{ObjectMeta: metav1.ObjectMeta{Generation: 1}}
+	target.Status.ObservedGeneration = 1
+
+	// the first spec becomes ready
+	assert.NoError(t, recordRevision(ctx, cli, cfg, template, pubsub.PubSubTopicSpec{ResourceID: &good}))
+	assert.NoError(t, markAppliedRevision(template, target, pubsub.PubSubTopicSpec{ResourceID: &good}))
+	target.Status.Conditions = []k8s.Condition{{Type: "Ready", Status: corev1.ConditionTrue}}
+	assert.NoError(t, checkRollout(ctx, cli, template, target))
+
+	// the second one is rejected by GCP
+	assert.NoError(t, recordRevision(ctx, cli, cfg, template, pubsub.PubSubTopicSpec{ResourceID: &bad}))
+	assert.NoError(t, markAppliedRevision(template, target, pubsub.PubSubTopicSpec{ResourceID: &bad}))
+	target.Annotations[InputsHashAnnotation] = "bad-hash"
+	target.Status.Conditions = []k8s.Condition{{Type: "Ready", Status: corev1.ConditionFalse, Reason: "UpdateFailed", Message: "immutable field"}}
+	assert.NoError(t, checkRollout(ctx, cli, template, target))
+	assert.Equal(t, "bad-hash", target.Annotations[FailedInputsHashAnnotation])
+	assert.Equal(t, UpdateFailedReason, template.Status.Conditions[0].Reason)
+	assert.Contains(t, template.Status.Conditions[0].Message, "rolled back to revision 1: immutable field")
+
+	spec, hash, err := failedRenderSpec(ctx, cli, template, target, "bad-hash")
+	assert.NoError(t, err)
+	assert.Equal(t, "good", *spec.(pubsub.PubSubTopicSpec).ResourceID)
+	assert.True(t, isRollbackHash(hash))
+
+	spec, _, err = failedRenderSpec(ctx, cli, template, target, "fixed-hash")
+	assert.NoError(t, err)
+	assert.Nil(t, spec)
+
+	// failures outside of the window are left alone
+	target.Annotations[AppliedAtAnnotation] = time.Now().Add(-time.Hour).Format(time.RFC3339)
+	delete(target.Annotations, FailedInputsHashAnnotation)
+	assert.NoError(t, checkRollout(ctx, cli, template, target))
+	assert.NotContains(t, target.Annotations, FailedInputsHashAnnotation)
+}
@@ -0,0 +1,102 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"embed"
+	"encoding/json"
+	goerrors "errors"
+	"fmt"
+	"io/fs"
+	apiextensions "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	"k8s.io/apiextensions-apiserver/pkg/apiserver/validation"
+	utiljson "k8s.io/apimachinery/pkg/util/json"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"k8s.io/kube-openapi/pkg/validation/validate"
+	"sigs.k8s.io/yaml"
+	"strings"
+	"sync"
+)
+
+// schemas holds the spec schemas of the template kinds as generated for the KCC types,
+// hack/relaxcrd writes them before relaxing the CRDs.
+//
+//go:embed schemas/*.yaml
+var schemas embed.FS
+
+var specValidators sync.Map
+
+// validateSpec checks the rendered spec of a template of templateKind against the schema of the KCC type.
+// The template CRDs accept template expressions instead, and without an API server, e.g. in GitOps mode,
+// nothing else would catch values the schema does not allow.
+func validateSpec(templateKind string, spec interface{}) error {
+	validator, err := specValidator(templateKind)
+	if err != nil || validator == nil {
+		return err
+	}
+	return validateTree(validator, spec)
+}
+
+func validateTree(validator *validate.SchemaValidator, spec interface{}) error {
+	data, err := json.Marshal(spec)
+	if err != nil {
+		return fmt.Errorf("failed to marshal spec; %w", err)
+	}
+	// integers are validated as int64 like in the API server
+	var tree interface{}
+	if err := utiljson.Unmarshal(data, &tree); err != nil {
+		return fmt.Errorf("failed to parse spec; %w", err)
+	}
+	if errs := validation.ValidateCustomResource(field.NewPath("spec"), tree, validator); len(errs) > 0 {
+		return fmt.Errorf("rendered spec is invalid; %w", errs.ToAggregate())
+	}
+	return nil
+}
+
+// specValidator returns the validator of the spec of templateKind, nil for kinds without a schema.
+func specValidator(templateKind string) (*validate.SchemaValidator, error) {
+	if v, ok := specValidators.Load(templateKind); ok {
+		return v.(*validate.SchemaValidator), nil
+	}
+	data, err := schemas.ReadFile("schemas/" + strings.ToLower(templateKind) + ".yaml")
+	if goerrors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read schema of %s; %w", templateKind, err)
+	}
+	schema := &apiextensionsv1.JSONSchemaProps{}
+	if err := yaml.Unmarshal(data, schema); err != nil {
+		return nil, fmt.Errorf("failed to parse schema of %s; %w", templateKind, err)
+	}
+	validator, err := newSchemaValidator(schema)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build validator of %s; %w", templateKind, err)
+	}
+	specValidators.Store(templateKind, validator)
+	return validator, nil
+}
+
+func newSchemaValidator(schema *apiextensionsv1.JSONSchemaProps) (*validate.SchemaValidator, error) {
+	internal := &apiextensions.JSONSchemaProps{}
+	if err := apiextensionsv1.Convert_v1_JSONSchemaProps_To_apiextensions_JSONSchemaProps(schema, internal, nil); err != nil {
+		return nil, err
+	}
+	validator, _, err := validation.NewSchemaValidator(&apiextensions.CustomResourceValidation{OpenAPIV3Schema: internal})
+	return validator, err
+}
@@ -0,0 +1,77 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"context"
+	pubsub "github.com/GoogleCloudPlatform/k8s-config-connector/pkg/apis/pubsub/v1beta1"
+	api "github.com/slamdev/config-connector-templater/api/v1alpha1"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"testing"
+)
+
+func TestValidateTree(t *testing.T) {
+	validator, err := newSchemaValidator(&apiextensionsv1.JSONSchemaProps{
+		Type: "object",
+		Properties: map[string]apiextensionsv1.JSONSchemaProps{
+			"storage": {Type: "string", Enum: []apiextensionsv1.JSON{{Raw: []byte(`"STANDARD"`)}, {Raw: []byte(`"NEARLINE"`)}}},
+			"retries": {Type: "integer", Minimum: new(float64)},
+		},
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, validateTree(validator, map[string]interface{}{"storage": "NEARLINE", "retries": 3}))
+
+	err = validateTree(validator, map[string]interface{}{"storage": "ARCHIVE"})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "spec.storage")
+	assert.Contains(t, err.Error(), `Unsupported value: "ARCHIVE"`)
+
+	err = validateTree(validator, map[string]interface{}{"retries": -1})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "spec.retries")
+}
+
+func TestValidateSpec(t *testing.T) {
+	ctx := context.Background()
+	// the templated CRD accepts any document, the KCC schema requires the regions of a storage policy
+	topic := &api.PubSubTopicTemplate{ObjectMeta: metav1.ObjectMeta{Name: "orders", Namespace: "team1"}}
+	topic.Annotations = map[string]string{TemplateAnnotation: "messageStoragePolicy: {}"}
+	cli := newFakeCli(topic, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team1"}})
+
+	opts, hash, err := renderInputs(ctx, cli, Config{}, topic)
+	assert.NoError(t, err)
+	err = createTemplatedResource(ctx, cli, Config{}, topic, &pubsub.PubSubTopic{}, opts, hash)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "spec.messageStoragePolicy.allowedPersistenceRegions")
+	assert.NoError(t, cli.Get(ctx, client.ObjectKeyFromObject(topic), topic))
+	cond := meta.FindStatusCondition(topic.Status.Conditions, RenderedCondition)
+	assert.NotNil(t, cond)
+	assert.Equal(t, RenderFailedReason, cond.Reason)
+
+	topic.Annotations[TemplateAnnotation] = "messageStoragePolicy: {allowedPersistenceRegions: [europe-west1]}"
+	opts, hash, err = renderInputs(ctx, cli, Config{}, topic)
+	assert.NoError(t, err)
+	assert.NoError(t, createTemplatedResource(ctx, cli, Config{}, topic, &pubsub.PubSubTopic{}, opts, hash))
+
+	// kinds without a schema are not validated
+	assert.NoError(t, validateSpec("Unknown", map[string]interface{}{"any": true}))
+}
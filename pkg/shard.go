@@ -0,0 +1,137 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"strconv"
+	"strings"
+)
+
+// ShardLabel pins a template to a shard, templates without it are assigned by a hash of their namespace.
+// Rendered resources inherit the label, so their events reach the same shard.
+const ShardLabel = AnnotationPrefix + "shard"
+
+// Sharding splits templates between several templater replicas, each one reconciling a single shard.
+type Sharding struct {
+	// Shards is the number of shards, 0 or 1 disables sharding.
+	Shards int
+	// ID is the shard handled by this replica, from 0 to Shards-1.
+	ID int
+}
+
+// Enabled reports whether templates are split between replicas.
+func (s Sharding) Enabled() bool {
+	return s.Shards > 1
+}
+
+// Validate checks that ID is one of the shards.
+func (s Sharding) Validate() error {
+	if s.Enabled() && (s.ID < 0 || s.ID >= s.Shards) {
+		return fmt.Errorf("shard id %d is out of range [0, %d)", s.ID, s.Shards)
+	}
+	return nil
+}
+
+// Owns reports whether obj belongs to the shard of this replica.
+func (s Sharding) Owns(obj client.Object) bool {
+	if !s.Enabled() {
+		return true
+	}
+	return ShardOf(obj, s.Shards) == s.ID
+}
+
+// Templates lists the templates of the kind of templateType in the shard of this replica that match filter.
+// Events of other objects, e.g. cluster scoped policies or templates of another shard, reach every replica
+// and each one enqueues the templates of its own shard.
+func (s Sharding) Templates(ctx context.Context, cli CliCli, templateType client.Object, filter func(*unstructured.Unstructured) bool, opts ...client.ListOption) ([]types.NamespacedName, error) {
+	list, err := newList(cli, templateType)
+	if err != nil {
+		return nil, err
+	}
+	if err := cli.List(ctx, list, opts...); err != nil {
+		return nil, fmt.Errorf("failed to list templates; %w", err)
+	}
+	items, err := meta.ExtractList(list)
+	if err != nil {
+		return nil, err
+	}
+	var names []types.NamespacedName
+	for _, item := range items {
+		obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(item)
+		if err != nil {
+			continue
+		}
+		u := &unstructured.Unstructured{Object: obj}
+		if s.Owns(u) && filter(u) {
+			names = append(names, types.NamespacedName{Namespace: u.GetNamespace(), Name: u.GetName()})
+		}
+	}
+	return names, nil
+}
+
+// TemplatesIn lists the templates of this shard in the namespace of obj, all of them for cluster scoped objects
+// such as ClusterTemplateDefaults and TemplatePolicy.
+func (s Sharding) TemplatesIn(ctx context.Context, cli CliCli, templateType client.Object, obj client.Object) ([]types.NamespacedName, error) {
+	return s.Templates(ctx, cli, templateType, func(*unstructured.Unstructured) bool {
+		return true
+	}, client.InNamespace(obj.GetNamespace()))
+}
+
+// TemplatesReferencing lists the templates of this shard whose spec references the template ref, see ReferencesTemplate.
+func (s Sharding) TemplatesReferencing(ctx context.Context, cli CliCli, templateType client.Object, ref client.Object) ([]types.NamespacedName, error) {
+	return s.Templates(ctx, cli, templateType, func(u *unstructured.Unstructured) bool {
+		return ReferencesTemplate(u, ref)
+	})
+}
+
+// LeaderElectionID derives a separate leader election per shard, so every shard has its own leader.
+func (s Sharding) LeaderElectionID(id string) string {
+	if !s.Enabled() {
+		return id
+	}
+	return fmt.Sprintf("shard-%d-%s", s.ID, id)
+}
+
+// ShardOf returns the shard of obj, a valid shard label wins over the namespace hash.
+func ShardOf(obj client.Object, shards int) int {
+	if v, ok := obj.GetLabels()[ShardLabel]; ok {
+		if shard, err := strconv.Atoi(strings.TrimSpace(v)); err == nil && shard >= 0 && shard < shards {
+			return shard
+		}
+	}
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(obj.GetNamespace()))
+	return int(h.Sum32() % uint32(shards))
+}
+
+// ShardFromHostname takes the shard id from the ordinal of a StatefulSet pod name, e.g. templater-2.
+func ShardFromHostname(hostname string) (int, error) {
+	i := strings.LastIndex(hostname, "-")
+	id, err := strconv.Atoi(hostname[i+1:])
+	if i < 0 || err != nil {
+		return 0, fmt.Errorf("hostname %q does not end with a pod ordinal", hostname)
+	}
+	return id, nil
+}
@@ -0,0 +1,103 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"context"
+	api "github.com/slamdev/config-connector-templater/api/v1alpha1"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"strconv"
+	"testing"
+)
+
+func TestShardOf(t *testing.T) {
+	a := &api.PubSubTopicTemplate{ObjectMeta: metav1.ObjectMeta{Name: "a", Namespace: "team1"}}
+	b := &api.PubSubTopicTemplate{ObjectMeta: metav1.ObjectMeta{Name: "b", Namespace: "team1"}}
+	assert.Equal(t, ShardOf(a, 3), ShardOf(b, 3))
+
+	b.Labels = map[string]string{ShardLabel: "2"}
+	assert.Equal(t, 2, ShardOf(b, 3))
+
+	b.Labels[ShardLabel] = "3"
+	assert.Equal(t, ShardOf(a, 3), ShardOf(b, 3))
+}
+
+func TestShardingOwns(t *testing.T) {
+	template := &api.PubSubTopicTemplate{ObjectMeta: metav1.ObjectMeta{Namespace: "team1", Labels: map[string]string{ShardLabel: "1"}}}
+	assert.True(t, Sharding{}.Owns(template))
+	assert.True(t, Sharding{Shards: 2, ID: 1}.Owns(template))
+	assert.False(t, Sharding{Shards: 2, ID: 0}.Owns(template))
+
+	assert.Equal(t, "e9aa28d2.slamdev.net", Sharding{}.LeaderElectionID("e9aa28d2.slamdev.net"))
+	assert.Equal(t, "shard-1-e9aa28d2.slamdev.net", Sharding{Shards: 2, ID: 1}.LeaderElectionID("e9aa28d2.slamdev.net"))
+	assert.Error(t, Sharding{Shards: 2, ID: 2}.Validate())
+}
+
+func TestShardFromHostname(t *testing.T) {
+	id, err := ShardFromHostname("templater-controller-manager-2")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, id)
+
+	_, err = ShardFromHostname("templater")
+	assert.Error(t, err)
+}
+
+func TestShardingTemplates(t *testing.T) {
+	ctx := context.Background()
+	var objs []client.Object
+	for _, ns := range []string{"team1", "team2", "team3", "team4"} {
+		objs = append(objs, &api.PubSubTopicTemplate{ObjectMeta: metav1.ObjectMeta{Name: "topic", Namespace: ns}})
+	}
+	pinned := &api.PubSubTopicTemplate{ObjectMeta: metav1.ObjectMeta{Name: "pinned", Namespace: "team1"}}
+	pinned.Labels = map[string]string{ShardLabel: strconv.Itoa(1 - ShardOf(objs[0], 2))}
+	objs = append(objs, pinned)
+	cli := newFakeCli(objs...)
+	all := func(*unstructured.Unstructured) bool { return true }
+
+	// every template is listed by exactly one shard
+	seen := make(map[types.NamespacedName]int)
+	for id := 0; id < 2; id++ {
+		sharding := Sharding{Shards: 2, ID: id}
+		names, err := sharding.Templates(ctx, cli, &api.PubSubTopicTemplate{}, all)
+		assert.NoError(t, err)
+		for _, name := range names {
+			seen[name]++
+			tpl := &api.PubSubTopicTemplate{}
+			assert.NoError(t, cli.Get(ctx, name, tpl))
+			assert.True(t, sharding.Owns(tpl))
+		}
+	}
+	assert.Len(t, seen, len(objs))
+	for name, n := range seen {
+		assert.Equal(t, 1, n, name.String())
+	}
+
+	// the pinned template is listed by its own shard, not by the shard of its namespace
+	names, err := Sharding{Shards: 2, ID: ShardOf(pinned, 2)}.Templates(ctx, cli, &api.PubSubTopicTemplate{}, all, client.InNamespace("team1"))
+	assert.NoError(t, err)
+	assert.Equal(t, []types.NamespacedName{{Namespace: "team1", Name: "pinned"}}, names)
+
+	names, err = Sharding{}.Templates(ctx, cli, &api.PubSubTopicTemplate{}, func(u *unstructured.Unstructured) bool {
+		return u.GetName() == "pinned"
+	})
+	assert.NoError(t, err)
+	assert.Len(t, names, 1)
+}
@@ -0,0 +1,85 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"reflect"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// RenderedCondition reports whether the template could be rendered into the target spec.
+	RenderedCondition = "Rendered"
+
+	RenderSucceededReason     = "RenderSucceeded"
+	RenderFailedReason        = "RenderFailed"
+	RenderLimitExceededReason = "RenderLimitExceeded"
+)
+
+// ReportRenderError sets the Rendered condition of src to False with the render error.
+func ReportRenderError(ctx context.Context, cli CliCli, src client.Object, err error) error {
+	reason := RenderFailedReason
+	if errors.Is(err, ErrRenderLimitExceeded) {
+		reason = RenderLimitExceededReason
+	}
+	return updateCondition(ctx, cli, src, metav1.Condition{
+		Type:    RenderedCondition,
+		Status:  metav1.ConditionFalse,
+		Reason:  reason,
+		Message: err.Error(),
+	})
+}
+
+// failRender reports the render error on src and returns it.
+func failRender(ctx context.Context, cli CliCli, src client.Object, err error) error {
+	if err := ReportRenderError(ctx, cli, src, err); err != nil {
+		return fmt.Errorf("failed to report render error; %w", err)
+	}
+	return fmt.Errorf("failed to render template; %w", err)
+}
+
+func updateCondition(ctx context.Context, cli CliCli, src client.Object, cond metav1.Condition) error {
+	if !setCondition(src, cond) {
+		return nil
+	}
+	return cli.Status().Update(ctx, src)
+}
+
+// setCondition sets the condition on src in memory and reports whether anything changed.
+func setCondition(src client.Object, cond metav1.Condition) bool {
+	cond.ObservedGeneration = src.GetGeneration()
+	conditions := getConditions(src)
+	if existing := meta.FindStatusCondition(*conditions, cond.Type); existing != nil &&
+		existing.Status == cond.Status && existing.Reason == cond.Reason &&
+		existing.Message == cond.Message && existing.ObservedGeneration == cond.ObservedGeneration {
+		return false
+	}
+	meta.SetStatusCondition(conditions, cond)
+	return true
+}
+
+func getConditions(target interface{}) *[]metav1.Condition {
+	v := reflect.ValueOf(target).Elem()
+	statusValue := v.FieldByName("Status")
+	conditionsValue := statusValue.FieldByName("Conditions")
+	return conditionsValue.Addr().Interface().(*[]metav1.Condition)
+}